@@ -7,8 +7,11 @@ import (
 	"github.com/ferama/crauti/pkg/conf"
 	"github.com/ferama/crauti/pkg/gateway"
 	"github.com/ferama/crauti/pkg/gateway/kube"
+	"github.com/ferama/crauti/pkg/identity"
 	"github.com/ferama/crauti/pkg/logger"
 	"github.com/ferama/crauti/pkg/redis"
+	"github.com/ferama/crauti/pkg/store"
+	"github.com/ferama/crauti/pkg/warmup"
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
@@ -69,7 +72,10 @@ var rootCmd = &cobra.Command{
 			// I have the updated config at this point
 			// Notify the services
 			redis.Update()
+			store.Update()
+			identity.Update()
 			gwServer.Update()
+			warmup.Instance().Update(gwServer.Handler())
 
 			if conf.ConfInst.Gateway.Kubernetes.Autodiscover {
 				kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
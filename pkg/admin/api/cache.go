@@ -2,8 +2,13 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 
-	"github.com/ferama/crauti/pkg/redis"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/middleware/cache"
+	"github.com/ferama/crauti/pkg/middleware/collector"
+	"github.com/ferama/crauti/pkg/store"
+	"github.com/ferama/crauti/pkg/utils"
 	"github.com/gin-gonic/gin"
 )
 
@@ -15,10 +20,16 @@ func cacheRoutes(router *gin.RouterGroup) {
 
 	router.POST("flush", r.flush)
 	router.POST("flushall", r.flushAll)
+	router.POST("purge", r.purge)
+
+	router.GET("keys", r.keys)
+	router.GET("entry", r.entry)
+	router.DELETE("entry", r.deleteEntry)
+	router.GET("stats", r.stats)
 }
 
 func (r *cacheGroup) flushAll(c *gin.Context) {
-	redis.CacheInstance().FlushallAsync()
+	store.Instance().FlushAll()
 	c.JSON(200, gin.H{
 		"message": "full cache flush requested",
 	})
@@ -36,9 +47,201 @@ func (r *cacheGroup) flush(c *gin.Context) {
 		})
 		return
 	}
-	go redis.CacheInstance().Flush(data.Match)
+	go store.Instance().Flush(data.Match)
 
 	c.JSON(200, gin.H{
 		"message": "cache flush requested",
 	})
 }
+
+// Purges the cached responses by tag, by url, by path (whatever the query is)
+// or by mount point. Exactly one of them needs to be set. The matchHost of the mount point
+// can be set along with it. Soft purges mark the responses as stale instead of removing them.
+//
+// curl -X POST -d '{"tag": "product-42", "soft": true}' http://localhost:9000/api/cache/purge
+// curl -X POST -d '{"url": "/api/config?v=1"}' http://localhost:9000/api/cache/purge
+// curl -X POST -d '{"path": "/api/config"}' http://localhost:9000/api/cache/purge
+// curl -X POST -d '{"mountPoint": "/api", "matchHost": "example.com"}' http://localhost:9000/api/cache/purge
+func (r *cacheGroup) purge(c *gin.Context) {
+	type mapping struct {
+		Tag        string `json:"tag"`
+		URL        string `json:"url"`
+		Path       string `json:"path"`
+		MountPoint string `json:"mountPoint"`
+		MatchHost  string `json:"matchHost"`
+		Soft       bool   `json:"soft"`
+	}
+	data := mapping{}
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	set := 0
+	for _, v := range []string{data.Tag, data.URL, data.Path, data.MountPoint} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "exactly one of tag, url, path or mountPoint is required",
+		})
+		return
+	}
+
+	var purged int
+	var err error
+	switch {
+	case data.Tag != "":
+		purged, err = cache.PurgeTag(data.Tag, data.Soft)
+	case data.URL != "":
+		purged, err = cache.PurgeURL(data.URL, data.Soft)
+	case data.Path != "":
+		purged, err = cache.PurgePath(data.Path, data.Soft)
+	default:
+		purged, err = cache.PurgeMountPoint(data.MatchHost, data.MountPoint, data.Soft)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "cache purged",
+		"purged":  purged,
+	})
+}
+
+// Lists the cached entries of a mount point, ordered by expiration. Limit defaults
+// to 100 and it is capped to 1000. MatchHost is the one of the mount point
+//
+// curl "http://localhost:9000/api/cache/keys?mountPoint=/api&matchHost=example.com&offset=0&limit=50"
+func (r *cacheGroup) keys(c *gin.Context) {
+	mountPoint := c.Query("mountPoint")
+	if mountPoint == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "mountPoint is required",
+		})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid offset",
+		})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid limit",
+		})
+		return
+	}
+
+	entries, total, err := cache.ListEntries(c.Query("matchHost"), mountPoint, offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"entries": entries,
+	})
+}
+
+// Returns the metadata of a cached entry. The key is the one returned
+// by the keys endpoint
+//
+// curl "http://localhost:9000/api/cache/entry?key=..."
+func (r *cacheGroup) entry(c *gin.Context) {
+	key := c.Query("key")
+	info, ok := cache.Inspect(key)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "entry not found",
+		})
+		return
+	}
+	c.JSON(200, info)
+}
+
+// curl -X DELETE "http://localhost:9000/api/cache/entry?key=..."
+func (r *cacheGroup) deleteEntry(c *gin.Context) {
+	key := c.Query("key")
+	if key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "key is required",
+		})
+		return
+	}
+	if err := cache.Delete(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"message": "entry deleted",
+	})
+}
+
+// Returns the cache stats of each mount point. The hit ratio is computed
+// from the counters of this instance: hits are the requests served from
+// the cache (HIT, STALE and REVALIDATED), misses the ones that went to
+// the upstream (MISS). The bytes of the mount points with more than 1000
+// entries are estimated
+//
+// curl http://localhost:9000/api/cache/stats
+func (r *cacheGroup) stats(c *gin.Context) {
+	type mountPointStats struct {
+		MountPoint string  `json:"mountPoint"`
+		MatchHost  string  `json:"matchHost,omitempty"`
+		Entries    int     `json:"entries"`
+		Bytes      int64   `json:"bytes"`
+		Estimated  bool    `json:"estimated,omitempty"`
+		Hits       float64 `json:"hits"`
+		Misses     float64 `json:"misses"`
+		HitRatio   float64 `json:"hitRatio"`
+	}
+
+	out := []mountPointStats{}
+	for _, mp := range conf.ConfInst.MountPoints {
+		stats, err := cache.Stats(mp.MatchHost, mp.Path)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		totals := collector.MetricsInstance().CacheTotals(mp.Path, mp.MatchHost)
+		hits := totals[utils.CacheStatusHit] +
+			totals[utils.CacheStatusStale] +
+			totals[utils.CacheStatusRevalidated]
+		misses := totals[utils.CacheStatusMiss]
+
+		s := mountPointStats{
+			MountPoint: mp.Path,
+			MatchHost:  mp.MatchHost,
+			Entries:    stats.Entries,
+			Bytes:      stats.Bytes,
+			Estimated:  stats.Estimated,
+			Hits:       hits,
+			Misses:     misses,
+		}
+		if hits+misses > 0 {
+			s.HitRatio = hits / (hits + misses)
+		}
+		out = append(out, s)
+	}
+	c.JSON(200, out)
+}
@@ -10,4 +10,5 @@ func RootRouter(router *gin.RouterGroup) {
 	configRoutes(router.Group("/config"))
 	cacheRoutes(router.Group("/cache"))
 	mountPointRoutes(router.Group("/mount-point"))
+	warmupRoutes(router.Group("/warmup"))
 }
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ferama/crauti/pkg/warmup"
+	"github.com/gin-gonic/gin"
+)
+
+type warmupGroup struct{}
+
+func warmupRoutes(router *gin.RouterGroup) {
+	r := &warmupGroup{}
+	router.GET("", r.get)
+	router.POST("", r.post)
+}
+
+// Returns the progress of the last warmup run
+//
+// curl http://localhost:9000/api/warmup
+func (r *warmupGroup) get(c *gin.Context) {
+	c.JSON(200, warmup.Instance().Progress())
+}
+
+// Starts a warmup run. The configured urls are used if the body
+// doesn't list any
+//
+// curl -X POST http://localhost:9000/api/warmup
+// curl -X POST -d '{"urls": ["/api/items", "https://example.com/"]}' http://localhost:9000/api/warmup
+func (r *warmupGroup) post(c *gin.Context) {
+	type mapping struct {
+		URLs []string `json:"urls"`
+	}
+	data := mapping{}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&data); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	if !warmup.Instance().Run(data.URLs) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "a warmup run is already in progress",
+		})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "warmup started",
+	})
+}
@@ -7,6 +7,10 @@ import (
 
 	"github.com/ferama/crauti/pkg/admin/api"
 	"github.com/ferama/crauti/pkg/admin/ui"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/identity"
+	"github.com/ferama/crauti/pkg/redis"
+	"github.com/ferama/crauti/pkg/store"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -57,11 +61,23 @@ func NewAdminServer() *adminServer {
 }
 
 func (s *adminServer) setupRoutes() {
-	// setup health endpoint
+	// setup health endpoint. The gateway keeps serving without the cache
+	// if redis is down: the redis status is reported but the
+	// endpoint still answers with a 200
 	s.router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
+		res := gin.H{
 			"message": "ok",
-		})
+		}
+		if usesRedis() {
+			res["redis"] = redis.CacheInstance().Health()
+		}
+		c.JSON(200, res)
+	})
+	// publish the key signing the internal identity tokens, so the
+	// upstreams can verify them
+	s.router.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.Data(http.StatusOK, "application/json", identity.Instance().JWKS())
 	})
 	// install the prometheus metrics endpoint
 	s.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
@@ -70,6 +86,20 @@ func (s *adminServer) setupRoutes() {
 	api.RootRouter(s.router.Group("/api"))
 }
 
+// true if the cache store or the fill locks use redis
+func usesRedis() bool {
+	if conf.ConfInst.CacheStore.Backend != store.BackendMemory {
+		return true
+	}
+	for _, mp := range conf.ConfInst.MountPoints {
+		cache := mp.Middlewares.Cache
+		if cache.IsEnabled() && cache.IsDistributedLock() {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *adminServer) Start() {
 	s.router.Run(adminApiListenAddress)
 }
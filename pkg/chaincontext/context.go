@@ -18,10 +18,12 @@ const chainContextKey contextKey = "chain-context"
 // It is easily accessed from all the middleware without requiring
 // any custom variable passing and stuff
 type ChainContext struct {
-	Conf  *conf.MountPoint
-	Proxy *ProxyContext
-	Cache *CacheContext
-	Auth  *AuthContext
+	Conf    *conf.MountPoint
+	Proxy   *ProxyContext
+	Cache   *CacheContext
+	Auth    *AuthContext
+	Fault   *FaultContext
+	GraphQL *GraphQLContext
 
 	request *http.Request
 }
@@ -43,6 +45,8 @@ func NewChainContext() *ChainContext {
 		Auth: &AuthContext{
 			Authorized: false,
 		},
+		Fault:   &FaultContext{},
+		GraphQL: &GraphQLContext{},
 	}
 	return c
 }
@@ -52,8 +56,18 @@ func NewChainContext() *ChainContext {
 func (c *ChainContext) Reset(conf *conf.MountPoint, r *http.Request) {
 	c.Conf = conf
 	c.Proxy.ProxiedRequest = false
+	c.Proxy.Upstream = ""
 	c.Cache.Status = utils.CacheStatusMiss
+	c.Cache.Stored = false
+	c.Cache.TTL = 0
+	c.Cache.NotStored = ""
 	c.Auth.Authorized = false
+	c.Auth.JwtClaims = nil
+	c.Fault.Delay = 0
+	c.Fault.AbortStatus = 0
+	c.GraphQL.Operation = ""
+	c.GraphQL.OperationName = ""
+	c.GraphQL.Key = ""
 	c.request = r
 }
 
@@ -78,6 +92,38 @@ func (c *ChainContext) Update() *http.Request {
 	return c.request
 }
 
+// Returns a copy of the request holding a copy of the chain context. The
+// returned request is detached from the client connection: it is not
+// canceled when the client goes away. Intended for background work like
+// cache refreshes
+func (c *ChainContext) Detach() *http.Request {
+	dc := ChainContext{
+		Conf:  c.Conf,
+		Proxy: &ProxyContext{},
+		Cache: &CacheContext{
+			Status: c.Cache.Status,
+		},
+		Auth: &AuthContext{
+			JwtClaims:  c.Auth.JwtClaims,
+			Authorized: c.Auth.Authorized,
+		},
+		Fault: &FaultContext{},
+		GraphQL: &GraphQLContext{
+			Operation:     c.GraphQL.Operation,
+			OperationName: c.GraphQL.OperationName,
+			Key:           c.GraphQL.Key,
+		},
+	}
+	dc.request = c.request.Clone(context.Background())
+	// the body of the original request could be already consumed
+	if c.request.GetBody != nil {
+		if body, err := c.request.GetBody(); err == nil {
+			dc.request.Body = body
+		}
+	}
+	return dc.Update()
+}
+
 type ProxyContext struct {
 	// Is set to true, the request effectively reached the upstream
 	// If not, it probably was served from the cache
@@ -85,13 +131,52 @@ type ProxyContext struct {
 	UpstreamRequestStartTime time.Time
 	// upstream request URI including rewrites
 	URI string
+	// the upstream target that served the request
+	Upstream string
 }
 
 type CacheContext struct {
 	Status string
+	// true if the upstream response was stored, with its TTL
+	Stored bool
+	TTL    time.Duration
+	// why the upstream response was not stored, if any
+	NotStored string
+}
+
+// returns true if the response was served from the cache and the
+// upstream doesn't need to be poked
+func (c *CacheContext) ServedFromCache() bool {
+	return c.Status == utils.CacheStatusHit || c.Status == utils.CacheStatusStale
 }
 
 type AuthContext struct {
 	JwtClaims  jwt.MapClaims
 	Authorized bool
 }
+
+// Holds the synthetic faults injected by the fault injection middleware.
+// Used to label the request logs
+type FaultContext struct {
+	Delay       time.Duration
+	AbortStatus int
+}
+
+func (f *FaultContext) Injected() bool {
+	return f.Delay > 0 || f.AbortStatus > 0
+}
+
+// The GraphQL operation of the request. Set by the graphql middleware
+type GraphQLContext struct {
+	// query, mutation or subscription. Empty if the request is not
+	// a GraphQL one or it was not inspected
+	Operation     string
+	OperationName string
+	// identifies the normalized operation and its variables
+	Key string
+}
+
+// returns true if the operation can be served from the cache
+func (c *GraphQLContext) Cacheable() bool {
+	return c.Operation == "query"
+}
@@ -0,0 +1,83 @@
+package conf
+
+import "time"
+
+const (
+	AffinityModeCookie = "cookie"
+	AffinityModeHash   = "hash"
+
+	AffinityHashHeader = "header"
+	AffinityHashIP     = "ip"
+	AffinityHashClaim  = "claim"
+)
+
+type affinityCookie struct {
+	// default: crauti_affinity
+	Name string `yaml:"name,omitempty"`
+	// the cookie lifetime. Use 0 for a session cookie
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// Do not use this directly. Use the IsSecure function instead
+	Secure *bool `yaml:"secure,omitempty"`
+	// Do not use this directly. Use the IsHTTPOnly function instead
+	HTTPOnly *bool `yaml:"httpOnly,omitempty"`
+}
+
+// Helper function that check for nil value on Secure field
+func (c *affinityCookie) IsSecure() bool {
+	return c.Secure != nil && *c.Secure
+}
+
+// Helper function that check for nil value on HTTPOnly field
+func (c *affinityCookie) IsHTTPOnly() bool {
+	return c.HTTPOnly != nil && *c.HTTPOnly
+}
+
+type affinityHash struct {
+	// what the requests are hashed on. One of: header, ip, claim
+	Source string `yaml:"source,omitempty"`
+	// the header or the jwt claim name
+	Name string `yaml:"name,omitempty"`
+}
+
+// Affinity pins the clients to one of the mount point upstream targets.
+// The pinned target is replaced when it goes unhealthy: the cookie is
+// reissued, the hash moves to the next target of the ring
+type Affinity struct {
+	// One of:
+	//   cookie: the gateway issues a cookie naming the target
+	//   hash: consistent hashing on a header, the client ip or a
+	//     jwt claim. The requests without it are balanced round robin
+	// Leave it empty to balance all the requests round robin
+	Mode   string         `yaml:"mode,omitempty"`
+	Cookie affinityCookie `yaml:"cookie,omitempty"`
+	Hash   affinityHash   `yaml:"hash,omitempty"`
+}
+
+func (c *Affinity) clone() Affinity {
+	secure := *c.Cookie.Secure
+	httpOnly := *c.Cookie.HTTPOnly
+	out := Affinity{
+		Mode: c.Mode,
+		Cookie: affinityCookie{
+			Name:     c.Cookie.Name,
+			TTL:      c.Cookie.TTL,
+			Secure:   &secure,
+			HTTPOnly: &httpOnly,
+		},
+		Hash: c.Hash,
+	}
+	return out
+}
+
+// UpstreamHealth defines when an upstream target is considered
+// unhealthy. The health is passive: it is derived from the proxied
+// requests. Only the transport errors (refused connections, timeouts)
+// count as failures
+type UpstreamHealth struct {
+	// consecutive failures that mark the target unhealthy. Use 0 to
+	// never mark the targets unhealthy
+	MaxFails int `yaml:"maxFails,omitempty"`
+	// how long an unhealthy target is skipped. Then it receives the
+	// requests again, until it fails
+	FailTimeout time.Duration `yaml:"failTimeout,omitempty"`
+}
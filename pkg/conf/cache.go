@@ -1,6 +1,11 @@
 package conf
 
-import "time"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Cache struct {
 	// Do not use this directly. Use the IsEnabled function instead
@@ -10,17 +15,90 @@ type Cache struct {
 	Methods    []string      `yaml:"methods,omitempty"`
 	KeyHeaders []string      `yaml:"keyHeaders,omitempty"`
 	KeyClaims  []string      `yaml:"keyClaims,omitempty"`
+	// the response statuses that can be stored, optionally followed by
+	// their own TTL. Entries are status codes or classes (4xx) and exact
+	// codes take precedence over classes.
+	// Example: ["200", "404:30s", "5xx:never"]
+	// Responses with statuses that are not listed are never stored.
+	// An empty list allows every status.
+	// In rfc9111 mode the TTL replaces the fallback one: the explicit
+	// freshness sent by the upstream still takes precedence
+	CacheableStatuses []string `yaml:"cacheableStatuses,omitempty"`
+	// the cache key policy
+	Key CacheKey `yaml:"key,omitempty"`
+	// the cache status response headers
+	Headers CacheHeaders `yaml:"headers,omitempty"`
+	// the invalidation policy of the unsafe requests
+	Invalidation CacheInvalidation `yaml:"invalidation,omitempty"`
+	// if true, the cache follows the RFC 9111 rules: freshness is derived
+	// from the upstream response headers (TTL is used as fallback) and
+	// the request Cache-Control directives are honoured.
+	// Do not use this directly. Use the IsRFC9111 function instead
+	RFC9111 *bool `yaml:"rfc9111,omitempty"`
+	// how long a stale entry is kept into the store after its
+	// expiration. Stale entries carrying validators (ETag, Last-Modified)
+	// are revalidated with the upstream using conditional requests.
+	// In rfc9111 mode they are served to clients sending the max-stale
+	// directive too
+	KeepStale time.Duration `yaml:"keepStale,omitempty"`
+	// stale entries are served immediately for this time after their
+	// expiration while they are refreshed in background.
+	// Overridden by the stale-while-revalidate response directive
+	StaleWhileRevalidate time.Duration `yaml:"staleWhileRevalidate,omitempty"`
+	// stale entries are served for this time after their expiration if
+	// the upstream fails (5xx responses and transport errors).
+	// Overridden by the stale-if-error response directive
+	StaleIfError time.Duration `yaml:"staleIfError,omitempty"`
+	// responses larger than this are passed through and never cached.
+	// Example: 50mb. Use 0 to disable the limit: the responses of
+	// unknown length (chunked) are still buffered up to 64mb
+	MaxObjectSize string `yaml:"maxObjectSize,omitempty"`
+	// how range requests are handled on cache misses. One of:
+	//   passthrough: the request is forwarded as is. Partial responses
+	//     are not stored
+	//   full: the full object is requested to the upstream and stored.
+	//     The requested range is served from it
+	RangeMiss string `yaml:"rangeMiss,omitempty"`
+	// coalesce the cache misses across the gateway replicas using a
+	// fill lock stored into redis. Only the lock holder pokes the upstream,
+	// the other replicas wait for the entry.
+	// Do not use this directly. Use the IsDistributedLock function instead
+	DistributedLock *bool `yaml:"distributedLock,omitempty"`
+	// max time the fill lock is held. If the holder dies, the waiters
+	// take over after this time
+	LockLease time.Duration `yaml:"lockLease,omitempty"`
+	// max time a replica waits for the entry filled by the lock holder
+	// before poking the upstream itself
+	LockWait time.Duration `yaml:"lockWait,omitempty"`
 }
 
 func (c *Cache) clone() Cache {
 	enabled := *c.Enabled
+	rfc9111 := *c.RFC9111
+	distributedLock := *c.DistributedLock
 	out := Cache{
-		Enabled: &enabled,
-		TTL:     c.TTL,
+		Enabled:   &enabled,
+		TTL:       c.TTL,
+		RFC9111:   &rfc9111,
+		KeepStale: c.KeepStale,
+		Key:       c.Key.clone(),
+		Headers:   c.Headers.clone(),
+
+		Invalidation: c.Invalidation.clone(),
+
+		StaleWhileRevalidate: c.StaleWhileRevalidate,
+		StaleIfError:         c.StaleIfError,
+		MaxObjectSize:        c.MaxObjectSize,
+		RangeMiss:            c.RangeMiss,
+
+		DistributedLock: &distributedLock,
+		LockLease:       c.LockLease,
+		LockWait:        c.LockWait,
 	}
 	out.Methods = append(out.Methods, c.Methods...)
 	out.KeyHeaders = append(out.KeyHeaders, c.KeyHeaders...)
 	out.KeyClaims = append(out.KeyClaims, c.KeyClaims...)
+	out.CacheableStatuses = append(out.CacheableStatuses, c.CacheableStatuses...)
 	return out
 }
 
@@ -29,6 +107,16 @@ func (c *Cache) IsEnabled() bool {
 	return c.Enabled != nil && *c.Enabled
 }
 
+// Helper function that check for nil value on RFC9111 field
+func (c *Cache) IsRFC9111() bool {
+	return c.RFC9111 != nil && *c.RFC9111
+}
+
+// Helper function that check for nil value on DistributedLock field
+func (c *Cache) IsDistributedLock() bool {
+	return c.DistributedLock != nil && *c.DistributedLock
+}
+
 // slice types needs manually merging logic
 // When not defined (nil case) we should use the global values
 // If defined but empty ([] case), we should use a nil value
@@ -50,4 +138,91 @@ func (c *Cache) merge(target Cache) {
 	} else if len(target.KeyClaims) == 0 {
 		c.KeyClaims = nil
 	}
+
+	if target.CacheableStatuses == nil {
+		c.CacheableStatuses = ConfInst.Middlewares.Cache.CacheableStatuses
+	} else if len(target.CacheableStatuses) == 0 {
+		c.CacheableStatuses = nil
+	}
+
+	c.Key.merge(target.Key)
+	c.Invalidation.merge(target.Invalidation)
+}
+
+// Returns the TTL of the responses with the given status and false
+// if they can't be stored. Invalid entries are ignored
+func (c *Cache) StatusTTL(status int) (time.Duration, bool) {
+	if len(c.CacheableStatuses) == 0 {
+		return c.TTL, true
+	}
+	code := strconv.Itoa(status)
+	class := code[:1] + "xx"
+
+	var match *cacheableStatus
+	for _, s := range c.CacheableStatuses {
+		cs, err := parseCacheableStatus(s)
+		if err != nil {
+			continue
+		}
+		if cs.status == code {
+			match = &cs
+			break
+		}
+		if cs.status == class && match == nil {
+			match = &cs
+		}
+	}
+	if match == nil || match.never {
+		return 0, false
+	}
+	if match.ttl == 0 {
+		return c.TTL, true
+	}
+	return match.ttl, true
+}
+
+type cacheableStatus struct {
+	// a status code or a class (4xx)
+	status string
+	// zero if the cache TTL applies
+	ttl   time.Duration
+	never bool
+}
+
+// parses a CacheableStatuses entry. The format is <status>[:<ttl>|:never]
+func parseCacheableStatus(s string) (cacheableStatus, error) {
+	out := cacheableStatus{}
+
+	status, ttl, hasTTL := strings.Cut(strings.TrimSpace(s), ":")
+	status = strings.ToLower(strings.TrimSpace(status))
+	valid := len(status) == 3 && status[0] >= '1' && status[0] <= '5'
+	if valid && status[1:] != "xx" {
+		valid = isDigit(status[1]) && isDigit(status[2])
+	}
+	if !valid {
+		return out, fmt.Errorf("invalid status '%s'", status)
+	}
+	out.status = status
+
+	if !hasTTL {
+		return out, nil
+	}
+	ttl = strings.TrimSpace(ttl)
+	if ttl == "never" {
+		out.never = true
+		return out, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return out, err
+	}
+	if d <= 0 {
+		return out, fmt.Errorf("invalid TTL '%s'", ttl)
+	}
+	out.ttl = d
+	return out, nil
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
 }
@@ -0,0 +1,63 @@
+package conf
+
+// CacheHeaders defines the headers that report the cache status
+// to the clients
+type CacheHeaders struct {
+	// adds the Age header to the responses served from the cache.
+	// Do not use this directly. Use the IsAge function instead
+	Age *bool `yaml:"age,omitempty"`
+	// adds the RFC 9211 Cache-Status header.
+	// Do not use this directly. Use the IsCacheStatus function instead
+	CacheStatus *bool `yaml:"cacheStatus,omitempty"`
+	// default: Cache-Status
+	CacheStatusName string `yaml:"cacheStatusName,omitempty"`
+	// identifies the gateway into the Cache-Status header. Default: crauti
+	CacheName string `yaml:"cacheName,omitempty"`
+	// adds the X-Cache header (HIT, MISS, STALE...) for legacy tooling.
+	// Do not use this directly. Use the IsXCache function instead
+	XCache *bool `yaml:"xCache,omitempty"`
+	// default: X-Cache
+	XCacheName string `yaml:"xCacheName,omitempty"`
+	// hides the X-Generator header.
+	// Do not use this directly. Use the IsHideGenerator function instead
+	HideGenerator *bool `yaml:"hideGenerator,omitempty"`
+	// default: X-Generator
+	GeneratorName string `yaml:"generatorName,omitempty"`
+}
+
+func (c *CacheHeaders) clone() CacheHeaders {
+	age := *c.Age
+	cacheStatus := *c.CacheStatus
+	xCache := *c.XCache
+	hideGenerator := *c.HideGenerator
+	return CacheHeaders{
+		Age:             &age,
+		CacheStatus:     &cacheStatus,
+		CacheStatusName: c.CacheStatusName,
+		CacheName:       c.CacheName,
+		XCache:          &xCache,
+		XCacheName:      c.XCacheName,
+		HideGenerator:   &hideGenerator,
+		GeneratorName:   c.GeneratorName,
+	}
+}
+
+// Helper function that check for nil value on Age field
+func (c *CacheHeaders) IsAge() bool {
+	return c.Age != nil && *c.Age
+}
+
+// Helper function that check for nil value on CacheStatus field
+func (c *CacheHeaders) IsCacheStatus() bool {
+	return c.CacheStatus != nil && *c.CacheStatus
+}
+
+// Helper function that check for nil value on XCache field
+func (c *CacheHeaders) IsXCache() bool {
+	return c.XCache != nil && *c.XCache
+}
+
+// Helper function that check for nil value on HideGenerator field
+func (c *CacheHeaders) IsHideGenerator() bool {
+	return c.HideGenerator != nil && *c.HideGenerator
+}
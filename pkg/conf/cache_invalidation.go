@@ -0,0 +1,73 @@
+package conf
+
+// CacheInvalidation defines the cached responses invalidated by the
+// successful (2xx and 3xx) responses to unsafe requests.
+// The cached responses are invalidated in background once the response
+// of the unsafe request is forwarded: a request following it closely may
+// still get them. The invalidation is scoped to the mount point. With the
+// tiered store, the other replicas drop their L1 copies through redis
+// pub/sub
+type CacheInvalidation struct {
+	// Do not use this directly. Use the IsEnabled function instead
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// the request methods that trigger the invalidation
+	Methods []string `yaml:"methods,omitempty"`
+	// invalidates the paths of the Location and Content-Location
+	// response headers too. Only the urls on the request host are taken
+	// into account.
+	// Do not use this directly. Use the IsLocation function instead
+	Location *bool `yaml:"location,omitempty"`
+	// other paths invalidated by the mount point unsafe requests.
+	// The path.Match patterns (/api/items/*) scan all the cached entries
+	// of the mount point
+	RelatedPaths []string `yaml:"relatedPaths,omitempty"`
+	// marks the responses as stale instead of removing them.
+	// Do not use this directly. Use the IsSoft function instead
+	Soft *bool `yaml:"soft,omitempty"`
+}
+
+func (c *CacheInvalidation) clone() CacheInvalidation {
+	enabled := *c.Enabled
+	location := *c.Location
+	soft := *c.Soft
+	out := CacheInvalidation{
+		Enabled:  &enabled,
+		Location: &location,
+		Soft:     &soft,
+	}
+	out.Methods = append(out.Methods, c.Methods...)
+	out.RelatedPaths = append(out.RelatedPaths, c.RelatedPaths...)
+	return out
+}
+
+// Helper function that check for nil value on Enabled field
+func (c *CacheInvalidation) IsEnabled() bool {
+	return c.Enabled != nil && *c.Enabled
+}
+
+// Helper function that check for nil value on Location field
+func (c *CacheInvalidation) IsLocation() bool {
+	return c.Location != nil && *c.Location
+}
+
+// Helper function that check for nil value on Soft field
+func (c *CacheInvalidation) IsSoft() bool {
+	return c.Soft != nil && *c.Soft
+}
+
+// slice types needs manually merging logic
+// When not defined (nil case) we should use the global values
+// If defined but empty ([] case), we should use a nil value
+func (c *CacheInvalidation) merge(target CacheInvalidation) {
+	if target.Methods == nil {
+		c.Methods = ConfInst.Middlewares.Cache.Invalidation.Methods
+	} else if len(target.Methods) == 0 {
+		c.Methods = nil
+	}
+
+	if target.RelatedPaths == nil {
+		c.RelatedPaths = ConfInst.Middlewares.Cache.Invalidation.RelatedPaths
+	} else if len(target.RelatedPaths) == 0 {
+		c.RelatedPaths = nil
+	}
+}
@@ -0,0 +1,83 @@
+package conf
+
+// CacheKey defines how the request contributes to the cache key
+type CacheKey struct {
+	// sort the query parameters, so their order doesn't matter.
+	// Do not use this directly. Use the IsSortQuery function instead
+	SortQuery *bool `yaml:"sortQuery,omitempty"`
+	// if not empty, only these query parameters contribute to the key
+	IncludeParams []string `yaml:"includeParams,omitempty"`
+	// query parameters that don't contribute to the key. A trailing *
+	// matches by prefix. Example: utm_*
+	IgnoreParams []string `yaml:"ignoreParams,omitempty"`
+	// Do not use this directly. Use the IsLowercasePath function instead
+	LowercasePath *bool `yaml:"lowercasePath,omitempty"`
+	// cookies that contribute to the key
+	Cookies []string `yaml:"cookies,omitempty"`
+	// the request host contributes to the key.
+	// Do not use this directly. Use the IsHost function instead
+	Host *bool `yaml:"host,omitempty"`
+	// adds the computed key to the response headers.
+	// Do not use this directly. Use the IsDebugHeader function instead
+	DebugHeader *bool `yaml:"debugHeader,omitempty"`
+}
+
+func (c *CacheKey) clone() CacheKey {
+	sortQuery := *c.SortQuery
+	lowercasePath := *c.LowercasePath
+	host := *c.Host
+	debugHeader := *c.DebugHeader
+	out := CacheKey{
+		SortQuery:     &sortQuery,
+		LowercasePath: &lowercasePath,
+		Host:          &host,
+		DebugHeader:   &debugHeader,
+	}
+	out.IncludeParams = append(out.IncludeParams, c.IncludeParams...)
+	out.IgnoreParams = append(out.IgnoreParams, c.IgnoreParams...)
+	out.Cookies = append(out.Cookies, c.Cookies...)
+	return out
+}
+
+// Helper function that check for nil value on SortQuery field
+func (c *CacheKey) IsSortQuery() bool {
+	return c.SortQuery != nil && *c.SortQuery
+}
+
+// Helper function that check for nil value on LowercasePath field
+func (c *CacheKey) IsLowercasePath() bool {
+	return c.LowercasePath != nil && *c.LowercasePath
+}
+
+// Helper function that check for nil value on Host field
+func (c *CacheKey) IsHost() bool {
+	return c.Host != nil && *c.Host
+}
+
+// Helper function that check for nil value on DebugHeader field
+func (c *CacheKey) IsDebugHeader() bool {
+	return c.DebugHeader != nil && *c.DebugHeader
+}
+
+// slice types needs manually merging logic
+// When not defined (nil case) we should use the global values
+// If defined but empty ([] case), we should use a nil value
+func (c *CacheKey) merge(target CacheKey) {
+	if target.IncludeParams == nil {
+		c.IncludeParams = ConfInst.Middlewares.Cache.Key.IncludeParams
+	} else if len(target.IncludeParams) == 0 {
+		c.IncludeParams = nil
+	}
+
+	if target.IgnoreParams == nil {
+		c.IgnoreParams = ConfInst.Middlewares.Cache.Key.IgnoreParams
+	} else if len(target.IgnoreParams) == 0 {
+		c.IgnoreParams = nil
+	}
+
+	if target.Cookies == nil {
+		c.Cookies = ConfInst.Middlewares.Cache.Key.Cookies
+	} else if len(target.Cookies) == 0 {
+		c.Cookies = nil
+	}
+}
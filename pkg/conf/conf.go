@@ -1,6 +1,7 @@
 package conf
 
 import (
+	"regexp"
 	"strings"
 	"time"
 
@@ -24,6 +25,9 @@ type MountPoint struct {
 	// full upstream definition
 	// like http://my-service.my-namespace:port
 	Upstream string `yaml:"upstream"`
+	// more upstream targets. The requests are balanced across them and
+	// the Upstream one. See Middlewares.Affinity
+	Upstreams []string `yaml:"upstreams,omitempty"`
 	// VirtualHost like behaviour
 	MatchHost string `yaml:"matchHost"`
 	// middlewares configuration can be overridden setting
@@ -47,12 +51,35 @@ type Middlewares struct {
 	PreserveHostHeader *bool `yaml:"preserveHostHeader,omitempty"`
 	// if true, all requeste will be redirected to https
 	RedirectToHTTPS *bool `yaml:"redirectToHTTPS,omitempty"`
+	// periodic flush of the response body to the client while copying
+	// it from the upstream. Use 0 to disable periodic flushes and any
+	// value lesser than 0 to flush after each write.
+	// Server-Sent Events (text/event-stream) and responses of unknown
+	// length are always flushed immediately
+	FlushInterval time.Duration `yaml:"flushInterval,omitempty"`
 	// set rewrite parameters
 	Rewrite rewrite `yaml:"rewrite,omitempty"`
 	// if not empty, enables the jwt auth middleware
 	JwksURL string `yaml:"jwksURL,omitempty"`
+	// jwt auth middleware token validation
+	JWT JWT `yaml:"jwt"`
+	// forwards the validated identity to the upstream
+	ForwardIdentity ForwardIdentity `yaml:"forwardIdentity"`
+	// OpenID Connect login for the browsers
+	OIDC OIDC `yaml:"oidc"`
 	// http basic auth
 	BasicAuth BasiAuth `yaml:"basicAuth"`
+	// inject synthetic delays and errors (resilience testing)
+	FaultInjection FaultInjection `yaml:"faultInjection"`
+	// Edge Side Includes processing
+	ESI ESI `yaml:"esi"`
+	// GraphQL operations caching and limits
+	GraphQL GraphQL `yaml:"graphql"`
+	// pins the clients to one of the upstream targets, if the mount
+	// point has more than one
+	Affinity Affinity `yaml:"affinity"`
+	// passive health of the upstream targets
+	UpstreamHealth UpstreamHealth `yaml:"upstreamHealth"`
 }
 
 // Helper function that check for nil value on Enabled field
@@ -76,9 +103,18 @@ func (m *Middlewares) clone() Middlewares {
 		MaxRequestBodySize: m.MaxRequestBodySize,
 		PreserveHostHeader: &preserveHostHeader,
 		RedirectToHTTPS:    &redirectToHTTPS,
+		FlushInterval:      m.FlushInterval,
 		Rewrite:            m.Rewrite.clone(),
 		JwksURL:            m.JwksURL,
+		JWT:                m.JWT.clone(),
+		ForwardIdentity:    m.ForwardIdentity.clone(),
+		OIDC:               m.OIDC.clone(),
 		BasicAuth:          m.BasicAuth.clone(),
+		FaultInjection:     m.FaultInjection.clone(),
+		ESI:                m.ESI.clone(),
+		GraphQL:            m.GraphQL.clone(),
+		Affinity:           m.Affinity.clone(),
+		UpstreamHealth:     m.UpstreamHealth,
 	}
 	return c
 }
@@ -117,12 +153,144 @@ type gateway struct {
 	Kubernetes kubernetes `yaml:"kubernetes"`
 }
 
-type redis struct {
-	Host     string `yaml:"host,omitempty"`
-	Port     int    `yaml:"port,omitempty"`
+type redisSentinel struct {
+	// the name of the master monitored by the sentinels. Enables the
+	// sentinel mode
+	MasterName string `yaml:"masterName,omitempty"`
+	// the sentinels host:port addresses
+	Addresses []string `yaml:"addresses,omitempty"`
+	// the sentinels ACL credentials, if they differ from the redis ones
+	Username string `yaml:"username,omitempty"`
 	Password string `yaml:"password,omitempty"`
 }
 
+type redisCluster struct {
+	// the cluster seed nodes host:port addresses. Enables the cluster mode
+	Nodes []string `yaml:"nodes,omitempty"`
+}
+
+type redisTLS struct {
+	Enabled bool `yaml:"enabled"`
+	// the CA used to verify the server certificate. The system pool
+	// is used if empty
+	CAFile string `yaml:"caFile,omitempty"`
+	// the client certificate and key, if the server requires them
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+	// overrides the name used to verify the server certificate
+	ServerName         string `yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+type redisCircuitBreaker struct {
+	// consecutive failures that open the breaker. While it is open the
+	// redis commands fail immediately and the cache is bypassed.
+	// Use 0 to disable the breaker
+	Failures int `yaml:"failures"`
+	// how long the breaker stays open. Then a single probe command is
+	// sent: the breaker is closed if it succeeds
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+type Redis struct {
+	// the server address. Used if neither the sentinel nor the
+	// cluster mode are enabled
+	Host string `yaml:"host,omitempty"`
+	Port int    `yaml:"port,omitempty"`
+	// ACL credentials. Leave the username empty to use the
+	// legacy AUTH password
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// the database index. Ignored in cluster mode
+	DB       int           `yaml:"db"`
+	Sentinel redisSentinel `yaml:"sentinel,omitempty"`
+	Cluster  redisCluster  `yaml:"cluster,omitempty"`
+	TLS      redisTLS      `yaml:"tls,omitempty"`
+	// max number of connections (per node in cluster mode). Use 0 for
+	// the client default (10 per CPU)
+	PoolSize     int `yaml:"poolSize"`
+	MinIdleConns int `yaml:"minIdleConns"`
+	// use 0 for the client defaults
+	DialTimeout  time.Duration `yaml:"dialTimeout"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	// max time to wait for a free connection
+	PoolTimeout time.Duration `yaml:"poolTimeout"`
+	// deadline of each command sent by the cache. Flushes are
+	// not limited. Use 0 to disable it
+	OperationTimeout time.Duration       `yaml:"operationTimeout"`
+	CircuitBreaker   redisCircuitBreaker `yaml:"circuitBreaker"`
+}
+
+type memoryStore struct {
+	// max memory used by the cached entries. Example: 100mb
+	MaxSize string `yaml:"maxSize,omitempty"`
+	// max number of cached entries. Use 0 to disable the limit
+	MaxEntries int `yaml:"maxEntries,omitempty"`
+}
+
+type tieredStore struct {
+	// max time an entry lives in the in memory L1 tier. L1 is local to
+	// each replica: the keys removed or overwritten by a replica are
+	// dropped from the other ones through redis pub/sub. The messages
+	// lost while redis is unreachable leave stale copies around for up
+	// to this time, so keep it short
+	L1TTL time.Duration `yaml:"l1TTL,omitempty"`
+}
+
+type compression struct {
+	// compress the cached entries using zstd
+	Enabled bool `yaml:"enabled"`
+	// entries smaller than this are stored uncompressed. Example: 1kb
+	MinSize string `yaml:"minSize,omitempty"`
+}
+
+type cacheStore struct {
+	// where the cache middleware stores the responses.
+	// One of: redis, memory, tiered
+	Backend     string      `yaml:"backend"`
+	Memory      memoryStore `yaml:"memory"`
+	Tiered      tieredStore `yaml:"tiered"`
+	Compression compression `yaml:"compression"`
+	// bodies larger than this are stored in chunks, so cache hits can
+	// stream them. Example: 1mb. Use 0 to disable chunking
+	ChunkSize string `yaml:"chunkSize,omitempty"`
+}
+
+type identity struct {
+	// the PEM private key (RSA or ECDSA) signing the internal identity
+	// tokens. An ephemeral ECDSA key is generated if empty: each replica
+	// would then publish its own key, so set it if the gateway runs
+	// more than one replica
+	SigningKeyFile string `yaml:"signingKeyFile,omitempty"`
+	// the iss claim of the internal identity tokens
+	Issuer string `yaml:"issuer,omitempty"`
+}
+
+type Warmup struct {
+	// the urls to warm up. Relative urls (/api/items) are routed to the
+	// mount points without a matchHost. Use absolute urls to target
+	// a host (https://example.com/api/items)
+	URLs []string `yaml:"urls"`
+	// a file with an url per line. Empty lines and lines starting
+	// with # are skipped
+	File string `yaml:"file"`
+	// sitemaps (urlset or sitemapindex) listing the urls to warm up.
+	// They are fetched through the gateway too
+	Sitemaps []string `yaml:"sitemaps"`
+	// headers sent with each request. Set them to warm up the
+	// variants selected by the cache keyHeaders or by Vary
+	Headers map[string]string `yaml:"headers"`
+	// max number of concurrent requests
+	Concurrency int `yaml:"concurrency"`
+	// rerun the warmup at this interval. Set it lower than the cache TTL
+	// to refresh the entries before they expire. Use 0 to run it
+	// once, at startup and on config changes
+	Interval time.Duration `yaml:"interval"`
+	// max time for each request
+	Timeout time.Duration `yaml:"timeout"`
+}
+
 // config holds all the config values
 type config struct {
 	// debug log level
@@ -130,7 +298,13 @@ type config struct {
 	// Listeners conf
 	Gateway gateway `yaml:"gateway"`
 	// redis server connection
-	Redis redis `yaml:"redis"`
+	Redis Redis `yaml:"redis"`
+	// cache storage backend
+	CacheStore cacheStore `yaml:"cacheStore"`
+	// populates the cache fetching a list of urls
+	Warmup Warmup `yaml:"warmup"`
+	// the gateway identity, signing the internal tokens
+	Identity identity `yaml:"identity"`
 	// global middlewares configuration
 	Middlewares Middlewares `yaml:"middlewares"`
 	// define mount points
@@ -153,6 +327,47 @@ func setDefaults() {
 	viper.SetDefault("Debug", false)
 	viper.SetDefault("Redis.Host", "localhost")
 	viper.SetDefault("Redis.Port", 6379)
+	viper.SetDefault("Redis.Username", "")
+	viper.SetDefault("Redis.Password", "")
+	viper.SetDefault("Redis.DB", 0)
+	viper.SetDefault("Redis.Sentinel.MasterName", "")
+	viper.SetDefault("Redis.Sentinel.Addresses", "")
+	viper.SetDefault("Redis.Sentinel.Username", "")
+	viper.SetDefault("Redis.Sentinel.Password", "")
+	viper.SetDefault("Redis.Cluster.Nodes", "")
+	viper.SetDefault("Redis.TLS.Enabled", false)
+	viper.SetDefault("Redis.TLS.CAFile", "")
+	viper.SetDefault("Redis.TLS.CertFile", "")
+	viper.SetDefault("Redis.TLS.KeyFile", "")
+	viper.SetDefault("Redis.TLS.ServerName", "")
+	viper.SetDefault("Redis.TLS.InsecureSkipVerify", false)
+	viper.SetDefault("Redis.PoolSize", 0)
+	viper.SetDefault("Redis.MinIdleConns", 0)
+	viper.SetDefault("Redis.DialTimeout", "0s")
+	viper.SetDefault("Redis.ReadTimeout", "0s")
+	viper.SetDefault("Redis.WriteTimeout", "0s")
+	viper.SetDefault("Redis.PoolTimeout", "0s")
+	viper.SetDefault("Redis.OperationTimeout", "500ms")
+	viper.SetDefault("Redis.CircuitBreaker.Failures", 5)
+	viper.SetDefault("Redis.CircuitBreaker.Cooldown", "10s")
+
+	viper.SetDefault("CacheStore.Backend", "redis")
+	viper.SetDefault("CacheStore.Memory.MaxSize", "100mb")
+	viper.SetDefault("CacheStore.Memory.MaxEntries", 0)
+	viper.SetDefault("CacheStore.Tiered.L1TTL", "10s")
+	viper.SetDefault("CacheStore.Compression.Enabled", false)
+	viper.SetDefault("CacheStore.Compression.MinSize", "1kb")
+	viper.SetDefault("CacheStore.ChunkSize", "1mb")
+
+	viper.SetDefault("Warmup.URLs", "")
+	viper.SetDefault("Warmup.File", "")
+	viper.SetDefault("Warmup.Sitemaps", "")
+	viper.SetDefault("Warmup.Concurrency", 4)
+	viper.SetDefault("Warmup.Interval", "0s")
+	viper.SetDefault("Warmup.Timeout", "30s")
+
+	viper.SetDefault("Identity.SigningKeyFile", "")
+	viper.SetDefault("Identity.Issuer", "crauti")
 
 	viper.SetDefault("MountPoints", []MountPoint{})
 
@@ -183,6 +398,7 @@ func setDefaults() {
 	viper.SetDefault("Middlewares.MaxRequestBodySize", "10mb")
 	viper.SetDefault("Middlewares.PreserveHostHeader", true)
 	viper.SetDefault("Middlewares.RedirectToHTTPS", false)
+	viper.SetDefault("Middlewares.FlushInterval", "0s")
 
 	// Cache defaults
 	viper.SetDefault("Middlewares.Cache.Enabled", false)
@@ -190,11 +406,92 @@ func setDefaults() {
 	viper.SetDefault("Middlewares.Cache.Methods", "GET,HEAD,OPTIONS")
 	viper.SetDefault("Middlewares.Cache.KeyHeaders", "")
 	viper.SetDefault("Middlewares.Cache.KeyClaims", "")
+	viper.SetDefault("Middlewares.Cache.CacheableStatuses", "")
+	viper.SetDefault("Middlewares.Cache.RFC9111", false)
+	viper.SetDefault("Middlewares.Cache.KeepStale", "0s")
+	viper.SetDefault("Middlewares.Cache.StaleWhileRevalidate", "0s")
+	viper.SetDefault("Middlewares.Cache.StaleIfError", "0s")
+	viper.SetDefault("Middlewares.Cache.MaxObjectSize", "0")
+	viper.SetDefault("Middlewares.Cache.RangeMiss", "passthrough")
+	viper.SetDefault("Middlewares.Cache.DistributedLock", false)
+	viper.SetDefault("Middlewares.Cache.LockLease", "10s")
+	viper.SetDefault("Middlewares.Cache.LockWait", "5s")
+	viper.SetDefault("Middlewares.Cache.Key.SortQuery", false)
+	viper.SetDefault("Middlewares.Cache.Key.IncludeParams", "")
+	viper.SetDefault("Middlewares.Cache.Key.IgnoreParams", "")
+	viper.SetDefault("Middlewares.Cache.Key.LowercasePath", false)
+	viper.SetDefault("Middlewares.Cache.Key.Cookies", "")
+	viper.SetDefault("Middlewares.Cache.Key.Host", false)
+	viper.SetDefault("Middlewares.Cache.Key.DebugHeader", false)
+	viper.SetDefault("Middlewares.Cache.Headers.Age", true)
+	viper.SetDefault("Middlewares.Cache.Headers.CacheStatus", true)
+	viper.SetDefault("Middlewares.Cache.Headers.CacheStatusName", "Cache-Status")
+	viper.SetDefault("Middlewares.Cache.Headers.CacheName", "crauti")
+	viper.SetDefault("Middlewares.Cache.Headers.XCache", false)
+	viper.SetDefault("Middlewares.Cache.Headers.XCacheName", "X-Cache")
+	viper.SetDefault("Middlewares.Cache.Headers.HideGenerator", false)
+	viper.SetDefault("Middlewares.Cache.Headers.GeneratorName", "X-Generator")
+	viper.SetDefault("Middlewares.Cache.Invalidation.Enabled", false)
+	viper.SetDefault("Middlewares.Cache.Invalidation.Methods", "POST,PUT,PATCH,DELETE")
+	viper.SetDefault("Middlewares.Cache.Invalidation.Location", false)
+	viper.SetDefault("Middlewares.Cache.Invalidation.RelatedPaths", "")
+	viper.SetDefault("Middlewares.Cache.Invalidation.Soft", false)
 
 	// Auth middlewares
 	viper.SetDefault("Middlewares.JwksURL", "") // disabled by default
+	viper.SetDefault("Middlewares.JWT.Issuer", "")
+	viper.SetDefault("Middlewares.JWT.Audiences", "")
+	viper.SetDefault("Middlewares.JWT.ClockSkew", "30s")
+	viper.SetDefault("Middlewares.JWT.Algorithms", "RS256,RS384,RS512,PS256,PS384,PS512,ES256,ES384,ES512,EdDSA")
+	viper.SetDefault("Middlewares.JWT.Scopes", "")
+	viper.SetDefault("Middlewares.JWT.Realm", "crauti")
+	viper.SetDefault("Middlewares.ForwardIdentity.Enabled", false)
+	viper.SetDefault("Middlewares.ForwardIdentity.StripHeaders", "")
+	viper.SetDefault("Middlewares.ForwardIdentity.StripAuthorization", false)
+	viper.SetDefault("Middlewares.ForwardIdentity.Token.Enabled", false)
+	viper.SetDefault("Middlewares.ForwardIdentity.Token.Header", "X-Identity-Token")
+	viper.SetDefault("Middlewares.ForwardIdentity.Token.TTL", "1m")
+	viper.SetDefault("Middlewares.ForwardIdentity.Token.Audience", "")
+	viper.SetDefault("Middlewares.ForwardIdentity.Token.Claims", "")
+	viper.SetDefault("Middlewares.OIDC.Enabled", false)
+	viper.SetDefault("Middlewares.OIDC.Issuer", "")
+	viper.SetDefault("Middlewares.OIDC.ClientID", "")
+	viper.SetDefault("Middlewares.OIDC.ClientSecret", "")
+	viper.SetDefault("Middlewares.OIDC.Scopes", "openid,profile,email")
+	viper.SetDefault("Middlewares.OIDC.CallbackPath", "/oauth2/callback")
+	viper.SetDefault("Middlewares.OIDC.LogoutPath", "/oauth2/logout")
+	viper.SetDefault("Middlewares.OIDC.PostLogoutRedirectURL", "")
+	viper.SetDefault("Middlewares.OIDC.SessionStore", "cookie")
+	viper.SetDefault("Middlewares.OIDC.CookieName", "crauti_session")
+	viper.SetDefault("Middlewares.OIDC.CookieSecret", "")
+	viper.SetDefault("Middlewares.OIDC.SessionTTL", "12h")
+	viper.SetDefault("Middlewares.OIDC.PassAccessToken", false)
 	viper.SetDefault("Middlewares.BasicAuth.Enabled", false)
 	viper.SetDefault("Middlewares.BasicAuth.Realm", "crauti")
+
+	// Fault injection defaults
+	viper.SetDefault("Middlewares.FaultInjection.Enabled", false)
+	viper.SetDefault("Middlewares.FaultInjection.Abort.Status", 503)
+	viper.SetDefault("Middlewares.ESI.Enabled", false)
+	viper.SetDefault("Middlewares.ESI.MaxDepth", 3)
+	viper.SetDefault("Middlewares.ESI.Timeout", "2s")
+	viper.SetDefault("Middlewares.ESI.MaxIncludes", 32)
+	viper.SetDefault("Middlewares.ESI.MaxSize", "5mb")
+	viper.SetDefault("Middlewares.GraphQL.Enabled", false)
+	viper.SetDefault("Middlewares.GraphQL.MaxDepth", 10)
+	viper.SetDefault("Middlewares.GraphQL.MaxComplexity", 500)
+	viper.SetDefault("Middlewares.GraphQL.MaxAliases", 30)
+	viper.SetDefault("Middlewares.GraphQL.PersistedQueries", false)
+	viper.SetDefault("Middlewares.GraphQL.PersistedQueryTTL", "24h")
+	viper.SetDefault("Middlewares.Affinity.Mode", "")
+	viper.SetDefault("Middlewares.Affinity.Cookie.Name", "crauti_affinity")
+	viper.SetDefault("Middlewares.Affinity.Cookie.TTL", "0s")
+	viper.SetDefault("Middlewares.Affinity.Cookie.Secure", false)
+	viper.SetDefault("Middlewares.Affinity.Cookie.HTTPOnly", true)
+	viper.SetDefault("Middlewares.Affinity.Hash.Source", "")
+	viper.SetDefault("Middlewares.Affinity.Hash.Name", "")
+	viper.SetDefault("Middlewares.UpstreamHealth.MaxFails", 3)
+	viper.SetDefault("Middlewares.UpstreamHealth.FailTimeout", "10s")
 }
 
 func init() {
@@ -242,12 +539,57 @@ func Update() {
 
 		m.Cache.merge(i.Middlewares.Cache)
 		m.BasicAuth.merge(i.Middlewares.BasicAuth)
+		m.JWT.merge(i.Middlewares.JWT)
+		m.ForwardIdentity.merge(i.Middlewares.ForwardIdentity)
+		m.OIDC.merge(i.Middlewares.OIDC)
 
 		_, err = utils.ConvertToBytes(m.MaxRequestBodySize)
 		if err != nil {
 			m.MaxRequestBodySize = DefaultMaxRequestBodySize
 			log.Error().Msgf("unable to parse MaxRequestBodySize. mountPath: '%s'. reverting to default", i.Path)
 		}
+		for _, s := range m.Cache.CacheableStatuses {
+			if _, err := parseCacheableStatus(s); err != nil {
+				log.Error().Err(err).Msgf("invalid Cache.CacheableStatuses entry '%s'. mountPath: '%s'. ignoring it", s, i.Path)
+			}
+		}
+		for _, c := range m.JWT.RequiredClaims {
+			if _, err := regexp.Compile(c.Pattern); err != nil {
+				log.Error().Err(err).Msgf("invalid JWT.RequiredClaims '%s' pattern. mountPath: '%s'. all the tokens will be rejected", c.Name, i.Path)
+			}
+		}
+		if m.OIDC.SessionStore != "cookie" && m.OIDC.SessionStore != "redis" {
+			log.Error().Msgf("unknown OIDC.SessionStore '%s'. mountPath: '%s'. reverting to cookie", m.OIDC.SessionStore, i.Path)
+			m.OIDC.SessionStore = "cookie"
+		}
+		switch m.Affinity.Mode {
+		case "", AffinityModeCookie:
+		case AffinityModeHash:
+			switch m.Affinity.Hash.Source {
+			case AffinityHashIP:
+			case AffinityHashHeader, AffinityHashClaim:
+				if m.Affinity.Hash.Name == "" {
+					log.Error().Msgf("Affinity.Hash.Name is required by the '%s' source. mountPath: '%s'. disabling the affinity", m.Affinity.Hash.Source, i.Path)
+					m.Affinity.Mode = ""
+				}
+			default:
+				log.Error().Msgf("unknown Affinity.Hash.Source '%s'. mountPath: '%s'. disabling the affinity", m.Affinity.Hash.Source, i.Path)
+				m.Affinity.Mode = ""
+			}
+		default:
+			log.Error().Msgf("unknown Affinity.Mode '%s'. mountPath: '%s'. disabling the affinity", m.Affinity.Mode, i.Path)
+			m.Affinity.Mode = ""
+		}
+		_, err = utils.ConvertToBytes(m.ESI.MaxSize)
+		if err != nil {
+			m.ESI.MaxSize = "0"
+			log.Error().Msgf("unable to parse ESI.MaxSize. mountPath: '%s'. disabling the limit", i.Path)
+		}
+		_, err = utils.ConvertToBytes(m.Cache.MaxObjectSize)
+		if err != nil {
+			m.Cache.MaxObjectSize = "0"
+			log.Error().Msgf("unable to parse Cache.MaxObjectSize. mountPath: '%s'. disabling the limit", i.Path)
+		}
 
 		ConfInst.MountPoints[idx].Middlewares = m
 	}
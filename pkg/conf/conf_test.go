@@ -3,6 +3,7 @@ package conf
 import (
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -70,3 +71,135 @@ func TestBooleans2(t *testing.T) {
 		t.Fatal("cache should be disabled on mountPoint by default")
 	}
 }
+
+func TestCacheKey(t *testing.T) {
+	loadConf("test5.yaml")
+
+	key := ConfInst.MountPoints[0].Middlewares.Cache.Key
+	if !key.IsSortQuery() || !key.IsHost() || key.IsLowercasePath() {
+		t.Fatal("unexpected key booleans")
+	}
+	if len(key.IgnoreParams) != 1 || key.IgnoreParams[0] != "utm_*" {
+		t.Fatal("global ignoreParams expected")
+	}
+	if len(key.Cookies) != 1 || key.Cookies[0] != "session" {
+		t.Fatal("session cookie expected")
+	}
+
+	key = ConfInst.MountPoints[1].Middlewares.Cache.Key
+	if key.IsSortQuery() {
+		t.Fatal("sortQuery should be disabled on mount point")
+	}
+	if len(key.IgnoreParams) != 0 || len(key.Cookies) != 0 {
+		t.Fatal("empty ignoreParams and cookies expected")
+	}
+}
+
+func TestCacheableStatuses(t *testing.T) {
+	loadConf("test6.yaml")
+
+	type check struct {
+		status int
+		ttl    time.Duration
+		ok     bool
+	}
+	tests := map[int][]check{
+		// the default allows everything
+		0: {
+			{200, 5 * time.Minute, true},
+			{302, 5 * time.Minute, true},
+			{500, 5 * time.Minute, true},
+		},
+		1: {
+			{200, 5 * time.Minute, true},
+			{404, 30 * time.Second, true},
+			{403, time.Minute, true},
+			{410, 0, false},
+			{503, 0, false},
+			{301, 0, false},
+		},
+		// an empty list allows everything
+		2: {
+			{500, 5 * time.Minute, true},
+		},
+	}
+	for idx, checks := range tests {
+		c := ConfInst.MountPoints[idx].Middlewares.Cache
+		for _, ch := range checks {
+			ttl, ok := c.StatusTTL(ch.status)
+			if ok != ch.ok || ttl != ch.ttl {
+				t.Errorf("mount point %d, status %d: got %s %v", idx, ch.status, ttl, ok)
+			}
+		}
+	}
+}
+
+func TestJWT(t *testing.T) {
+	loadConf("test7.yaml")
+
+	c := ConfInst.MountPoints[0].Middlewares.JWT
+	if c.Issuer != "https://keycloak.url/realms/test" || c.ClockSkew != 30*time.Second || c.Realm != "crauti" {
+		t.Fatalf("unexpected conf %+v", c)
+	}
+	if len(c.Audiences) != 1 || len(c.RequiredClaims) != 1 || len(c.Scopes) != 0 || len(c.Algorithms) == 0 {
+		t.Fatalf("unexpected conf %+v", c)
+	}
+
+	c = ConfInst.MountPoints[1].Middlewares.JWT
+	if c.Issuer != "https://keycloak.url/realms/test" || c.Audiences[0] != "admin-api" {
+		t.Fatalf("unexpected conf %+v", c)
+	}
+	if c.RequiredClaims[0].Values[0] != "admin" || c.Scopes[0] != "admin" {
+		t.Fatalf("unexpected conf %+v", c)
+	}
+
+	c = ConfInst.MountPoints[2].Middlewares.JWT
+	if c.Audiences != nil || len(c.RequiredClaims) != 1 {
+		t.Fatalf("unexpected conf %+v", c)
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	loadConf("test8.yaml")
+
+	tests := []struct {
+		depth, complexity, aliases int
+	}{
+		{5, 500, 30},
+		// 0 is not set: the global values are used
+		{-1, -1, 30},
+	}
+	for idx, tt := range tests {
+		c := ConfInst.MountPoints[idx].Middlewares.GraphQL
+		if c.MaxDepth != tt.depth || c.MaxComplexity != tt.complexity || c.MaxAliases != tt.aliases {
+			t.Errorf("mount point %d: unexpected conf %+v", idx, c)
+		}
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	loadConf("test9.yaml")
+
+	c := ConfInst.MountPoints[0].Middlewares.Affinity
+	if c.Mode != AffinityModeCookie || c.Cookie.Name != "crauti_affinity" ||
+		!c.Cookie.IsSecure() || !c.Cookie.IsHTTPOnly() {
+		t.Errorf("unexpected conf %+v", c)
+	}
+	if len(ConfInst.MountPoints[0].Upstreams) != 1 {
+		t.Error("1 more upstream expected")
+	}
+
+	c = ConfInst.MountPoints[1].Middlewares.Affinity
+	if c.Mode != AffinityModeHash || c.Hash.Source != AffinityHashHeader || c.Hash.Name != "X-Session" {
+		t.Errorf("unexpected conf %+v", c)
+	}
+	// the header name is missing
+	if ConfInst.MountPoints[2].Middlewares.Affinity.Mode != "" {
+		t.Error("the affinity should be disabled")
+	}
+
+	health := ConfInst.MountPoints[0].Middlewares.UpstreamHealth
+	if health.MaxFails != 3 || health.FailTimeout != 10*time.Second {
+		t.Errorf("unexpected health conf %+v", health)
+	}
+}
@@ -0,0 +1,35 @@
+package conf
+
+import "time"
+
+// ESI defines the Edge Side Includes processing of the html responses
+type ESI struct {
+	// Do not use this directly. Use the IsEnabled function instead
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// max nesting level of the included fragments. Deeper includes fail
+	MaxDepth int `yaml:"maxDepth,omitempty"`
+	// max time waited for each fragment
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// max number of includes processed per document. The exceeding
+	// ones fail
+	MaxIncludes int `yaml:"maxIncludes,omitempty"`
+	// documents and fragments larger than this are not processed.
+	// Example: 5mb
+	MaxSize string `yaml:"maxSize,omitempty"`
+}
+
+func (c *ESI) clone() ESI {
+	enabled := *c.Enabled
+	return ESI{
+		Enabled:     &enabled,
+		MaxDepth:    c.MaxDepth,
+		Timeout:     c.Timeout,
+		MaxIncludes: c.MaxIncludes,
+		MaxSize:     c.MaxSize,
+	}
+}
+
+// Helper function that check for nil value on Enabled field
+func (c *ESI) IsEnabled() bool {
+	return c.Enabled != nil && *c.Enabled
+}
@@ -0,0 +1,46 @@
+package conf
+
+import "time"
+
+type faultDelay struct {
+	// percentage (0-100) of requests that will be delayed
+	Percentage float64 `yaml:"percentage,omitempty"`
+	// fixed delay. If MaxDuration is set too, the delay is randomly
+	// choosen in the [Duration, MaxDuration) interval
+	Duration    time.Duration `yaml:"duration,omitempty"`
+	MaxDuration time.Duration `yaml:"maxDuration,omitempty"`
+}
+
+type faultAbort struct {
+	// percentage (0-100) of requests that will be aborted
+	Percentage float64 `yaml:"percentage,omitempty"`
+	// the http status returned to the client on abort
+	Status int `yaml:"status,omitempty"`
+}
+
+type FaultInjection struct {
+	// Do not use this directly. Use the IsEnabled function instead
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// if not empty, faults are applied only to requests carrying
+	// this header (example: X-Crauti-Fault). The header is removed
+	// before forwarding the request to the upstream
+	Header string     `yaml:"header,omitempty"`
+	Delay  faultDelay `yaml:"delay,omitempty"`
+	Abort  faultAbort `yaml:"abort,omitempty"`
+}
+
+func (c *FaultInjection) clone() FaultInjection {
+	enabled := *c.Enabled
+	out := FaultInjection{
+		Enabled: &enabled,
+		Header:  c.Header,
+		Delay:   c.Delay,
+		Abort:   c.Abort,
+	}
+	return out
+}
+
+// Helper function that check for nil value on Enabled field
+func (c *FaultInjection) IsEnabled() bool {
+	return c.Enabled != nil && *c.Enabled
+}
@@ -0,0 +1,110 @@
+package conf
+
+import "time"
+
+// maps a claim to an upstream request header
+type ClaimHeader struct {
+	// the claim name. Use dots for the nested claims
+	// like realm_access.roles
+	Claim  string `yaml:"claim"`
+	Header string `yaml:"header"`
+}
+
+// IdentityToken defines the internal token minted for the upstreams.
+// The token is signed with the gateway key (see the identity conf) and
+// the key is published by the admin server at /.well-known/jwks.json
+type IdentityToken struct {
+	// Do not use this directly. Use the IsEnabled function instead
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// the request header carrying the token
+	Header string `yaml:"header,omitempty"`
+	// the token lifetime
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// the aud claim. The mount point upstream is used if empty
+	Audience string `yaml:"audience,omitempty"`
+	// the (top level) claims copied from the validated token. All of them
+	// are copied if empty, the registered ones excluded
+	Claims []string `yaml:"claims,omitempty"`
+}
+
+func (c *IdentityToken) clone() IdentityToken {
+	enabled := *c.Enabled
+	out := IdentityToken{
+		Enabled:  &enabled,
+		Header:   c.Header,
+		TTL:      c.TTL,
+		Audience: c.Audience,
+	}
+	out.Claims = append(out.Claims, c.Claims...)
+	return out
+}
+
+// Helper function that check for nil value on Enabled field
+func (c *IdentityToken) IsEnabled() bool {
+	return c.Enabled != nil && *c.Enabled
+}
+
+// ForwardIdentity defines how the identity validated by the jwt auth
+// middleware is forwarded to the upstreams. The headers set by the
+// gateway are always removed from the incoming requests, so the
+// clients can't spoof them
+type ForwardIdentity struct {
+	// Do not use this directly. Use the IsEnabled function instead
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// the claims forwarded as headers. The lists are comma joined and
+	// the objects json encoded
+	ClaimHeaders []ClaimHeader `yaml:"claimHeaders,omitempty"`
+	// other headers removed from the incoming requests
+	StripHeaders []string `yaml:"stripHeaders,omitempty"`
+	// removes the Authorization header once the token is validated.
+	// Do not use this directly. Use the IsStripAuthorization function instead
+	StripAuthorization *bool `yaml:"stripAuthorization,omitempty"`
+	// mints an internal token
+	Token IdentityToken `yaml:"token"`
+}
+
+func (c *ForwardIdentity) clone() ForwardIdentity {
+	enabled := *c.Enabled
+	stripAuthorization := *c.StripAuthorization
+	out := ForwardIdentity{
+		Enabled:            &enabled,
+		StripAuthorization: &stripAuthorization,
+		Token:              c.Token.clone(),
+	}
+	out.ClaimHeaders = append(out.ClaimHeaders, c.ClaimHeaders...)
+	out.StripHeaders = append(out.StripHeaders, c.StripHeaders...)
+	return out
+}
+
+// Helper function that check for nil value on Enabled field
+func (c *ForwardIdentity) IsEnabled() bool {
+	return c.Enabled != nil && *c.Enabled
+}
+
+// Helper function that check for nil value on StripAuthorization field
+func (c *ForwardIdentity) IsStripAuthorization() bool {
+	return c.StripAuthorization != nil && *c.StripAuthorization
+}
+
+// slice types needs manually merging logic
+// When not defined (nil case) we should use the global values
+// If defined but empty ([] case), we should use a nil value
+func (c *ForwardIdentity) merge(target ForwardIdentity) {
+	if target.ClaimHeaders == nil {
+		c.ClaimHeaders = ConfInst.Middlewares.ForwardIdentity.ClaimHeaders
+	} else if len(target.ClaimHeaders) == 0 {
+		c.ClaimHeaders = nil
+	}
+
+	if target.StripHeaders == nil {
+		c.StripHeaders = ConfInst.Middlewares.ForwardIdentity.StripHeaders
+	} else if len(target.StripHeaders) == 0 {
+		c.StripHeaders = nil
+	}
+
+	if target.Token.Claims == nil {
+		c.Token.Claims = ConfInst.Middlewares.ForwardIdentity.Token.Claims
+	} else if len(target.Token.Claims) == 0 {
+		c.Token.Claims = nil
+	}
+}
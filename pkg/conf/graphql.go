@@ -0,0 +1,50 @@
+package conf
+
+import "time"
+
+// GraphQL defines how the GraphQL requests are inspected. When enabled,
+// the query operations are cached whatever the request method is,
+// keyed on the normalized query and its variables. The mutations are
+// never cached
+type GraphQL struct {
+	// Do not use this directly. Use the IsEnabled function instead
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// max selection set nesting. Use -1 or any value lesser than 0 to
+	// disable the limit
+	MaxDepth int `yaml:"maxDepth,omitempty"`
+	// max number of selected fields, fragments expanded. Use -1 or any
+	// value lesser than 0 to disable the limit
+	MaxComplexity int `yaml:"maxComplexity,omitempty"`
+	// max number of aliased fields. Use -1 or any value lesser than 0
+	// to disable the limit
+	MaxAliases int `yaml:"maxAliases,omitempty"`
+	// supports the automatic persisted queries: the clients can send the
+	// query hash only, once the query is known.
+	// Do not use this directly. Use the IsPersistedQueries function instead
+	PersistedQueries *bool `yaml:"persistedQueries,omitempty"`
+	// how long the persisted queries are kept into the store
+	PersistedQueryTTL time.Duration `yaml:"persistedQueryTTL,omitempty"`
+}
+
+func (c *GraphQL) clone() GraphQL {
+	enabled := *c.Enabled
+	persistedQueries := *c.PersistedQueries
+	return GraphQL{
+		Enabled:           &enabled,
+		MaxDepth:          c.MaxDepth,
+		MaxComplexity:     c.MaxComplexity,
+		MaxAliases:        c.MaxAliases,
+		PersistedQueries:  &persistedQueries,
+		PersistedQueryTTL: c.PersistedQueryTTL,
+	}
+}
+
+// Helper function that check for nil value on Enabled field
+func (c *GraphQL) IsEnabled() bool {
+	return c.Enabled != nil && *c.Enabled
+}
+
+// Helper function that check for nil value on PersistedQueries field
+func (c *GraphQL) IsPersistedQueries() bool {
+	return c.PersistedQueries != nil && *c.PersistedQueries
+}
@@ -0,0 +1,87 @@
+package conf
+
+import "time"
+
+// a claim the tokens must have
+type ClaimMatcher struct {
+	// the claim name. Use dots for the nested claims
+	// like realm_access.roles
+	Name string `yaml:"name"`
+	// if not empty, the claim value (or one of the claim values if it
+	// is a list) must be one of these
+	Values []string `yaml:"values,omitempty"`
+	// if not empty, the claim value (or one of the claim values if it
+	// is a list) must fully match this regular expression. The tokens
+	// are always rejected if the expression is invalid
+	Pattern string `yaml:"pattern,omitempty"`
+}
+
+// JWT defines how the tokens are validated by the jwt auth middleware.
+// The middleware is enabled by the Middlewares.JwksURL field
+type JWT struct {
+	// if not empty, the iss claim must be equal to this
+	Issuer string `yaml:"issuer,omitempty"`
+	// if not empty, the aud claim must contain one of these
+	Audiences []string `yaml:"audiences,omitempty"`
+	// the tolerated clock difference while checking the exp, nbf and iat
+	// claims
+	ClockSkew time.Duration `yaml:"clockSkew,omitempty"`
+	// the allowed signing algorithms
+	Algorithms []string `yaml:"algorithms,omitempty"`
+	// the claims the tokens must have
+	RequiredClaims []ClaimMatcher `yaml:"requiredClaims,omitempty"`
+	// the scopes the tokens must have, all of them. The scopes are
+	// read from the scope (space separated) or the scp claims
+	Scopes []string `yaml:"scopes,omitempty"`
+	// the realm of the WWW-Authenticate response header
+	Realm string `yaml:"realm,omitempty"`
+}
+
+func (c *JWT) clone() JWT {
+	out := JWT{
+		Issuer:    c.Issuer,
+		ClockSkew: c.ClockSkew,
+		Realm:     c.Realm,
+	}
+	out.Audiences = append(out.Audiences, c.Audiences...)
+	out.Algorithms = append(out.Algorithms, c.Algorithms...)
+	out.Scopes = append(out.Scopes, c.Scopes...)
+	for _, m := range c.RequiredClaims {
+		matcher := ClaimMatcher{
+			Name:    m.Name,
+			Pattern: m.Pattern,
+		}
+		matcher.Values = append(matcher.Values, m.Values...)
+		out.RequiredClaims = append(out.RequiredClaims, matcher)
+	}
+	return out
+}
+
+// slice types needs manually merging logic
+// When not defined (nil case) we should use the global values
+// If defined but empty ([] case), we should use a nil value
+func (c *JWT) merge(target JWT) {
+	if target.Audiences == nil {
+		c.Audiences = ConfInst.Middlewares.JWT.Audiences
+	} else if len(target.Audiences) == 0 {
+		c.Audiences = nil
+	}
+
+	if target.Algorithms == nil {
+		c.Algorithms = ConfInst.Middlewares.JWT.Algorithms
+	} else if len(target.Algorithms) == 0 {
+		c.Algorithms = nil
+	}
+
+	if target.RequiredClaims == nil {
+		c.RequiredClaims = ConfInst.Middlewares.JWT.RequiredClaims
+	} else if len(target.RequiredClaims) == 0 {
+		c.RequiredClaims = nil
+	}
+
+	if target.Scopes == nil {
+		c.Scopes = ConfInst.Middlewares.JWT.Scopes
+	} else if len(target.Scopes) == 0 {
+		c.Scopes = nil
+	}
+}
@@ -0,0 +1,81 @@
+package conf
+
+import "time"
+
+// OIDC makes the gateway an OpenID Connect relying party: the
+// unauthenticated browsers are redirected to the identity provider and
+// the sessions are kept in cookies or in redis
+type OIDC struct {
+	// Do not use this directly. Use the IsEnabled function instead
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// the identity provider issuer. The endpoints are discovered from
+	// <issuer>/.well-known/openid-configuration
+	Issuer       string `yaml:"issuer,omitempty"`
+	ClientID     string `yaml:"clientID,omitempty"`
+	ClientSecret string `yaml:"clientSecret,omitempty"`
+	// the requested scopes
+	Scopes []string `yaml:"scopes,omitempty"`
+	// the redirect uri path, relative to the mount point path
+	CallbackPath string `yaml:"callbackPath,omitempty"`
+	// the logout path, relative to the mount point path
+	LogoutPath string `yaml:"logoutPath,omitempty"`
+	// where the browsers land after the logout. Sent to the identity
+	// provider as post_logout_redirect_uri, if it supports the
+	// RP-initiated logout
+	PostLogoutRedirectURL string `yaml:"postLogoutRedirectURL,omitempty"`
+	// where the sessions are kept. One of: cookie, redis
+	SessionStore string `yaml:"sessionStore,omitempty"`
+	// the session cookie name
+	CookieName string `yaml:"cookieName,omitempty"`
+	// the secret encrypting the cookies. An ephemeral one is generated
+	// if empty: the sessions are lost on restart, and they can't be
+	// shared by more than one replica
+	CookieSecret string `yaml:"cookieSecret,omitempty"`
+	// the max session lifetime. The tokens are refreshed meanwhile
+	SessionTTL time.Duration `yaml:"sessionTTL,omitempty"`
+	// forwards the access token to the upstream as a bearer token.
+	// Do not use this directly. Use the IsPassAccessToken function instead
+	PassAccessToken *bool `yaml:"passAccessToken,omitempty"`
+}
+
+func (c *OIDC) clone() OIDC {
+	enabled := *c.Enabled
+	passAccessToken := *c.PassAccessToken
+	out := OIDC{
+		Enabled:               &enabled,
+		Issuer:                c.Issuer,
+		ClientID:              c.ClientID,
+		ClientSecret:          c.ClientSecret,
+		CallbackPath:          c.CallbackPath,
+		LogoutPath:            c.LogoutPath,
+		PostLogoutRedirectURL: c.PostLogoutRedirectURL,
+		SessionStore:          c.SessionStore,
+		CookieName:            c.CookieName,
+		CookieSecret:          c.CookieSecret,
+		SessionTTL:            c.SessionTTL,
+		PassAccessToken:       &passAccessToken,
+	}
+	out.Scopes = append(out.Scopes, c.Scopes...)
+	return out
+}
+
+// Helper function that check for nil value on Enabled field
+func (c *OIDC) IsEnabled() bool {
+	return c.Enabled != nil && *c.Enabled
+}
+
+// Helper function that check for nil value on PassAccessToken field
+func (c *OIDC) IsPassAccessToken() bool {
+	return c.PassAccessToken != nil && *c.PassAccessToken
+}
+
+// slice types needs manually merging logic
+// When not defined (nil case) we should use the global values
+// If defined but empty ([] case), we should use a nil value
+func (c *OIDC) merge(target OIDC) {
+	if target.Scopes == nil {
+		c.Scopes = ConfInst.Middlewares.OIDC.Scopes
+	} else if len(target.Scopes) == 0 {
+		c.Scopes = nil
+	}
+}
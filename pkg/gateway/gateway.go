@@ -15,6 +15,10 @@ import (
 	"github.com/ferama/crauti/pkg/middleware/cache"
 	"github.com/ferama/crauti/pkg/middleware/collector"
 	"github.com/ferama/crauti/pkg/middleware/cors"
+	"github.com/ferama/crauti/pkg/middleware/esi"
+	"github.com/ferama/crauti/pkg/middleware/fault"
+	"github.com/ferama/crauti/pkg/middleware/graphql"
+	"github.com/ferama/crauti/pkg/middleware/oidc"
 	"github.com/ferama/crauti/pkg/middleware/proxy"
 	"github.com/ferama/crauti/pkg/middleware/redirect"
 	"github.com/ferama/crauti/pkg/middleware/timeout"
@@ -41,6 +45,10 @@ type Gateway struct {
 
 	updateChan chan *runtimeUpdates
 	updateMU   sync.Mutex
+
+	// the last built multiplexer
+	mux   *multiplexer
+	muxMU sync.RWMutex
 }
 
 func NewGateway(httpListenAddr string, httpsListenAddress string) *Gateway {
@@ -93,14 +101,28 @@ func (s *Gateway) buildChain(mp conf.MountPoint) http.Handler {
 		&collector.CollectorMiddleware{},
 		// install the basic auth
 		&auth.BasicAuthMiddleware{},
+		// browser sessions. Must run before the jwt middleware: the
+		// requests with a session are not checked for a bearer token
+		&oidc.OIDCMiddleware{},
 		// jwks based authentication middleware
 		&auth.JWTAuthMiddleware{},
+		// forward the validated identity to the upstream
+		&auth.IdentityMiddleware{},
 		// add timetout to context
 		&timeout.TimeoutMiddleware{},
 		// checks for unwanted large bodies
 		&bodylimit.BodyLimiterMiddleware{},
 		// add cors headers
 		&cors.CorsMiddleware{},
+		// synthetic delays and errors. Must run before the cache
+		// or injected errors could be cached
+		&fault.FaultInjectionMiddleware{},
+		// parse and check the GraphQL operations. Must run before the
+		// cache: the queries are cached by operation
+		&graphql.GraphQLMiddleware{},
+		// process the esi tags of the responses. Must run before the
+		// cache: the templates and the fragments are cached separately
+		&esi.ESIMiddleware{Handler: s.Handler()},
 		// respond with cache if we can
 		&cache.CacheMiddleware{},
 		// poke the backend if needed
@@ -185,6 +207,10 @@ func (s *Gateway) Update() {
 		}
 	}
 
+	s.muxMU.Lock()
+	s.mux = mux
+	s.muxMU.Unlock()
+
 	go func() {
 		s.server.stop()
 		domains := make([]string, len(hosts))
@@ -200,6 +226,22 @@ func (s *Gateway) Update() {
 	}()
 }
 
+// Handler serves the requests in process, without going through the
+// listeners. It always routes them using the last configuration
+func (s *Gateway) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.muxMU.RLock()
+		mux := s.mux
+		s.muxMU.RUnlock()
+
+		if mux == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
 func (s *Gateway) Start() error {
 	return s.server.run()
 }
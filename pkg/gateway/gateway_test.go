@@ -1,8 +1,10 @@
 package gateway
 
 import (
+	"bufio"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"testing"
 	"time"
@@ -19,8 +21,8 @@ func loadConf(file string) {
 	conf.Update()
 }
 
-func startWebServer(sleepTime int) http.Server {
-	s := http.Server{
+func startWebServer(sleepTime int) *http.Server {
+	s := &http.Server{
 		Addr: ":19999",
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			time.Sleep(time.Duration(sleepTime) * time.Second)
@@ -167,3 +169,86 @@ func TestPort80(t *testing.T) {
 		t.Fatal("expected 'done'")
 	}
 }
+
+func TestServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	s := &http.Server{
+		Addr: ":19999",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("data: first\n\n"))
+			w.(http.Flusher).Flush()
+			// keep the stream open until the client got the first event
+			<-release
+		}),
+	}
+	go s.ListenAndServe()
+
+	loadConf("test5.yaml")
+	gwServer := NewGateway(":8080", ":8443")
+	defer func() {
+		gwServer.Stop()
+		s.Close()
+	}()
+	// deferred calls run in reverse order: the stream needs to be
+	// released before shutting down the servers
+	defer close(release)
+	gwServer.Update()
+
+	go gwServer.Start()
+	time.Sleep(1 * time.Second)
+
+	// without flushing, not even the response headers will reach
+	// the client. Read the first event asynchronously
+	got := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://127.0.0.1:8080/events")
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		got <- line
+	}()
+
+	select {
+	case line := <-got:
+		if line != "data: first\n" {
+			t.Fatalf("unexpected event '%s'", line)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("event was buffered")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := startWebServer(0)
+	go s.ListenAndServe()
+
+	loadConf("test.yaml")
+	gwServer := NewGateway(":8080", ":8443")
+	defer func() {
+		gwServer.Stop()
+		s.Close()
+	}()
+
+	rec := httptest.NewRecorder()
+	gwServer.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatal("expected 503 before the first update")
+	}
+
+	gwServer.Update()
+	go gwServer.Start()
+	// give time to the upstream to raise
+	time.Sleep(1 * time.Second)
+
+	// served in process, without going through the listener
+	rec = httptest.NewRecorder()
+	gwServer.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "done" {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,217 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/logger"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog"
+)
+
+var (
+	log *zerolog.Logger
+
+	mu       sync.Mutex
+	instance *Signer
+)
+
+func init() {
+	log = logger.GetLogger("identity")
+}
+
+// Signer mints the internal identity tokens forwarded to the upstreams
+type Signer struct {
+	key    crypto.Signer
+	method jwt.SigningMethod
+	// the RFC 7638 thumbprint of the public key
+	kid    string
+	jwk    map[string]string
+	issuer string
+	// the file the key was loaded from. Empty for the ephemeral keys
+	keyFile string
+}
+
+// Instance returns the signer configured in conf.ConfInst.Identity
+func Instance() *Signer {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if instance == nil {
+		instance = newSigner(nil)
+	}
+	return instance
+}
+
+// intended to be used on config changes. The key file is read again,
+// so the rotated keys are picked up. The ephemeral key is kept: the
+// tokens already minted stay valid
+func Update() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	instance = newSigner(instance)
+}
+
+func newSigner(current *Signer) *Signer {
+	c := conf.ConfInst.Identity
+	if c.SigningKeyFile != "" {
+		s, err := signerFromFile(c.SigningKeyFile, c.Issuer)
+		if err == nil {
+			return s
+		}
+		log.Error().Err(err).Str("file", c.SigningKeyFile).Msg("unable to load the identity signing key")
+		if current != nil {
+			return current.withIssuer(c.Issuer)
+		}
+	} else if current != nil && current.keyFile == "" {
+		return current.withIssuer(c.Issuer)
+	}
+
+	log.Warn().Msg("using an ephemeral identity signing key")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s, _ := NewSigner(key, c.Issuer)
+	return s
+}
+
+func signerFromFile(file string, issuer string) (*Signer, error) {
+	key, err := loadKey(file)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSigner(key, issuer)
+	if err != nil {
+		return nil, err
+	}
+	s.keyFile = file
+	return s, nil
+}
+
+func (s *Signer) withIssuer(issuer string) *Signer {
+	out := *s
+	out.issuer = issuer
+	return &out
+}
+
+// NewSigner returns a signer using the RSA or ECDSA key
+func NewSigner(key crypto.Signer, issuer string) (*Signer, error) {
+	s := &Signer{
+		key:    key,
+		issuer: issuer,
+	}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.method = jwt.SigningMethodRS256
+		s.jwk = map[string]string{
+			"kty": "RSA",
+			"n":   encode(k.N.Bytes()),
+			"e":   encode(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case *ecdsa.PrivateKey:
+		// the coordinates are padded to the curve size (RFC 7518)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		switch k.Curve {
+		case elliptic.P256():
+			s.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			s.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			s.method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+		s.jwk = map[string]string{
+			"kty": "EC",
+			"crv": k.Curve.Params().Name,
+			"x":   encode(k.X.FillBytes(make([]byte, size))),
+			"y":   encode(k.Y.FillBytes(make([]byte, size))),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	// the required members only, marshalled with sorted keys
+	thumbprint, _ := json.Marshal(s.jwk)
+	sum := sha256.Sum256(thumbprint)
+	s.kid = encode(sum[:])
+	return s, nil
+}
+
+// reads a PEM private key: PKCS #1, PKCS #8 or SEC 1
+func loadKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// Sign mints a token carrying the claims. The registered claims are set
+// by the signer
+func (s *Signer) Sign(claims jwt.MapClaims, audience string, ttl time.Duration) (string, error) {
+	out := jwt.MapClaims{}
+	for k, v := range claims {
+		out[k] = v
+	}
+	now := time.Now()
+	out["iss"] = s.issuer
+	out["aud"] = audience
+	out["iat"] = now.Unix()
+	out["nbf"] = now.Unix()
+	out["exp"] = now.Add(ttl).Unix()
+
+	token := jwt.NewWithClaims(s.method, out)
+	token.Header["kid"] = s.kid
+	return token.SignedString(s.key)
+}
+
+// JWKS returns the json web key set publishing the public key
+func (s *Signer) JWKS() []byte {
+	key := map[string]string{
+		"kid": s.kid,
+		"alg": s.method.Alg(),
+		"use": "sig",
+	}
+	for k, v := range s.jwk {
+		key[k] = v
+	}
+	out, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{key},
+	})
+	return out
+}
@@ -0,0 +1,85 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func writeKey(t *testing.T, blockType string, der []byte) string {
+	file := filepath.Join(t.TempDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestSigner(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	sec1, _ := x509.MarshalECPrivateKey(ecKey)
+
+	tests := []struct {
+		file string
+		key  crypto.Signer
+		alg  string
+	}{
+		{writeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), rsaKey, "RS256"},
+		{writeKey(t, "PRIVATE KEY", pkcs8), ecKey, "ES384"},
+		{writeKey(t, "EC PRIVATE KEY", sec1), ecKey, "ES384"},
+	}
+	for _, tt := range tests {
+		s, err := signerFromFile(tt.file, "crauti")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.method.Alg() != tt.alg {
+			t.Fatalf("unexpected alg %s", s.method.Alg())
+		}
+
+		signed, err := s.Sign(jwt.MapClaims{"sub": "bob", "iss": "spoofed"}, "http://upstream", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwks, err := keyfunc.NewJSON(json.RawMessage(s.JWKS()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(signed, claims, jwks.Keyfunc)
+		if err != nil || !token.Valid {
+			t.Fatalf("the token should be valid: %v", err)
+		}
+		if claims["sub"] != "bob" || claims["iss"] != "crauti" || !claims.VerifyAudience("http://upstream", true) {
+			t.Fatalf("unexpected claims %v", claims)
+		}
+		if token.Header["kid"] != s.kid {
+			t.Fatalf("unexpected kid %v", token.Header["kid"])
+		}
+	}
+
+	// the same key always gets the same kid
+	a, _ := NewSigner(ecKey, "")
+	b, _ := signerFromFile(tests[2].file, "")
+	if a.kid != b.kid {
+		t.Fatal("the kid should be the key thumbprint")
+	}
+
+	if _, err := signerFromFile(writeKey(t, "PRIVATE KEY", []byte("garbage")), ""); err == nil {
+		t.Fatal("an error is expected")
+	}
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/identity"
+	"github.com/ferama/crauti/pkg/middleware"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// the claims set by the identity signer. They are never copied from
+// the validated token
+var registeredClaims = map[string]bool{
+	"iss": true,
+	"aud": true,
+	"exp": true,
+	"nbf": true,
+	"iat": true,
+	"jti": true,
+}
+
+// Forwards the identity validated by the jwt auth middleware to the
+// upstream, so the upstreams don't need to validate the bearer tokens.
+// The claims are forwarded as headers and/or into an internal token
+// signed by the gateway. The upstreams verify it using the admin server
+// /.well-known/jwks.json endpoint. Sample usage:
+//
+//	middlewares:
+//	  forwardIdentity:
+//	    enabled: true
+//	    claimHeaders:
+//	      - claim: sub
+//	        header: X-User-Id
+//	      - claim: realm_access.roles
+//	        header: X-User-Roles
+//	    stripAuthorization: true
+//	    token:
+//	      enabled: true
+//	      header: X-Identity-Token
+//	      ttl: 1m
+//
+// The forwarded headers are removed from all the incoming requests,
+// authenticated or not
+type IdentityMiddleware struct {
+	middleware.Middleware
+
+	next http.Handler
+}
+
+func (m *IdentityMiddleware) Init(next http.Handler) middleware.Middleware {
+	m.next = next
+
+	return m
+}
+
+func (m *IdentityMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := chaincontext.GetChainContext(r)
+	c := ctx.Conf.Middlewares.ForwardIdentity
+	if !c.IsEnabled() {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	// the spoofed headers
+	for _, ch := range c.ClaimHeaders {
+		r.Header.Del(ch.Header)
+	}
+	for _, h := range c.StripHeaders {
+		r.Header.Del(h)
+	}
+	if c.Token.IsEnabled() {
+		r.Header.Del(c.Token.Header)
+	}
+
+	claims := ctx.Auth.JwtClaims
+	if !ctx.Auth.Authorized || claims == nil {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	for _, ch := range c.ClaimHeaders {
+		if v, ok := lookupClaim(claims, ch.Claim); ok {
+			if value := claimHeaderValue(v); value != "" {
+				r.Header.Set(ch.Header, value)
+			}
+		}
+	}
+
+	if c.Token.IsEnabled() {
+		token, err := m.mint(claims, ctx.Conf, c.Token)
+		if err != nil {
+			log.Err(err).Msg("unable to mint the identity token")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.Header.Set(c.Token.Header, token)
+	}
+
+	if c.IsStripAuthorization() {
+		r.Header.Del("Authorization")
+	}
+	m.next.ServeHTTP(w, r)
+}
+
+func (m *IdentityMiddleware) mint(claims jwt.MapClaims, mp *conf.MountPoint, c conf.IdentityToken) (string, error) {
+	out := jwt.MapClaims{}
+	if len(c.Claims) == 0 {
+		for k, v := range claims {
+			if !registeredClaims[k] {
+				out[k] = v
+			}
+		}
+	} else {
+		for _, k := range c.Claims {
+			if v, ok := claims[k]; ok && !registeredClaims[k] {
+				out[k] = v
+			}
+		}
+	}
+
+	audience := c.Audience
+	if audience == "" {
+		audience = mp.Upstream
+	}
+	return identity.Instance().Sign(out, audience, c.TTL)
+}
+
+// formats a claim as a header value. The lists are comma joined and the
+// objects json encoded. The control characters are removed
+func claimHeaderValue(v any) string {
+	var value string
+	if obj, ok := v.(map[string]any); ok {
+		b, _ := json.Marshal(obj)
+		value = string(b)
+	} else {
+		value = strings.Join(claimValues(v), ",")
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+}
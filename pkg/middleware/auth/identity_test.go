@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/identity"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestIdentity(t *testing.T) {
+	conf.Update()
+	identity.Update()
+
+	var headers http.Header
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+	})
+	m := (&IdentityMiddleware{}).Init(upstream)
+
+	enabled := true
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				ForwardIdentity: conf.ForwardIdentity{
+					Enabled: &enabled,
+					ClaimHeaders: []conf.ClaimHeader{
+						{Claim: "sub", Header: "X-User-Id"},
+						{Claim: "realm_access.roles", Header: "X-User-Roles"},
+						{Claim: "realm_access", Header: "X-Realm-Access"},
+						{Claim: "updated_at", Header: "X-Updated-At"},
+					},
+					StripHeaders:       []string{"X-User-Email"},
+					StripAuthorization: &enabled,
+					Token: conf.IdentityToken{
+						Enabled: &enabled,
+						Header:  "X-Identity-Token",
+						TTL:     time.Minute,
+						Claims:  []string{"sub", "iss"},
+					},
+				},
+			},
+		}, r)
+		// the claims validated by the jwt middleware
+		if r.Header.Get("Authorization") != "" {
+			cc.Auth.Authorized = true
+			cc.Auth.JwtClaims = jwt.MapClaims{
+				"iss":          "https://idp",
+				"sub":          "bob\r\nX-Admin: true",
+				"updated_at":   float64(1700000000),
+				"realm_access": map[string]any{"roles": []any{"user", "admin"}},
+			}
+		}
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	do := func(auth bool) {
+		headers = nil
+		req, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+		for _, h := range []string{"X-User-Id", "X-User-Roles", "X-User-Email", "X-Identity-Token"} {
+			req.Header.Set(h, "spoofed")
+		}
+		if auth {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d", res.StatusCode)
+		}
+	}
+
+	// not authenticated: the spoofed headers are removed
+	do(false)
+	for _, h := range []string{"X-User-Id", "X-User-Roles", "X-User-Email", "X-Identity-Token"} {
+		if headers.Get(h) != "" {
+			t.Fatalf("the %s header should be removed", h)
+		}
+	}
+
+	do(true)
+	expected := map[string]string{
+		"X-User-Id":      "bobX-Admin: true",
+		"X-User-Roles":   "user,admin",
+		"X-Realm-Access": `{"roles":["user","admin"]}`,
+		"X-Updated-At":   "1700000000",
+		"X-User-Email":   "",
+		"Authorization":  "",
+	}
+	for h, v := range expected {
+		if headers.Get(h) != v {
+			t.Fatalf("unexpected %s header %q", h, headers.Get(h))
+		}
+	}
+
+	jwks, err := keyfunc.NewJSON(json.RawMessage(identity.Instance().JWKS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(headers.Get("X-Identity-Token"), claims, jwks.Keyfunc); err != nil {
+		t.Fatal(err)
+	}
+	if claims["iss"] != "crauti" || claims["aud"] != "http://upstream" || claims["realm_access"] != nil {
+		t.Fatalf("unexpected claims %v", claims)
+	}
+}
@@ -3,22 +3,52 @@ package auth
 import (
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/MicahParks/keyfunc"
 	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
 	"github.com/ferama/crauti/pkg/middleware"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/rs/zerolog/log"
 )
 
+// the RFC 6750 error codes
+const (
+	errorInvalidRequest    = "invalid_request"
+	errorInvalidToken      = "invalid_token"
+	errorInsufficientScope = "insufficient_scope"
+)
+
 // Checks for JWT token validity and puts claims into context
 // Uses jwks standard URL
 // Example using keyclaok:
 //
 //	https://keycloak.url/realms/test/protocol/openid-connect/certs
+//
+// The tokens are validated against the jwt conf: issuer, audiences,
+// algorithms, required claims and scopes. Sample usage:
+//
+//	middlewares:
+//	  jwksURL: https://keycloak.url/realms/test/protocol/openid-connect/certs
+//	  jwt:
+//	    issuer: https://keycloak.url/realms/test
+//	    audiences: [my-api]
+//	    clockSkew: 30s
+//	    requiredClaims:
+//	      - name: realm_access.roles
+//	        values: [admin]
+//	      - name: email
+//	        pattern: .*@example\.com
+//	    scopes: [read]
+//
+// The requests authorized by an oidc session are checked against the
+// same conf, using the session claims. The failures are reported using
+// the RFC 6750 WWW-Authenticate header
 type JWTAuthMiddleware struct {
 	middleware.Middleware
 
@@ -26,6 +56,9 @@ type JWTAuthMiddleware struct {
 
 	jwks map[string]*keyfunc.JWKS
 	mu   sync.Mutex
+
+	// the compiled claim patterns
+	patterns sync.Map
 }
 
 func (m *JWTAuthMiddleware) Init(next http.Handler) middleware.Middleware {
@@ -35,14 +68,14 @@ func (m *JWTAuthMiddleware) Init(next http.Handler) middleware.Middleware {
 	return m
 }
 
-func (m *JWTAuthMiddleware) getJWKS(jwksURL string) *keyfunc.JWKS {
+func (m *JWTAuthMiddleware) getJWKS(jwksURL string) (*keyfunc.JWKS, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if item, ok := m.jwks[jwksURL]; ok {
-		return item
+		return item, nil
 	}
-	jwks, _ := keyfunc.Get(jwksURL, keyfunc.Options{
+	jwks, err := keyfunc.Get(jwksURL, keyfunc.Options{
 		RefreshErrorHandler: func(err error) {
 			log.Err(err).Send()
 		},
@@ -51,10 +84,14 @@ func (m *JWTAuthMiddleware) getJWKS(jwksURL string) *keyfunc.JWKS {
 		RefreshTimeout:    time.Second * 10,
 		RefreshUnknownKID: true,
 	})
+	// do not cache the failures: the next request will try again
+	if err != nil {
+		return nil, err
+	}
 
 	m.jwks[jwksURL] = jwks
 
-	return jwks
+	return jwks, nil
 }
 
 func (m *JWTAuthMiddleware) serverErrorResponse(val string, w http.ResponseWriter) {
@@ -62,9 +99,72 @@ func (m *JWTAuthMiddleware) serverErrorResponse(val string, w http.ResponseWrite
 	fmt.Fprintf(w, "%s\n", val)
 }
 
-func (m *JWTAuthMiddleware) unauthorizedResponse(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusUnauthorized)
-	fmt.Fprintf(w, "unauthorized\n")
+// a RFC 6750 error response. The code is empty if the request
+// doesn't contain any token
+type authError struct {
+	status      int
+	code        string
+	description string
+	scope       string
+}
+
+func invalidToken(format string, args ...any) *authError {
+	return &authError{
+		status:      http.StatusUnauthorized,
+		code:        errorInvalidToken,
+		description: fmt.Sprintf(format, args...),
+	}
+}
+
+func insufficientScope(scope string, format string, args ...any) *authError {
+	return &authError{
+		status:      http.StatusForbidden,
+		code:        errorInsufficientScope,
+		description: fmt.Sprintf(format, args...),
+		scope:       scope,
+	}
+}
+
+func (m *JWTAuthMiddleware) errorResponse(w http.ResponseWriter, realm string, e *authError) {
+	challenge := fmt.Sprintf(`Bearer realm="%s"`, quote(realm))
+	if e.code != "" {
+		challenge += fmt.Sprintf(`, error="%s", error_description="%s"`, e.code, quote(e.description))
+	}
+	if e.scope != "" {
+		challenge += fmt.Sprintf(`, scope="%s"`, quote(e.scope))
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(e.status)
+	if e.status == http.StatusForbidden {
+		fmt.Fprintf(w, "forbidden\n")
+	} else {
+		fmt.Fprintf(w, "unauthorized\n")
+	}
+}
+
+// the auth-param values are quoted strings: they can't contain
+// quotes and backslashes
+func quote(s string) string {
+	return strings.NewReplacer(`"`, "'", `\`, "/").Replace(s)
+}
+
+// extracts the bearer token from the Authorization header
+func bearerToken(r *http.Request) (string, *authError) {
+	auth := r.Header.Get("Authorization")
+	scheme, token, _ := strings.Cut(auth, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", &authError{status: http.StatusUnauthorized}
+	}
+	token = strings.TrimSpace(token)
+	if token == "" || strings.Contains(token, " ") {
+		return "", &authError{
+			status:      http.StatusBadRequest,
+			code:        errorInvalidRequest,
+			description: "malformed bearer token",
+		}
+	}
+	return token, nil
 }
 
 func (m *JWTAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -75,37 +175,221 @@ func (m *JWTAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		m.next.ServeHTTP(w, r)
 		return
 	}
+	c := ctx.Conf.Middlewares.JWT
 
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		m.unauthorizedResponse(w)
+	// the requests already authorized by the oidc middleware session.
+	// The session claims must satisfy the conf like the tokens ones
+	if ctx.Auth.Authorized {
+		if aerr := m.checkClaims(ctx.Auth.JwtClaims, c); aerr != nil {
+			m.rejected(w, r, c, aerr)
+			return
+		}
+		m.next.ServeHTTP(w, r)
 		return
 	}
 
-	// extract bearer
-	parts := strings.Split(auth, " ")
-	if len(parts) != 2 {
-		m.unauthorizedResponse(w)
+	bearer, aerr := bearerToken(r)
+	if aerr != nil {
+		m.errorResponse(w, c.Realm, aerr)
 		return
 	}
-	bearer := parts[1]
-
-	jwks := m.getJWKS(ctx.Conf.Middlewares.JwksURL)
 
-	// Parse the JWT.
-	token, err := jwt.Parse(bearer, jwks.Keyfunc)
+	jwks, err := m.getJWKS(ctx.Conf.Middlewares.JwksURL)
 	if err != nil {
-		m.serverErrorResponse(fmt.Sprintf("failed to parse token: %s", err), w)
+		log.Err(err).Str("jwksURL", ctx.Conf.Middlewares.JwksURL).Msg("unable to get the jwks")
+		m.serverErrorResponse("unable to get the jwks", w)
 		return
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		ctx.Auth.Authorized = true
-		ctx.Auth.JwtClaims = claims
-	} else {
-		m.unauthorizedResponse(w)
+	claims, aerr := m.validate(bearer, jwks.Keyfunc, c)
+	if aerr != nil {
+		m.rejected(w, r, c, aerr)
 		return
 	}
 
+	ctx.Auth.Authorized = true
+	ctx.Auth.JwtClaims = claims
+
 	m.next.ServeHTTP(w, r)
 }
+
+func (m *JWTAuthMiddleware) rejected(w http.ResponseWriter, r *http.Request, c conf.JWT, aerr *authError) {
+	log.Debug().
+		Str("error", aerr.code).
+		Str("description", aerr.description).
+		Str("path", r.URL.Path).
+		Msg("jwt rejected")
+	m.errorResponse(w, c.Realm, aerr)
+}
+
+// parses the token and checks it against the conf
+func (m *JWTAuthMiddleware) validate(bearer string, keyFunc jwt.Keyfunc, c conf.JWT) (jwt.MapClaims, *authError) {
+	opts := []jwt.ParserOption{
+		// the time based claims are verified below, taking the clock
+		// skew into account
+		jwt.WithoutClaimsValidation(),
+	}
+	if len(c.Algorithms) > 0 {
+		opts = append(opts, jwt.WithValidMethods(c.Algorithms))
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(opts...).ParseWithClaims(bearer, claims, keyFunc)
+	if err != nil {
+		return nil, invalidToken("%s", err)
+	}
+
+	now := time.Now()
+	if !claims.VerifyExpiresAt(now.Add(-c.ClockSkew).Unix(), false) {
+		return nil, invalidToken("token is expired")
+	}
+	if !claims.VerifyNotBefore(now.Add(c.ClockSkew).Unix(), false) {
+		return nil, invalidToken("token is not valid yet")
+	}
+	if !claims.VerifyIssuedAt(now.Add(c.ClockSkew).Unix(), false) {
+		return nil, invalidToken("token used before issued")
+	}
+	if aerr := m.checkClaims(claims, c); aerr != nil {
+		return nil, aerr
+	}
+	return claims, nil
+}
+
+// checks the issuer, the audience, the required claims and the scopes.
+// The time based claims are not checked here
+func (m *JWTAuthMiddleware) checkClaims(claims jwt.MapClaims, c conf.JWT) *authError {
+	if c.Issuer != "" && !claims.VerifyIssuer(c.Issuer, true) {
+		return invalidToken("unexpected issuer")
+	}
+	if len(c.Audiences) > 0 && !verifyAudience(claims, c.Audiences) {
+		return invalidToken("unexpected audience")
+	}
+
+	for _, matcher := range c.RequiredClaims {
+		if !m.matchClaim(claims, matcher) {
+			return insufficientScope("", "claim \"%s\" missing or not matching", matcher.Name)
+		}
+	}
+
+	if len(c.Scopes) > 0 {
+		granted := scopes(claims)
+		for _, s := range c.Scopes {
+			if !granted[s] {
+				return insufficientScope(strings.Join(c.Scopes, " "), "scope \"%s\" required", s)
+			}
+		}
+	}
+	return nil
+}
+
+// the aud claim can be a string or a list of strings
+func verifyAudience(claims jwt.MapClaims, audiences []string) bool {
+	for _, aud := range audiences {
+		if claims.VerifyAudience(aud, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// the granted scopes. The scope claim is a space separated string
+// (RFC 8693), the scp one can be a list too
+func scopes(claims jwt.MapClaims) map[string]bool {
+	out := make(map[string]bool)
+	for _, name := range []string{"scope", "scp"} {
+		for _, v := range claimValues(claims[name]) {
+			for _, s := range strings.Fields(v) {
+				out[s] = true
+			}
+		}
+	}
+	return out
+}
+
+// looks up a claim by its dotted name
+func lookupClaim(claims jwt.MapClaims, name string) (any, bool) {
+	var cur any = map[string]any(claims)
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// returns the claim value(s) as strings. The objects are skipped
+func claimValues(v any) []string {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{value}
+	case []any:
+		out := []string{}
+		for _, item := range value {
+			out = append(out, claimValues(item)...)
+		}
+		return out
+	case map[string]any:
+		return nil
+	case float64:
+		// the json numbers. Avoid the exponent format of the large ones
+		return []string{strconv.FormatFloat(value, 'f', -1, 64)}
+	default:
+		return []string{fmt.Sprint(value)}
+	}
+}
+
+func (m *JWTAuthMiddleware) matchClaim(claims jwt.MapClaims, matcher conf.ClaimMatcher) bool {
+	v, ok := lookupClaim(claims, matcher.Name)
+	if !ok {
+		return false
+	}
+	if len(matcher.Values) == 0 && matcher.Pattern == "" {
+		return true
+	}
+
+	var re *regexp.Regexp
+	if matcher.Pattern != "" {
+		var err error
+		if re, err = m.pattern(matcher.Pattern); err != nil {
+			return false
+		}
+	}
+	for _, value := range claimValues(v) {
+		if len(matcher.Values) > 0 && !contains(matcher.Values, value) {
+			continue
+		}
+		if re != nil && !re.MatchString(value) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// compiles the claim patterns once. The patterns are anchored: the
+// whole value must match
+func (m *JWTAuthMiddleware) pattern(expr string) (*regexp.Regexp, error) {
+	if re, ok := m.patterns.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	m.patterns.Store(expr, re)
+	return re, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// serves the public key of a test rsa key pair
+func jwksServer(t *testing.T) (*httptest.Server, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	body, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   encode(key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	return s, key
+}
+
+func TestJWT(t *testing.T) {
+	jwks, key := jwksServer(t)
+	defer jwks.Close()
+
+	var claims jwt.MapClaims
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims = chaincontext.GetChainContext(r).Auth.JwtClaims
+	})
+	m := (&JWTAuthMiddleware{}).Init(upstream)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				JwksURL: jwks.URL,
+				JWT: conf.JWT{
+					Issuer:     "https://idp",
+					Audiences:  []string{"api", "other"},
+					ClockSkew:  time.Minute,
+					Algorithms: []string{"RS256"},
+					RequiredClaims: []conf.ClaimMatcher{
+						{Name: "realm_access.roles", Values: []string{"admin"}},
+						{Name: "email", Pattern: `.*@example\.com`},
+					},
+					Scopes: []string{"read", "write"},
+					Realm:  "test",
+				},
+			},
+		}, r)
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	sign := func(override jwt.MapClaims) string {
+		c := jwt.MapClaims{
+			"iss":          "https://idp",
+			"aud":          []string{"api"},
+			"exp":          time.Now().Add(time.Hour).Unix(),
+			"iat":          time.Now().Unix(),
+			"email":        "bob@example.com",
+			"scope":        "read write profile",
+			"realm_access": map[string]any{"roles": []string{"user", "admin"}},
+		}
+		for k, v := range override {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+		token.Header["kid"] = "test"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	hs256, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{}).SignedString([]byte("secret"))
+
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+		// the expected WWW-Authenticate header prefix
+		challenge string
+	}{
+		{"valid", "Bearer " + sign(nil), http.StatusOK, ""},
+		{"scp list", "Bearer " + sign(jwt.MapClaims{"scope": nil, "scp": []string{"read", "write"}}), http.StatusOK, ""},
+		{"expired within skew", "Bearer " + sign(jwt.MapClaims{"exp": time.Now().Add(-30 * time.Second).Unix()}), http.StatusOK, ""},
+		{"no token", "", http.StatusUnauthorized, `Bearer realm="test"`},
+		{"basic", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, `Bearer realm="test"`},
+		{"malformed", "Bearer a b", http.StatusBadRequest, `Bearer realm="test", error="invalid_request"`},
+		{"garbage", "Bearer abc", http.StatusUnauthorized, `Bearer realm="test", error="invalid_token"`},
+		{"hs256", "Bearer " + hs256, http.StatusUnauthorized, `Bearer realm="test", error="invalid_token"`},
+		{"expired", "Bearer " + sign(jwt.MapClaims{"exp": time.Now().Add(-2 * time.Minute).Unix()}), http.StatusUnauthorized, `Bearer realm="test", error="invalid_token"`},
+		{"issuer", "Bearer " + sign(jwt.MapClaims{"iss": "https://other"}), http.StatusUnauthorized, `Bearer realm="test", error="invalid_token"`},
+		{"audience", "Bearer " + sign(jwt.MapClaims{"aud": "another-client"}), http.StatusUnauthorized, `Bearer realm="test", error="invalid_token"`},
+		{"role", "Bearer " + sign(jwt.MapClaims{"realm_access": map[string]any{"roles": []string{"user"}}}), http.StatusForbidden, `Bearer realm="test", error="insufficient_scope"`},
+		{"email", "Bearer " + sign(jwt.MapClaims{"email": "bob@example.com.evil"}), http.StatusForbidden, `Bearer realm="test", error="insufficient_scope"`},
+		{"scope", "Bearer " + sign(jwt.MapClaims{"scope": "read"}), http.StatusForbidden, `Bearer realm="test", error="insufficient_scope"`},
+	}
+	for _, tt := range tests {
+		claims = nil
+		req, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		challenge := res.Header.Get("WWW-Authenticate")
+		if res.StatusCode != tt.status || !strings.HasPrefix(challenge, tt.challenge) || (tt.challenge == "") != (challenge == "") {
+			t.Fatalf("%s: unexpected response %d %s", tt.name, res.StatusCode, challenge)
+		}
+		if tt.status == http.StatusOK && claims["email"] != "bob@example.com" {
+			t.Fatalf("%s: the claims should be into the context", tt.name)
+		}
+	}
+
+	// the insufficient scope challenge lists the required scopes
+	req, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+	req.Header.Set("Authorization", "Bearer "+sign(jwt.MapClaims{"scope": "read"}))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if !strings.HasSuffix(res.Header.Get("WWW-Authenticate"), `scope="read write"`) {
+		t.Fatalf("unexpected challenge %s", res.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestJWTSession(t *testing.T) {
+	var session jwt.MapClaims
+	m := (&JWTAuthMiddleware{}).Init(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				// never fetched: the sessions carry their claims
+				JwksURL: "http://127.0.0.1:1/certs",
+				JWT: conf.JWT{
+					Issuer:    "https://idp",
+					Audiences: []string{"dashboard"},
+					RequiredClaims: []conf.ClaimMatcher{
+						{Name: "realm_access.roles", Values: []string{"admin"}},
+					},
+					Scopes: []string{"read"},
+				},
+			},
+		}, r)
+		// acts like the oidc middleware
+		cc.Auth.Authorized = true
+		cc.Auth.JwtClaims = session
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	claims := func(override map[string]any) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":          "https://idp",
+			"aud":          "dashboard",
+			"scope":        "openid read",
+			"realm_access": map[string]any{"roles": []any{"user", "admin"}},
+		}
+		for k, v := range override {
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"valid", claims(nil), http.StatusOK},
+		{"issuer", claims(map[string]any{"iss": "https://other"}), http.StatusUnauthorized},
+		{"audience", claims(map[string]any{"aud": "other"}), http.StatusUnauthorized},
+		{"role", claims(map[string]any{"realm_access": map[string]any{"roles": []any{"user"}}}), http.StatusForbidden},
+		{"scope", claims(map[string]any{"scope": "openid"}), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		session = tt.claims
+		res, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.status {
+			t.Fatalf("%s: unexpected status %d", tt.name, res.StatusCode)
+		}
+	}
+}
@@ -1,19 +1,19 @@
 package cache
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"net/http"
-	"net/textproto"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ferama/crauti/pkg/chaincontext"
 	"github.com/ferama/crauti/pkg/conf"
 	"github.com/ferama/crauti/pkg/logger"
 	"github.com/ferama/crauti/pkg/middleware"
-	"github.com/ferama/crauti/pkg/redis"
+	"github.com/ferama/crauti/pkg/store"
 	"github.com/ferama/crauti/pkg/utils"
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
@@ -27,11 +27,22 @@ const (
 	CachedContentHeaderValue   = "crauti/cache"
 	UpstreamContentHeaderValue = "crauti/upstream"
 
-	// redis key heads. The redis key is build using the format
+	// store key heads. The store key is build using the format
 	//  KEYHEAD:KEYENCODING
+	entryKeyHead = "ENTRY"
+	// the body chunks of large entries
+	chunkKeyHead = "CHUNK"
+	// the distributed fill locks
+	fillLockKeyHead = "FILL"
+	// the list of request headers the response varies on
+	varyKeyHead = "VARY"
+
+	// key heads of the legacy entry format. An entry was split
+	// across multiple keys
 	bodyKeyHead    = "BODY"
 	headersKeyHead = "HEADERS"
 	statusKeyHead  = "STATUS"
+	metaKeyHead    = "META"
 )
 
 var (
@@ -57,7 +68,7 @@ func init() {
 	}
 }
 
-func buildRedisKey(keyHead string, key string) string {
+func buildStoreKey(keyHead string, key string) string {
 	return fmt.Sprintf("%s:%s", keyHead, key)
 }
 
@@ -77,11 +88,14 @@ type CacheMiddleware struct {
 
 	mu      sync.Mutex
 	lockmap map[string]*sync.Mutex
+	// cache keys with a background refresh in progress
+	refreshing map[string]bool
 }
 
 func (m *CacheMiddleware) Init(next http.Handler) middleware.Middleware {
 	m.next = next
 	m.lockmap = make(map[string]*sync.Mutex)
+	m.refreshing = make(map[string]bool)
 	return m
 }
 
@@ -110,12 +124,26 @@ func (m *CacheMiddleware) buildCacheKey(r *http.Request) string {
 	}
 	sort.Strings(keys)
 
-	enc := fmt.Sprintf("%s%s", r.Method, r.URL)
+	ctx := chaincontext.GetChainContext(r)
+	policy := ctx.Conf.Middlewares.Cache.Key
+
+	enc := fmt.Sprintf("%s%s", r.Method, urlKey(r, policy))
+	// the GraphQL operations are identified by their own key, so the
+	// GET and POST requests share the cached responses
+	if ctx.GraphQL.Key != "" {
+		u := *r.URL
+		u.RawQuery = ""
+		enc = fmt.Sprintf("GQL%s|%s", u.String(), ctx.GraphQL.Key)
+		if policy.IsHost() {
+			enc = strings.ToLower(r.Host) + enc
+		}
+	}
 	for _, k := range keys {
 		v := r.Header.Get(k)
 		enc = m.encodeKeyHeader(r, enc, k, v)
 	}
-	ctx := chaincontext.GetChainContext(r)
+	enc += cookiesKey(r, policy)
+
 	if !ctx.Auth.Authorized {
 		return enc
 	}
@@ -137,47 +165,316 @@ func (m *CacheMiddleware) buildCacheKey(r *http.Request) string {
 	return enc
 }
 
-func (m *CacheMiddleware) serveFromCache(key string, w http.ResponseWriter, r *http.Request) bool {
-	body, _ := redis.CacheInstance().Get(buildRedisKey(bodyKeyHead, key))
-	if body != nil {
-		log.Debug().
-			Str("status", utils.CacheStatusHit).
-			Str("key", key).Send()
-
-		// retrieve headers string from the cache, recontsruct them
-		// and put into response
-		headers, _ := redis.CacheInstance().Get(buildRedisKey(headersKeyHead, key))
-		if headers != nil {
-			reader := bufio.NewReader(strings.NewReader(string(headers) + "\r\n"))
-			tp := textproto.NewReader(reader)
-			mimeHeader, err := tp.ReadMIMEHeader()
-			if err != nil {
-				httpHeader := http.Header(mimeHeader)
-				for k, v := range httpHeader {
-					w.Header().Set(k, strings.Join(v, ","))
-				}
-			}
+// checks if a cached entry can be used to satisfy the request
+func (m *CacheMiddleware) acceptable(e *entry, r *http.Request) bool {
+	ctx := chaincontext.GetChainContext(r)
+	if !ctx.Conf.Middlewares.Cache.IsRFC9111() {
+		return e.freshness() > 0
+	}
+
+	reqCC := parseCacheControl(r.Header)
+	if maxAge, ok := reqCC.duration("max-age"); ok && e.age() > maxAge {
+		return false
+	}
+	freshness := e.freshness()
+	if minFresh, ok := reqCC.duration("min-fresh"); ok && freshness < minFresh {
+		return false
+	}
+	if freshness > 0 {
+		return true
+	}
+
+	// the entry is stale. It can be served only if the client
+	// explicitly allows it
+	if !reqCC.has("max-stale") {
+		return false
+	}
+	cc := parseCacheControl(e.Header)
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		return false
+	}
+	// max-stale without a value means that any stale entry is good
+	if maxStale, ok := reqCC.duration("max-stale"); ok && -freshness > maxStale {
+		return false
+	}
+	return true
+}
+
+// looks for a cached response matching the request. Returns the entry (nil if
+// not found) and the key it is stored with
+func (m *CacheMiddleware) lookup(key string, r *http.Request) (*entry, string) {
+	chainContext := chaincontext.GetChainContext(r)
+	if chainContext.Conf.Middlewares.Cache.IsRFC9111() {
+		key = resolveKey(key, r)
+	}
+
+	e, ok := loadEntry(key, true)
+	if !ok {
+		return nil, key
+	}
+	return e, key
+}
+
+// writes the cached response. If the client sent a conditional request and
+// the cached response satisfies it, a 304 response is written instead
+func (m *CacheMiddleware) writeEntry(e *entry, cond conditions, w http.ResponseWriter, s signal) {
+	// put the cached headers into response. The cookies are never
+	// replayed, even if an older entry stored them
+	for k, v := range e.Header {
+		if k == "Set-Cookie" {
+			continue
 		}
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	generator := CachedContentHeaderValue
+	if s.status == utils.CacheStatusMiss {
+		generator = UpstreamContentHeaderValue
+	}
+	setGenerator(w.Header(), s.conf, generator)
+	s.apply(w.Header(), e)
 
-		w.Header().Set(GeneratorHeaderKey, CachedContentHeaderValue)
+	if e.Status == http.StatusOK && cond.notModified(e.Header) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if e.Status == http.StatusOK {
+		if w.Header().Get("Accept-Ranges") == "" {
+			w.Header().Set("Accept-Ranges", "bytes")
+		}
+		if cond.ranges != "" {
+			m.serveRange(e, cond, w)
+			return
+		}
+	}
 
-		// get cached status and write back to the response
-		status, _ := redis.CacheInstance().GetInt(buildRedisKey(statusKeyHead, key))
-		w.WriteHeader(status)
-		w.Write(body)
+	// write back the cached status and body
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+
+	// large entries are streamed chunk by chunk
+	for _, key := range e.chunks {
+		chunk, err := loadChunk(key)
+		if err != nil {
+			// the headers are already sent. Abort the response so the
+			// client doesn't get a truncated body
+			log.Error().Err(err).Str("key", key).Msg("unable to load the cache entry chunk")
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(chunk)
+	}
+}
 
-		// set the hit status into the context
-		chainContext := chaincontext.GetChainContext(r)
-		chainContext.Cache.Status = utils.CacheStatusHit
-		r = chainContext.Update()
+func (m *CacheMiddleware) serveFromCache(e *entry, key string, w http.ResponseWriter, r *http.Request) bool {
+	if e == nil || !m.acceptable(e, r) {
+		return false
+	}
 
-		// we can safely proceed calling the next op here. We set the cache
-		// status into the context, so the next ops can adapt their behaviour using
-		// this information
-		m.next.ServeHTTP(w, r)
-		return true
+	log.Debug().
+		Str("status", utils.CacheStatusHit).
+		Str("key", key).Send()
+
+	chainContext := chaincontext.GetChainContext(r)
+	m.writeEntry(e, requestConditions(r), w, signal{
+		conf:   chainContext.Conf.Middlewares.Cache,
+		status: utils.CacheStatusHit,
+		key:    key,
+	})
+
+	// set the hit status into the context
+	chainContext.Cache.Status = utils.CacheStatusHit
+	r = chainContext.Update()
+
+	// we can safely proceed calling the next op here. We set the cache
+	// status into the context, so the next ops can adapt their behaviour using
+	// this information
+	m.next.ServeHTTP(w, r)
+	return true
+}
+
+// updates a stale entry after a successful revalidation, using the
+// headers sent with the upstream 304 response (RFC 9111 section 4.3.4)
+func (m *CacheMiddleware) refresh(e *entry, key string, header http.Header, c conf.Cache) {
+	if err := e.loadBody(); err != nil {
+		log.Error().Err(err).Str("key", key).Msg("unable to refresh the cache entry")
+		return
 	}
-	return false
+	for k, v := range header {
+		if k == generatorHeader(c) || k == "Content-Length" || k == "Set-Cookie" {
+			continue
+		}
+		e.Header[k] = v
+	}
+	e.meta.StoredAt = time.Now()
+	e.meta.TTL = c.TTL
+	e.meta.InitialAge = 0
+
+	if c.IsRFC9111() {
+		if lifetime, ok := freshnessLifetime(e.Header, parseCacheControl(e.Header)); ok {
+			e.meta.TTL = lifetime
+		}
+		e.meta.InitialAge = initialAge(e.Header)
+	}
+	storeEntry(key, e, staleRetention(e.Header, c))
+}
+
+// serves a stale entry if it is within the stale-while-revalidate window
+// and starts a background refresh of it
+func (m *CacheMiddleware) serveStale(e *entry, key string, cacheKey string, w http.ResponseWriter, r *http.Request) bool {
+	if e == nil {
+		return false
+	}
+	ctx := chaincontext.GetChainContext(r)
+	c := ctx.Conf.Middlewares.Cache
+
+	staleness := -e.freshness()
+	swr, _ := staleWindows(e.Header, c)
+	if staleness <= 0 || staleness > swr || !staleAllowed(e, r, c) {
+		return false
+	}
+
+	log.Debug().
+		Str("status", utils.CacheStatusStale).
+		Str("key", key).Msg("stale while revalidate")
+
+	// the refresh updates the entry: write it before starting
+	m.writeEntry(e, requestConditions(r), w, signal{
+		conf:   c,
+		status: utils.CacheStatusStale,
+		key:    key,
+	})
+	m.backgroundRefresh(e, key, cacheKey, r)
+
+	ctx.Cache.Status = utils.CacheStatusStale
+	r = ctx.Update()
+	m.next.ServeHTTP(w, r)
+	return true
+}
+
+// refreshes a stale entry without blocking the client. No more than one
+// refresh per cache key runs at the same time
+func (m *CacheMiddleware) backgroundRefresh(e *entry, key string, cacheKey string, r *http.Request) {
+	m.mu.Lock()
+	if m.refreshing[cacheKey] {
+		m.mu.Unlock()
+		return
+	}
+	m.refreshing[cacheKey] = true
+	m.mu.Unlock()
+
+	// the client request is going to be canceled as soon as the stale
+	// response is sent
+	ctx := chaincontext.GetChainContext(r)
+	br := ctx.Detach()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			delete(m.refreshing, cacheKey)
+		}()
+
+		if timeout := ctx.Conf.Middlewares.Timeout; timeout > 0 {
+			tctx, cancel := context.WithTimeout(br.Context(), timeout)
+			defer cancel()
+			br = br.WithContext(tctx)
+		}
+		rw := m.fetch(&discardWriter{header: http.Header{}}, br, cacheKey, fetchOptions{
+			stale:       e,
+			staleKey:    key,
+			keepOnError: true,
+		})
+		responseWriterPool.Put(rw)
+	}()
+}
+
+type fetchOptions struct {
+	// a stale entry to revalidate
+	stale    *entry
+	staleKey string
+	// always preserve the stale entry on upstream errors
+	keepOnError bool
+	// if set, the response is stored only if the lock is still held
+	lock *fillLock
+	// the response is not forwarded to the client. The caller
+	// needs to write it (see responseWriter.holding)
+	hold bool
+}
+
+// pokes the upstream and stores its response. If a stale entry is available
+// the request is turned into a conditional one to revalidate it and, when
+// allowed, upstream errors are not forwarded so the stale entry can replace
+// them.
+// The returned writer needs to be put back into the pool by the caller
+func (m *CacheMiddleware) fetch(w http.ResponseWriter, r *http.Request, cacheKey string, opts fetchOptions) *responseWriter {
+	ctx := chaincontext.GetChainContext(r)
+	c := ctx.Conf.Middlewares.Cache
+	stale, staleKey := opts.stale, opts.staleKey
+
+	rw := responseWriterPool.Get().(*responseWriter)
+	rw.Reset(r, w, cacheKey)
+	rw.maxObjectSize, _ = utils.ConvertToBytes(c.MaxObjectSize)
+	rw.holding = opts.hold
+
+	if stale != nil {
+		if hasValidators(stale.Header) {
+			log.Debug().
+				Str("key", staleKey).
+				Msg("revalidating stale entry")
+
+			rw.revalidating = true
+			setConditionalHeaders(r.Header, stale.Header)
+		}
+		_, sie := staleWindows(stale.Header, c)
+		rw.staleIfError = opts.keepOnError ||
+			(-stale.freshness() <= sie && staleAllowed(stale, r, c))
+	}
+
+	rw.signal = &signal{
+		conf:   c,
+		status: ctx.Cache.Status,
+		key:    cacheKey,
+	}
+	setGenerator(rw.Header(), c, UpstreamContentHeaderValue)
+	m.next.ServeHTTP(rw, r)
+
+	switch {
+	case rw.failed:
+		log.Debug().
+			Int("upstreamStatus", rw.statusCode).
+			Str("key", staleKey).
+			Msg("upstream error: keeping the stale entry")
+	case !opts.lock.held():
+		log.Warn().
+			Str("key", cacheKey).
+			Msg("fill lock lease expired: response not stored")
+	case rw.notModified:
+		// the upstream confirmed that the stale entry is still valid
+		m.refresh(stale, staleKey, rw.Header(), c)
+	default:
+		// the request was served from the upstream.
+		// store the response into the cache
+		rw.Done(c)
+	}
+	return rw
+}
+
+// The client asked for a cached response only (Cache-Control: only-if-cached)
+// but we have not a suitable one
+func (m *CacheMiddleware) gatewayTimeout(w http.ResponseWriter, r *http.Request, key string) {
+	ctx := chaincontext.GetChainContext(r)
+	log.Debug().
+		Str("key", key).
+		Msg("only-if-cached request without a suitable cached response")
+
+	ctx.Cache.Status = utils.CacheStatusMiss
+	signal{
+		conf:   ctx.Conf.Middlewares.Cache,
+		status: utils.CacheStatusMiss,
+		key:    key,
+		detail: "only-if-cached",
+	}.apply(w.Header(), nil)
+	w.WriteHeader(http.StatusGatewayTimeout)
 }
 
 func (m *CacheMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -186,35 +483,124 @@ func (m *CacheMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// if the request should not be cached because the http
 	// method needs to be ignored or because it is disabled,
 	// directly serve it ignoring the cache
-	if !contains(conf.Methods, r.Method) || !conf.IsEnabled() {
+	cacheable := contains(conf.Methods, r.Method)
+	// the GraphQL operations are cacheable whatever the method is
+	if ctx.GraphQL.Operation != "" {
+		cacheable = ctx.GraphQL.Cacheable()
+	}
+	if !cacheable || !conf.IsEnabled() {
 
 		if conf.IsEnabled() {
 			ctx.Cache.Status = utils.CacheStatusBypass
 			r = ctx.Update()
+			signal{
+				conf:   conf,
+				status: utils.CacheStatusBypass,
+				fwd:    "method",
+			}.apply(w.Header(), nil)
 
 			log.Debug().
 				Str("status", utils.CacheStatusBypass).
 				Str("key", fmt.Sprintf("%s%s", r.Method, r.URL)).Send()
 
+			if conf.Invalidation.IsEnabled() && contains(conf.Invalidation.Methods, r.Method) {
+				w = &invalidationWriter{
+					w:          w,
+					r:          r,
+					conf:       conf.Invalidation,
+					mountPoint: ctx.Conf.Path,
+					matchHost:  ctx.Conf.MatchHost,
+				}
+			}
+		}
+
+		m.next.ServeHTTP(w, r)
+		if iw, ok := w.(*invalidationWriter); ok {
+			iw.done()
 		}
+		return
+	}
+
+	// do not wait for an unhealthy store: serve the request
+	// as if the cache was disabled
+	if !store.Instance().Available() {
+		ctx.Cache.Status = utils.CacheStatusBypassError
+		r = ctx.Update()
+		signal{
+			conf:   conf,
+			status: utils.CacheStatusBypassError,
+			detail: "store unavailable",
+		}.apply(w.Header(), nil)
+
+		log.Debug().
+			Str("status", utils.CacheStatusBypassError).
+			Str("key", fmt.Sprintf("%s%s", r.Method, r.URL)).Send()
 
 		m.next.ServeHTTP(w, r)
 		return
 	}
 
 	cacheKey := m.buildCacheKey(r)
+	if conf.Key.IsDebugHeader() {
+		w.Header().Set(CacheKeyHeaderKey, cacheKey)
+	}
 
 	ignoreCache := false
-	// It works like the amazon api gateway
-	// https://docs.aws.amazon.com/apigateway/latest/developerguide/api-gateway-caching.html
-	if r.Header.Get("Cache-Control") == "max-age=0" {
+	onlyIfCached := false
+	if conf.IsRFC9111() {
+		reqCC := parseCacheControl(r.Header)
+		// the response must not be stored
+		if reqCC.has("no-store") {
+			log.Debug().
+				Str("status", utils.CacheStatusBypass).
+				Str("key", cacheKey).Msg("no-store request")
+
+			ctx.Cache.Status = utils.CacheStatusBypass
+			r = ctx.Update()
+			signal{
+				conf:   conf,
+				status: utils.CacheStatusBypass,
+				key:    cacheKey,
+				fwd:    "request",
+			}.apply(w.Header(), nil)
+			m.next.ServeHTTP(w, r)
+			return
+		}
+		// the client wants a response validated by the upstream
+		if reqCC.has("no-cache") {
+			ignoreCache = true
+		}
+		onlyIfCached = reqCC.has("only-if-cached")
+	} else if r.Header.Get("Cache-Control") == "max-age=0" {
+		// It works like the amazon api gateway
+		// https://docs.aws.amazon.com/apigateway/latest/developerguide/api-gateway-caching.html
 		log.Debug().Str("key", cacheKey).Msg("ignore cache request with Cache-Control header")
 		ignoreCache = true
 	}
 
+	if onlyIfCached && ignoreCache {
+		m.gatewayTimeout(w, r, cacheKey)
+		return
+	}
+
+	// a stale cached response that can be revalidated or used
+	// in place of an upstream error
+	var stale *entry
+	var staleKey string
+	// the distributed fill lock, if held
+	var lock *fillLock
+
 	if !ignoreCache {
 		// try to get response from cache
-		if m.serveFromCache(cacheKey, w, r) {
+		e, key := m.lookup(cacheKey, r)
+		if m.serveFromCache(e, key, w, r) {
+			return
+		}
+		if !onlyIfCached && m.serveStale(e, key, cacheKey, w, r) {
+			return
+		}
+		if onlyIfCached {
+			m.gatewayTimeout(w, r, cacheKey)
 			return
 		}
 		// No more then one concurrent request of the same kind (with the same enc) should hit the backend.
@@ -222,6 +608,7 @@ func (m *CacheMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// make same request to the backend.
 		// I'm using an in memory map that is is not distributed to hold the locks (I will have one
 		// per replica). The penality is that I could have 'max backend concurrent calls = max replicas'.
+		// Enable the distributedLock to coordinate the replicas too (see distributedFill).
 		//
 		// The logic will prevent backend bombing. Imagine the situation where we have like 1000 concurrent
 		// request at the same time to the same resource: they will all hit the cache until the cache expires.
@@ -255,9 +642,22 @@ func (m *CacheMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		// Another coroutine (the non locked one) likely has filled the cache already
 		// so take the advantage here
-		if m.serveFromCache(cacheKey, w, r) {
+		e, key = m.lookup(cacheKey, r)
+		if m.serveFromCache(e, key, w, r) {
 			return
 		}
+		if e != nil {
+			stale = e
+			staleKey = key
+		}
+		if conf.IsDistributedLock() {
+			var served bool
+			lock, served = m.distributedFill(cacheKey, w, r)
+			if served {
+				return
+			}
+			defer lock.release()
+		}
 		log.Debug().
 			Str("status", utils.CacheStatusMiss).
 			Str("key", cacheKey).Send()
@@ -274,14 +674,54 @@ func (m *CacheMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r = ctx.Update()
 	}
 
-	// If I'm here, I need to poke the backend and fill the cache
-	rw := responseWriterPool.Get().(*responseWriter)
+	// If I'm here, I need to poke the backend and fill the cache.
+	// The client conditions need to be evaluated against the cached
+	// response: take them before turning the request into a conditional one
+	cond := requestConditions(r)
+	opts := fetchOptions{
+		stale:    stale,
+		staleKey: staleKey,
+		lock:     lock,
+	}
+	// fetch the full object and serve the requested range from it
+	if cond.ranges != "" && r.Method == http.MethodGet && conf.RangeMiss == RangeMissFull {
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+		opts.hold = true
+	}
+	rw := m.fetch(w, r, cacheKey, opts)
 	defer responseWriterPool.Put(rw)
-	rw.Reset(r, w, cacheKey)
 
-	rw.Header().Set(GeneratorHeaderKey, UpstreamContentHeaderValue)
-	m.next.ServeHTTP(rw, r)
-	// the request was served from the upstream.
-	// store the response into the cache
-	rw.Done(conf.TTL)
+	switch {
+	case rw.notModified:
+		log.Debug().
+			Str("status", utils.CacheStatusRevalidated).
+			Str("key", staleKey).Send()
+
+		ctx.Cache.Status = utils.CacheStatusRevalidated
+		m.writeEntry(stale, cond, w, signal{
+			conf:      conf,
+			status:    utils.CacheStatusRevalidated,
+			key:       staleKey,
+			fwdStatus: rw.statusCode,
+		})
+	case rw.failed:
+		log.Debug().
+			Str("status", utils.CacheStatusStale).
+			Str("key", staleKey).Msg("stale if error")
+
+		// drop the headers of the error response
+		for k := range w.Header() {
+			delete(w.Header(), k)
+		}
+		ctx.Cache.Status = utils.CacheStatusStale
+		m.writeEntry(stale, cond, w, signal{
+			conf:      conf,
+			status:    utils.CacheStatusStale,
+			key:       staleKey,
+			fwdStatus: rw.statusCode,
+		})
+	case rw.holding:
+		m.writeHeld(rw, cond, w)
+	}
 }
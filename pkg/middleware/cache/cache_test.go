@@ -0,0 +1,814 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/middleware/graphql"
+	"github.com/ferama/crauti/pkg/redis"
+	"github.com/ferama/crauti/pkg/store"
+	"github.com/ferama/crauti/pkg/utils"
+)
+
+func init() {
+	conf.ConfInst.CacheStore.Backend = store.BackendMemory
+	store.Update()
+}
+
+type upstream struct {
+	calls   atomic.Int32
+	handler http.HandlerFunc
+}
+
+// builds a test server with the cache middleware in front of the
+// upstream handler
+func buildServer(c conf.Cache, u *upstream) *httptest.Server {
+	// acts like the reverse proxy middleware: the upstream is poked
+	// only if the response wasn't served from the cache
+	root := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := chaincontext.GetChainContext(r)
+		if ctx.Cache.ServedFromCache() {
+			return
+		}
+		u.calls.Add(1)
+		u.handler(w, r)
+	})
+	m := (&CacheMiddleware{}).Init(root)
+
+	chain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				Cache: c,
+			},
+		}, r)
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	})
+	return httptest.NewServer(chain)
+}
+
+func rfc9111Conf() conf.Cache {
+	enabled := true
+	return conf.Cache{
+		Enabled:   &enabled,
+		RFC9111:   &enabled,
+		TTL:       time.Minute,
+		KeepStale: time.Minute,
+		Methods:   []string{http.MethodGet},
+	}
+}
+
+func get(t *testing.T, url string, headers map[string]string) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	return res
+}
+
+func TestRFC9111Storable(t *testing.T) {
+	tests := map[string]struct {
+		header http.Header
+		stored bool
+	}{
+		"max-age":    {http.Header{"Cache-Control": {"max-age=60"}}, true},
+		"no-headers": {http.Header{}, true},
+		"no-store":   {http.Header{"Cache-Control": {"no-store"}}, false},
+		"private":    {http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		"max-age=0":  {http.Header{"Cache-Control": {"max-age=0"}}, false},
+		"cookie":     {http.Header{"Set-Cookie": {"a=b"}}, false},
+		"vary-all":   {http.Header{"Vary": {"*"}}, false},
+	}
+
+	for name, test := range tests {
+		u := &upstream{
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range test.header {
+					w.Header()[k] = v
+				}
+				w.Write([]byte("done"))
+			},
+		}
+		s := buildServer(rfc9111Conf(), u)
+		url := fmt.Sprintf("%s/storable/%s", s.URL, name)
+		get(t, url, nil)
+		res := get(t, url, nil)
+		s.Close()
+
+		stored := res.Header.Get(GeneratorHeaderKey) == CachedContentHeaderValue
+		if stored != test.stored {
+			t.Fatalf("%s: expected stored=%v", name, test.stored)
+		}
+	}
+}
+
+func TestRFC9111Vary(t *testing.T) {
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+		},
+	}
+	s := buildServer(rfc9111Conf(), u)
+	defer s.Close()
+
+	url := s.URL + "/vary"
+	get(t, url, map[string]string{"Accept-Language": "en"})
+	get(t, url, map[string]string{"Accept-Language": "it"})
+	res := get(t, url, map[string]string{"Accept-Language": "en"})
+
+	if u.calls.Load() != 2 {
+		t.Fatalf("expected 2 upstream calls, got %d", u.calls.Load())
+	}
+	if res.Header.Get(GeneratorHeaderKey) != CachedContentHeaderValue {
+		t.Fatal("expected a cached response")
+	}
+}
+
+func TestRFC9111RequestDirectives(t *testing.T) {
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=1")
+			w.Write([]byte("done"))
+		},
+	}
+	s := buildServer(rfc9111Conf(), u)
+	defer s.Close()
+
+	url := s.URL + "/directives"
+
+	res := get(t, url, map[string]string{"Cache-Control": "only-if-cached"})
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", res.StatusCode)
+	}
+
+	get(t, url, nil)
+	get(t, url, map[string]string{"Cache-Control": "no-cache"})
+	if u.calls.Load() != 2 {
+		t.Fatalf("no-cache: expected 2 upstream calls, got %d", u.calls.Load())
+	}
+	get(t, url, map[string]string{"Cache-Control": "no-store"})
+	if u.calls.Load() != 3 {
+		t.Fatalf("no-store: expected 3 upstream calls, got %d", u.calls.Load())
+	}
+
+	res = get(t, url, map[string]string{"Cache-Control": "only-if-cached"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	// let the entry become stale
+	time.Sleep(1100 * time.Millisecond)
+
+	res = get(t, url, map[string]string{"Cache-Control": "max-stale"})
+	if res.Header.Get(GeneratorHeaderKey) != CachedContentHeaderValue {
+		t.Fatal("max-stale: expected a cached response")
+	}
+	res = get(t, url, map[string]string{"Cache-Control": "only-if-cached"})
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("stale entry: expected 504, got %d", res.StatusCode)
+	}
+	get(t, url, nil)
+	if u.calls.Load() != 4 {
+		t.Fatalf("stale entry: expected 4 upstream calls, got %d", u.calls.Load())
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	var notModified atomic.Int32
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("done"))
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled:   &enabled,
+		TTL:       time.Second,
+		KeepStale: time.Minute,
+		Methods:   []string{http.MethodGet},
+	}, u)
+	defer s.Close()
+
+	url := s.URL + "/revalidation"
+	get(t, url, nil)
+
+	// the client already has the cached version
+	res := get(t, url, map[string]string{"If-None-Match": `W/"v1"`})
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", res.StatusCode)
+	}
+
+	// let the entry become stale
+	time.Sleep(1100 * time.Millisecond)
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "done" {
+		t.Fatalf("expected the cached body, got %d '%s'", res.StatusCode, body)
+	}
+	if notModified.Load() != 1 {
+		t.Fatal("expected a conditional request to the upstream")
+	}
+
+	// the entry was refreshed
+	res = get(t, url, nil)
+	if u.calls.Load() != 2 {
+		t.Fatalf("expected 2 upstream calls, got %d", u.calls.Load())
+	}
+	if res.Header.Get(GeneratorHeaderKey) != CachedContentHeaderValue {
+		t.Fatal("expected a cached response")
+	}
+}
+
+func getBody(t *testing.T, url string) (*http.Response, string) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	u := &upstream{}
+	u.handler = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "v%d", u.calls.Load())
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled:              &enabled,
+		TTL:                  time.Second,
+		StaleWhileRevalidate: time.Minute,
+		Methods:              []string{http.MethodGet},
+	}, u)
+	defer s.Close()
+
+	url := s.URL + "/swr"
+	get(t, url, nil)
+
+	// let the entry become stale
+	time.Sleep(1100 * time.Millisecond)
+
+	res, body := getBody(t, url)
+	if body != "v1" || res.Header.Get(GeneratorHeaderKey) != CachedContentHeaderValue {
+		t.Fatalf("expected the stale body, got '%s'", body)
+	}
+
+	// wait for the background refresh
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, body = getBody(t, url)
+		if body == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the entry was not refreshed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if u.calls.Load() != 2 {
+		t.Fatalf("expected 2 upstream calls, got %d", u.calls.Load())
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	u := &upstream{}
+	u.handler = func(w http.ResponseWriter, r *http.Request) {
+		if u.calls.Load() > 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("failed"))
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=1, stale-if-error=60")
+		w.Write([]byte("done"))
+	}
+	s := buildServer(rfc9111Conf(), u)
+	defer s.Close()
+
+	url := s.URL + "/sie"
+	get(t, url, nil)
+
+	// let the entry become stale
+	time.Sleep(1100 * time.Millisecond)
+
+	res, body := getBody(t, url)
+	if res.StatusCode != http.StatusOK || body != "done" {
+		t.Fatalf("expected the stale body, got %d '%s'", res.StatusCode, body)
+	}
+	if u.calls.Load() != 2 {
+		t.Fatalf("expected 2 upstream calls, got %d", u.calls.Load())
+	}
+
+	// the client doesn't accept stale responses
+	res = get(t, url, map[string]string{"Cache-Control": "max-age=0"})
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", res.StatusCode)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set(SurrogateKeyHeaderKey, "products product-"+r.URL.Query().Get("id"))
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("done"))
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled:   &enabled,
+		TTL:       time.Minute,
+		KeepStale: time.Minute,
+		Methods:   []string{http.MethodGet},
+	}, u)
+	defer s.Close()
+
+	url1 := s.URL + "/purge?id=1"
+	url2 := s.URL + "/purge?id=2"
+	cached := func(url string) bool {
+		res := get(t, url, nil)
+		return res.Header.Get(GeneratorHeaderKey) == CachedContentHeaderValue
+	}
+
+	get(t, url1, nil)
+	get(t, url2, nil)
+	if !cached(url1) || !cached(url2) {
+		t.Fatal("expected cached responses")
+	}
+
+	if purged, err := PurgeTag("product-1", false); err != nil || purged != 1 {
+		t.Fatalf("expected 1 purged entry, got %d %v", purged, err)
+	}
+	if cached(url1) || !cached(url2) {
+		t.Fatal("only the product-1 entry should be purged")
+	}
+
+	// soft purged entries are revalidated
+	if purged, _ := PurgeURL("http://localhost/purge?id=2", true); purged != 1 {
+		t.Fatal("expected 1 purged entry")
+	}
+	calls := u.calls.Load()
+	res := get(t, url2, nil)
+	if u.calls.Load() != calls+1 || res.Header.Get(GeneratorHeaderKey) != CachedContentHeaderValue {
+		t.Fatal("expected a revalidation")
+	}
+
+	// the mount point is shared with the other tests
+	if purged, _ := PurgeMountPoint("", "/", false); purged < 2 {
+		t.Fatalf("expected at least 2 purged entries, got %d", purged)
+	}
+	if cached(url1) || cached(url2) {
+		t.Fatal("all the entries should be purged")
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Has("cl") {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			w.Write([]byte(body))
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled:       &enabled,
+		TTL:           time.Minute,
+		Methods:       []string{http.MethodGet},
+		MaxObjectSize: "50b",
+	}, u)
+	defer s.Close()
+
+	// by Content-Length and crossing the limit mid-stream
+	for _, url := range []string{s.URL + "/large?cl", s.URL + "/large"} {
+		calls := u.calls.Load()
+		getBody(t, url)
+		res, got := getBody(t, url)
+		if got != body {
+			t.Fatal("unexpected body")
+		}
+		if u.calls.Load() != calls+2 || res.Header.Get(GeneratorHeaderKey) == CachedContentHeaderValue {
+			t.Fatalf("%s: the response should not be cached", url)
+		}
+	}
+}
+
+func TestUnknownLengthLimit(t *testing.T) {
+	defer func(limit int64) { unknownLengthLimit = limit }(unknownLengthLimit)
+	unknownLengthLimit = 50
+
+	body := strings.Repeat("x", 100)
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body[:40]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(body[40:]))
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled: &enabled,
+		TTL:     time.Minute,
+		Methods: []string{http.MethodGet},
+	}, u)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		res, got := getBody(t, s.URL+"/chunked")
+		if got != body || res.Header.Get(GeneratorHeaderKey) == CachedContentHeaderValue {
+			t.Fatal("the response should not be cached")
+		}
+	}
+
+	// below the limit the chunked responses are cached
+	body = body[:45]
+	getBody(t, s.URL+"/small")
+	res, got := getBody(t, s.URL+"/small")
+	if got != body || res.Header.Get(GeneratorHeaderKey) != CachedContentHeaderValue {
+		t.Fatal("expected a cached response")
+	}
+}
+
+func TestCacheableStatuses(t *testing.T) {
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+			w.WriteHeader(status)
+			w.Write([]byte("done"))
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled:           &enabled,
+		TTL:               time.Minute,
+		Methods:           []string{http.MethodGet},
+		CacheableStatuses: []string{"200", "404:30s", "5xx:never"},
+		Headers:           conf.CacheHeaders{CacheStatus: &enabled},
+	}, u)
+	defer s.Close()
+
+	tests := []struct {
+		status int
+		cached bool
+		ttl    string
+	}{
+		{http.StatusOK, true, "ttl=59"},
+		{http.StatusNotFound, true, "ttl=29"},
+		{http.StatusInternalServerError, false, ""},
+		// not listed
+		{http.StatusFound, false, ""},
+	}
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, tt := range tests {
+		url := fmt.Sprintf("%s/status/%d", s.URL, tt.status)
+		calls := u.calls.Load()
+		var res *http.Response
+		for i := 0; i < 2; i++ {
+			var err error
+			if res, err = client.Get(url); err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		}
+
+		if got := u.calls.Load() - calls; tt.cached != (got == 1) {
+			t.Fatalf("status %d: unexpected upstream calls %d", tt.status, got)
+		}
+		if tt.cached && !strings.Contains(res.Header.Get(CacheStatusHeaderKey), tt.ttl) {
+			t.Fatalf("status %d: expected %s, got %s", tt.status, tt.ttl, res.Header.Get(CacheStatusHeaderKey))
+		}
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodGet:
+				w.Write([]byte("done"))
+			case r.URL.Query().Has("fail"):
+				w.WriteHeader(http.StatusInternalServerError)
+			default:
+				w.Header().Set("Location", "/inv/items/43")
+				w.WriteHeader(http.StatusNoContent)
+			}
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled: &enabled,
+		TTL:     time.Minute,
+		Methods: []string{http.MethodGet},
+		Invalidation: conf.CacheInvalidation{
+			Enabled:      &enabled,
+			Methods:      []string{http.MethodPut, http.MethodDelete},
+			Location:     &enabled,
+			RelatedPaths: []string{"/inv/items", "/inv/tags/*"},
+		},
+	}, u)
+	defer s.Close()
+
+	invalidated := []string{"/inv/items/42", "/inv/items/42?q=1", "/inv/items/43", "/inv/items", "/inv/tags/a"}
+	kept := []string{"/inv/other", "/inv/tags/a/b"}
+	cached := func(url string) bool {
+		calls := u.calls.Load()
+		get(t, s.URL+url, nil)
+		return u.calls.Load() == calls
+	}
+	for _, url := range append(invalidated, kept...) {
+		get(t, s.URL+url, nil)
+	}
+	// the same path on another mount point
+	otherKey := "GETother.example/inv/items/42"
+	storeEntry(otherKey, &entry{
+		Status: http.StatusOK,
+		Header: http.Header{},
+		Body:   []byte("done"),
+		meta: entryMeta{
+			StoredAt:   time.Now(),
+			TTL:        time.Minute,
+			URL:        "/inv/items/42",
+			MountPoint: "/",
+			MatchHost:  "other.example",
+		},
+	}, 0)
+
+	put := func(url string) {
+		req, _ := http.NewRequest(http.MethodPut, s.URL+url, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		// the invalidation runs after the response is forwarded
+		invalidations.Wait()
+	}
+
+	// failed requests don't invalidate
+	put("/inv/items/42?fail")
+	for _, url := range invalidated {
+		if !cached(url) {
+			t.Fatalf("%s should be still cached", url)
+		}
+	}
+
+	put("/inv/items/42")
+	for _, url := range invalidated {
+		if cached(url) {
+			t.Fatalf("%s should be invalidated", url)
+		}
+	}
+	for _, url := range kept {
+		if !cached(url) {
+			t.Fatalf("%s should be still cached", url)
+		}
+	}
+	if _, ok := Inspect(otherKey); !ok {
+		t.Fatal("the other mount point entries should be kept")
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"data":{}}`))
+		},
+	}
+	enabled := true
+	c := conf.Cache{
+		Enabled: &enabled,
+		TTL:     time.Minute,
+		Methods: []string{http.MethodGet},
+	}
+	root := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chaincontext.GetChainContext(r).Cache.ServedFromCache() {
+			return
+		}
+		u.calls.Add(1)
+		u.handler(w, r)
+	})
+	m := (&graphql.GraphQLMiddleware{}).Init((&CacheMiddleware{}).Init(root))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				Cache:   c,
+				GraphQL: conf.GraphQL{Enabled: &enabled},
+			},
+		}, r)
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	post := func(body string) {
+		res, err := http.Post(s.URL+"/graphql", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	post(`{"query": "{ gql { a } }"}`)
+	post(`{"query": "{\n  gql {\n    a\n  }\n}"}`)
+	get(t, s.URL+"/graphql?query="+url.QueryEscape("{ gql { a } }"), nil)
+	if u.calls.Load() != 1 {
+		t.Fatalf("the query should be cached, upstream calls %d", u.calls.Load())
+	}
+
+	post(`{"query": "mutation { gql }"}`)
+	post(`{"query": "mutation { gql }"}`)
+	if u.calls.Load() != 3 {
+		t.Fatalf("the mutations should not be cached, upstream calls %d", u.calls.Load())
+	}
+}
+
+func TestChunkedEntry(t *testing.T) {
+	chunkSize := conf.ConfInst.CacheStore.ChunkSize
+	conf.ConfInst.CacheStore.ChunkSize = "10b"
+	defer func() {
+		conf.ConfInst.CacheStore.ChunkSize = chunkSize
+	}()
+
+	body := strings.Repeat("0123456789", 3) + "end"
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled: &enabled,
+		TTL:     time.Minute,
+		Methods: []string{http.MethodGet},
+	}, u)
+	defer s.Close()
+
+	url := s.URL + "/chunked"
+	getBody(t, url)
+	res, got := getBody(t, url)
+	if res.Header.Get(GeneratorHeaderKey) != CachedContentHeaderValue {
+		t.Fatal("expected a cached response")
+	}
+	if got != body {
+		t.Fatalf("unexpected body '%s'", got)
+	}
+
+	e, ok := loadEntry("GET/chunked", false)
+	if !ok || e.meta.Chunks != 4 || len(e.chunks) != 3 || string(e.Body) != "0123456789" {
+		t.Fatal("expected a chunked entry")
+	}
+	if err := e.loadBody(); err != nil || string(e.Body) != body {
+		t.Fatal("unable to load the chunked body")
+	}
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	// nothing listens there: the commands fail immediately
+	redisConf := conf.ConfInst.Redis
+	conf.ConfInst.Redis = conf.Redis{Host: "127.0.0.1", Port: 1}
+	conf.ConfInst.Redis.CircuitBreaker.Failures = 1
+	conf.ConfInst.Redis.CircuitBreaker.Cooldown = time.Minute
+	conf.ConfInst.CacheStore.Backend = store.BackendRedis
+	redis.Update()
+	store.Update()
+	defer func() {
+		conf.ConfInst.Redis = redisConf
+		conf.ConfInst.CacheStore.Backend = store.BackendMemory
+		redis.Update()
+		store.Update()
+	}()
+
+	var status string
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			status = chaincontext.GetChainContext(r).Cache.Status
+			w.Write([]byte("done"))
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled: &enabled,
+		TTL:     time.Minute,
+		Methods: []string{http.MethodGet},
+	}, u)
+	defer s.Close()
+
+	// the startup command already opened the breaker
+	res := get(t, s.URL+"/unavailable", nil)
+	if res.StatusCode != http.StatusOK || status != utils.CacheStatusBypassError {
+		t.Fatalf("expected the cache to be bypassed, got %d %s", res.StatusCode, status)
+	}
+}
+
+func TestCacheStatusHeaders(t *testing.T) {
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Status", "origin; fwd=uri-miss")
+			w.Write([]byte("done"))
+		},
+	}
+	enabled := true
+	disabled := false
+	s := buildServer(conf.Cache{
+		Enabled: &enabled,
+		TTL:     time.Minute,
+		Methods: []string{http.MethodGet},
+		Headers: conf.CacheHeaders{
+			Age:           &enabled,
+			CacheStatus:   &enabled,
+			CacheName:     "edge",
+			XCache:        &enabled,
+			XCacheName:    "X-Edge-Cache",
+			HideGenerator: &enabled,
+		},
+	}, u)
+	defer s.Close()
+
+	res := get(t, s.URL+"/signal", nil)
+	values := res.Header.Values("Cache-Status")
+	if len(values) != 2 || values[0] != "origin; fwd=uri-miss" ||
+		!strings.HasPrefix(values[1], "edge; fwd=uri-miss; fwd-status=200; key=") {
+		t.Fatalf("unexpected Cache-Status %q", values)
+	}
+	if res.Header.Get("X-Edge-Cache") != "MISS" || res.Header.Get("Age") != "" {
+		t.Fatal("unexpected miss headers")
+	}
+	if res.Header.Get(GeneratorHeaderKey) != "" {
+		t.Fatal("the generator header should be hidden")
+	}
+
+	res = get(t, s.URL+"/signal", nil)
+	values = res.Header.Values("Cache-Status")
+	// the member added on the miss is not stored
+	if len(values) != 2 || !strings.HasPrefix(values[1], "edge; hit; ttl=") {
+		t.Fatalf("unexpected Cache-Status %q", values)
+	}
+	if res.Header.Get("X-Edge-Cache") != "HIT" || res.Header.Get("Age") != "0" {
+		t.Fatal("unexpected hit headers")
+	}
+
+	// only the generator header
+	s2 := buildServer(conf.Cache{
+		Enabled: &enabled,
+		TTL:     time.Minute,
+		Methods: []string{http.MethodGet},
+		Headers: conf.CacheHeaders{
+			Age:           &disabled,
+			CacheStatus:   &disabled,
+			HideGenerator: &disabled,
+			GeneratorName: "X-Served-By",
+		},
+	}, u)
+	defer s2.Close()
+	get(t, s2.URL+"/signal2", nil)
+	res = get(t, s2.URL+"/signal2", nil)
+	if res.Header.Get("X-Served-By") != CachedContentHeaderValue || len(res.Header.Values("Cache-Status")) != 1 {
+		t.Fatal("unexpected headers")
+	}
+}
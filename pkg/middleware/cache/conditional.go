@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// returns true if the response can be revalidated using a
+// conditional request
+func hasValidators(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// turns the request into a conditional one, using the validators of
+// the stored response
+func setConditionalHeaders(req http.Header, stored http.Header) {
+	req.Del("If-None-Match")
+	req.Del("If-Modified-Since")
+
+	if etag := stored.Get("ETag"); etag != "" {
+		req.Set("If-None-Match", etag)
+	}
+	if lastModified := stored.Get("Last-Modified"); lastModified != "" {
+		req.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// the conditional and range headers sent from the client
+type conditions struct {
+	method          string
+	ifNoneMatch     string
+	ifModifiedSince string
+	ranges          string
+	ifRange         string
+}
+
+func requestConditions(r *http.Request) conditions {
+	c := conditions{
+		method: r.Method,
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return c
+	}
+	c.ifNoneMatch = r.Header.Get("If-None-Match")
+	c.ifModifiedSince = r.Header.Get("If-Modified-Since")
+	c.ranges = r.Header.Get("Range")
+	c.ifRange = r.Header.Get("If-Range")
+	return c
+}
+
+// weak comparison: two entity tags are equivalent if their opaque-tags
+// match character-by-character, regardless of either or both being
+// tagged as "weak"
+func weakMatch(a string, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// evaluates the client conditions against a cached response
+// (RFC 9110 section 13.2.2). If-Modified-Since is ignored when
+// If-None-Match is present
+func (c conditions) notModified(header http.Header) bool {
+	if c.ifNoneMatch != "" {
+		etag := header.Get("ETag")
+		for _, tag := range strings.Split(c.ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || (etag != "" && weakMatch(tag, etag)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if c.ifModifiedSince != "" {
+		ims, err := http.ParseTime(c.ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !lastModified.After(ims)
+	}
+	return false
+}
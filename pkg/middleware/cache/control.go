@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+)
+
+// status codes that are cacheable by default (RFC 9110 section 15.1).
+// Responses with other status codes are stored only if they carry
+// explicit freshness information
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 206: true,
+	300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true,
+	501: true,
+}
+
+// parsed Cache-Control header. Directive names are lower case.
+// Directives without an argument map to an empty string
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// returns the directive value expressed in delta-seconds
+func (cc cacheControl) duration(directive string) (time.Duration, bool) {
+	val, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// computes the freshness lifetime of a response. The returned bool is false
+// if the response doesn't carry explicit freshness information
+func freshnessLifetime(header http.Header, cc cacheControl) (time.Duration, bool) {
+	// this is a shared cache: s-maxage wins over max-age
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d, true
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid dates represent a time in the past
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return exp.Sub(date), true
+	}
+	return 0, false
+}
+
+// returns the initial age of a response (the Age header sent
+// by the upstream)
+func initialAge(header http.Header) time.Duration {
+	age, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+	return time.Duration(age) * time.Second
+}
+
+// returns true if the request carries credentials or was authorized by
+// the auth middlewares (an oidc session or a stripped bearer token)
+func authenticated(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" ||
+		chaincontext.GetChainContext(r).Auth.Authorized
+}
+
+// Decides if a response can be stored following the RFC 9111 rules
+// for shared caches and returns its freshness lifetime. A zero lifetime
+// means that the response needs to be revalidated before each use.
+// The fallback lifetime is used when the upstream doesn't send
+// explicit freshness information. The authenticated flag is computed by
+// the caller: the auth middlewares can remove the Authorization header
+// before the cache runs
+func storable(r *http.Request, authenticated bool, status int, header http.Header, fallback time.Duration) (time.Duration, bool) {
+	reqCC := parseCacheControl(r.Header)
+	if reqCC.has("no-store") {
+		return 0, false
+	}
+
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return 0, false
+	}
+	// responses setting cookies are never shared
+	if header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	// responses to authenticated requests can be stored only if
+	// explicitly allowed
+	if authenticated &&
+		!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return 0, false
+	}
+	for _, v := range header.Values("Vary") {
+		if strings.TrimSpace(v) == "*" {
+			return 0, false
+		}
+	}
+
+	lifetime, explicit := freshnessLifetime(header, cc)
+	if !explicit {
+		if !heuristicallyCacheable[status] {
+			return 0, false
+		}
+		lifetime = fallback
+	}
+	// no-cache responses need to be revalidated on each use
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+	if lifetime <= 0 {
+		// a response that is already stale is useful only
+		// if it can be revalidated
+		if !hasValidators(header) {
+			return 0, false
+		}
+		lifetime = 0
+	}
+	return lifetime, true
+}
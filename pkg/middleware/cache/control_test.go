@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	h := http.Header{}
+	h.Add("Cache-Control", `Max-Age=60, no-cache="Set-Cookie"`)
+	h.Add("Cache-Control", "public")
+
+	cc := parseCacheControl(h)
+	if d, ok := cc.duration("max-age"); !ok || d != time.Minute {
+		t.Fatal("max-age=60 expected")
+	}
+	if cc["no-cache"] != "Set-Cookie" {
+		t.Fatal("no-cache=Set-Cookie expected")
+	}
+	if !cc.has("public") {
+		t.Fatal("public expected")
+	}
+	if _, ok := cc.duration("public"); ok {
+		t.Fatal("public has no value")
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		header   http.Header
+		lifetime time.Duration
+		explicit bool
+	}{
+		{http.Header{"Cache-Control": {"max-age=10, s-maxage=20"}}, 20 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=10"}}, 10 * time.Second, true},
+		{http.Header{
+			"Date":    {now.UTC().Format(http.TimeFormat)},
+			"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)},
+		}, time.Hour, true},
+		{http.Header{"Expires": {"0"}}, 0, true},
+		{http.Header{}, 0, false},
+	}
+
+	for idx, test := range tests {
+		lifetime, explicit := freshnessLifetime(test.header, parseCacheControl(test.header))
+		if explicit != test.explicit {
+			t.Fatalf("%d: expected explicit=%v", idx, test.explicit)
+		}
+		if lifetime != test.lifetime {
+			t.Fatalf("%d: expected %s, got %s", idx, test.lifetime, lifetime)
+		}
+	}
+}
+
+func TestStorableAuthorization(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	cc := chaincontext.NewChainContext()
+	cc.Reset(&conf.MountPoint{Path: "/"}, r)
+	r = cc.Update()
+	if authenticated(r) {
+		t.Fatal("the request is anonymous")
+	}
+	// an oidc session, or a bearer token stripped by the identity
+	// middleware
+	cc.Auth.Authorized = true
+	r = cc.Update()
+	if !authenticated(r) {
+		t.Fatal("the authorized requests are authenticated")
+	}
+
+	if _, ok := storable(r, true, 200, http.Header{}, time.Minute); ok {
+		t.Fatal("authorized responses should not be stored by default")
+	}
+	h := http.Header{"Cache-Control": {"public"}}
+	if ttl, ok := storable(r, true, 200, h, time.Minute); !ok || ttl != time.Minute {
+		t.Fatal("public authorized responses should be stored")
+	}
+	if _, ok := storable(r, true, 500, http.Header{}, time.Minute); ok {
+		t.Fatal("500 is not heuristically cacheable")
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {lastModified.Format(http.TimeFormat)},
+	}
+
+	tests := []struct {
+		cond        conditions
+		notModified bool
+	}{
+		{conditions{ifNoneMatch: `"v1"`}, true},
+		{conditions{ifNoneMatch: `"v0", W/"v1"`}, true},
+		{conditions{ifNoneMatch: `*`}, true},
+		{conditions{ifNoneMatch: `"v2"`}, false},
+		// If-Modified-Since is ignored if If-None-Match is present
+		{conditions{
+			ifNoneMatch:     `"v2"`,
+			ifModifiedSince: lastModified.Format(http.TimeFormat),
+		}, false},
+		{conditions{ifModifiedSince: lastModified.Format(http.TimeFormat)}, true},
+		{conditions{ifModifiedSince: lastModified.Add(-time.Hour).Format(http.TimeFormat)}, false},
+		{conditions{}, false},
+	}
+	for idx, test := range tests {
+		if test.cond.notModified(h) != test.notModified {
+			t.Fatalf("%d: expected %v", idx, test.notModified)
+		}
+	}
+}
+
+func TestStaleWindows(t *testing.T) {
+	c := conf.Cache{
+		KeepStale:            time.Second,
+		StaleWhileRevalidate: time.Minute,
+	}
+	h := http.Header{"Cache-Control": {"max-age=10, stale-if-error=120"}}
+
+	swr, sie := staleWindows(h, c)
+	if swr != time.Minute || sie != 2*time.Minute {
+		t.Fatalf("unexpected windows %s %s", swr, sie)
+	}
+	if staleRetention(h, c) != 2*time.Minute {
+		t.Fatal("the retention should cover the stale windows")
+	}
+	if staleRetention(http.Header{}, conf.Cache{KeepStale: time.Second}) != time.Second {
+		t.Fatal("expected the keepStale retention")
+	}
+}
@@ -0,0 +1,417 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/store"
+	"github.com/ferama/crauti/pkg/utils"
+	"github.com/klauspost/compress/zstd"
+)
+
+// An entry is stored as a single record, so readers never see a
+// partially written one. Body chunks are written before the record and
+// their keys are unique to each write. The record format is
+//
+//	version (1 byte) | flags (1 byte) | payload
+//
+// and the payload, zstd compressed if flagZstd is set, is
+//
+//	header length (4 bytes, big endian) | header (json) | body
+const (
+	recordVersion byte = 1
+
+	flagZstd byte = 1 << 0
+)
+
+var errInvalidRecord = errors.New("invalid cache entry record")
+
+var (
+	// both are safe for concurrent use with EncodeAll/DecodeAll
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type recordHeader struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Meta   entryMeta   `json:"meta"`
+}
+
+// a cached response
+type entry struct {
+	Status int
+	Header http.Header
+	// the first chunk only if the entry is stored in chunks
+	Body []byte
+
+	// entry metadata
+	meta entryMeta
+	// store keys of the remaining body chunks
+	chunks []string
+}
+
+type entryMeta struct {
+	// when the response was stored
+	StoredAt time.Time `json:"storedAt"`
+	// age of the response when it was stored (Age header sent
+	// from the upstream)
+	InitialAge time.Duration `json:"initialAge"`
+	// freshness lifetime
+	TTL time.Duration `json:"ttl"`
+	// validators of the stored response
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// how long the entry is kept into the store after its expiration
+	Retention time.Duration `json:"retention"`
+	// large bodies are split in chunks. The first one is stored with
+	// the entry record, the others using their own keys
+	Chunks  int    `json:"chunks,omitempty"`
+	ChunkID string `json:"chunkID,omitempty"`
+	// the body size
+	Size int64 `json:"size,omitempty"`
+
+	// the request uri and the mount point path and host of the cached
+	// response. Used to index the entry for purges
+	URL        string `json:"url,omitempty"`
+	MountPoint string `json:"mountPoint,omitempty"`
+	MatchHost  string `json:"matchHost,omitempty"`
+}
+
+// current age of the entry
+func (e *entry) age() time.Duration {
+	return e.meta.InitialAge + time.Since(e.meta.StoredAt)
+}
+
+// remaining freshness. Negative values means that the entry is stale
+func (e *entry) freshness() time.Duration {
+	return e.meta.TTL - e.age()
+}
+
+// returns the list of the request headers names a response varies on.
+// The bool is false if the response varies on something that can't be
+// matched (Vary: *)
+func varyHeaders(header http.Header) ([]string, bool) {
+	names := []string{}
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// builds the cache key of a response that varies on the given request headers
+func varyKey(key string, names []string, r *http.Request) string {
+	for _, name := range names {
+		key = fmt.Sprintf("%s|%s=%s", key, name, strings.Join(r.Header.Values(name), ","))
+	}
+	return key
+}
+
+// returns the key of the cached response that matches the request. If the
+// stored response varies on some request headers, the returned key includes
+// their values
+func resolveKey(key string, r *http.Request) string {
+	vary, err := store.Instance().Get(buildStoreKey(varyKeyHead, key))
+	if err != nil || len(vary) == 0 {
+		return key
+	}
+	return varyKey(key, strings.Split(string(vary), ","), r)
+}
+
+// returns the min body size of a compressed entry.
+// A negative value disables the compression
+func compressionThreshold() int64 {
+	c := conf.ConfInst.CacheStore.Compression
+	if !c.Enabled {
+		return -1
+	}
+	minSize, err := utils.ConvertToBytes(c.MinSize)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to parse the compression minSize")
+		return -1
+	}
+	return minSize
+}
+
+func encodeEntry(e *entry, threshold int64) ([]byte, error) {
+	header, err := json.Marshal(recordHeader{
+		Status: e.Status,
+		Header: e.Header,
+		Meta:   e.meta,
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, 4, 4+len(header)+len(e.Body))
+	binary.BigEndian.PutUint32(payload, uint32(len(header)))
+	payload = append(payload, header...)
+	payload = append(payload, e.Body...)
+
+	flags := byte(0)
+	if threshold >= 0 && int64(len(e.Body)) >= threshold {
+		flags |= flagZstd
+		payload = zstdEncoder.EncodeAll(payload, nil)
+	}
+	return append([]byte{recordVersion, flags}, payload...), nil
+}
+
+func decodeEntry(raw []byte) (*entry, error) {
+	if len(raw) < 2 || raw[0] != recordVersion {
+		return nil, errInvalidRecord
+	}
+	flags := raw[1]
+	payload := raw[2:]
+	if flags&flagZstd != 0 {
+		var err error
+		payload, err = zstdDecoder.DecodeAll(payload, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(payload) < 4 {
+		return nil, errInvalidRecord
+	}
+	headerLen := int(binary.BigEndian.Uint32(payload))
+	if len(payload) < 4+headerLen {
+		return nil, errInvalidRecord
+	}
+	rh := recordHeader{}
+	if err := json.Unmarshal(payload[4:4+headerLen], &rh); err != nil {
+		return nil, err
+	}
+	if rh.Header == nil {
+		rh.Header = http.Header{}
+	}
+	return &entry{
+		Status: rh.Status,
+		Header: rh.Header,
+		Body:   payload[4+headerLen:],
+		meta:   rh.Meta,
+	}, nil
+}
+
+// returns the min size of a chunked body.
+// A value lesser or equal to 0 disables chunking
+func chunkSize() int64 {
+	size, err := utils.ConvertToBytes(conf.ConfInst.CacheStore.ChunkSize)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+func chunkKey(key string, chunkID string, idx int) string {
+	return buildStoreKey(chunkKeyHead, fmt.Sprintf("%s:%d:%s", chunkID, idx, key))
+}
+
+// chunks are stored as
+//
+//	flags (1 byte) | data
+func encodeChunk(data []byte, threshold int64) []byte {
+	if threshold >= 0 && int64(len(data)) >= threshold {
+		return append([]byte{flagZstd}, zstdEncoder.EncodeAll(data, nil)...)
+	}
+	return append([]byte{0}, data...)
+}
+
+func loadChunk(key string) ([]byte, error) {
+	raw, err := store.Instance().Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 1 {
+		return nil, errInvalidRecord
+	}
+	if raw[0]&flagZstd != 0 {
+		return zstdDecoder.DecodeAll(raw[1:], nil)
+	}
+	return raw[1:], nil
+}
+
+// loads the remaining chunks of a chunked entry into its body
+func (e *entry) loadBody() error {
+	if len(e.chunks) == 0 {
+		return nil
+	}
+	body := append([]byte(nil), e.Body...)
+	for _, key := range e.chunks {
+		chunk, err := loadChunk(key)
+		if err != nil {
+			return err
+		}
+		body = append(body, chunk...)
+	}
+	e.Body = body
+	e.chunks = nil
+	return nil
+}
+
+// loads the entry stored with the key. The legacy entries are migrated
+// to the current format if migrate is true. Only the serving path
+// migrates: the read only ones (inspection, purges) don't write
+func loadEntry(key string, migrate bool) (*entry, bool) {
+	raw, err := store.Instance().Get(buildStoreKey(entryKeyHead, key))
+	if err != nil {
+		return loadLegacyEntry(key, migrate)
+	}
+	e, err := decodeEntry(raw)
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Msg("unable to decode the cache entry")
+		return nil, false
+	}
+	for idx := 1; idx < e.meta.Chunks; idx++ {
+		e.chunks = append(e.chunks, chunkKey(key, e.meta.ChunkID, idx))
+	}
+	return e, true
+}
+
+// loads an entry stored using the legacy format. Entries with metadata
+// can be migrated to the current format
+func loadLegacyEntry(key string, migrate bool) (*entry, bool) {
+	body, err := store.Instance().Get(buildStoreKey(bodyKeyHead, key))
+	if err != nil {
+		return nil, false
+	}
+	e := &entry{
+		Status: http.StatusOK,
+		Header: http.Header{},
+		Body:   body,
+	}
+
+	// the headers are stored as "Name: value" lines separated by CRLF,
+	// without the blank line ending a header block
+	headers, _ := store.Instance().Get(buildStoreKey(headersKeyHead, key))
+	if len(headers) > 0 {
+		reader := bufio.NewReader(strings.NewReader(string(headers) + "\r\n\r\n"))
+		mimeHeader, err := textproto.NewReader(reader).ReadMIMEHeader()
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Msg("unable to parse the legacy cache entry headers")
+			return nil, false
+		}
+		e.Header = http.Header(mimeHeader)
+	}
+
+	status, _ := store.Instance().Get(buildStoreKey(statusKeyHead, key))
+	if s, err := strconv.Atoi(string(status)); err == nil {
+		e.Status = s
+	}
+
+	meta, err := store.Instance().Get(buildStoreKey(metaKeyHead, key))
+	if err != nil || json.Unmarshal(meta, &e.meta) != nil {
+		// entries without metadata can't be migrated. They are
+		// fresh until the store expires them
+		e.meta = entryMeta{
+			StoredAt: time.Now(),
+			TTL:      math.MaxInt64,
+		}
+		return e, true
+	}
+	if !migrate {
+		return e, true
+	}
+
+	log.Debug().Str("key", key).Msg("migrating legacy cache entry")
+	storeEntry(key, e, e.meta.Retention)
+	deleteLegacyEntry(key)
+	return e, true
+}
+
+func legacyEntryKeys(key string) []string {
+	return []string{
+		buildStoreKey(bodyKeyHead, key),
+		buildStoreKey(headersKeyHead, key),
+		buildStoreKey(statusKeyHead, key),
+		buildStoreKey(metaKeyHead, key),
+	}
+}
+
+func deleteLegacyEntry(key string) error {
+	_, err := store.Instance().Del(legacyEntryKeys(key)...)
+	return err
+}
+
+// stores the entry. The entry will be kept into the store for its freshness
+// lifetime plus the retention time
+func storeEntry(key string, e *entry, retention time.Duration) {
+	e.meta.Retention = retention
+	e.meta.ETag = e.Header.Get("ETag")
+	e.meta.LastModified = e.Header.Get("Last-Modified")
+
+	ttl := time.Until(e.meta.StoredAt.Add(e.meta.TTL + retention))
+	if ttl <= 0 {
+		return
+	}
+
+	// store all the headers sent from backend to send them back
+	// to the client when the request hit the cache
+	header := e.Header.Clone()
+	header.Del(GeneratorHeaderKey)
+	header.Del(CacheKeyHeaderKey)
+	threshold := compressionThreshold()
+
+	body := e.Body
+	meta := e.meta
+	meta.Size = int64(len(body))
+	meta.Chunks = 0
+	meta.ChunkID = ""
+	if size := chunkSize(); size > 0 && int64(len(body)) > size {
+		id := make([]byte, 8)
+		rand.Read(id)
+		meta.ChunkID = hex.EncodeToString(id)
+		meta.Chunks = int((int64(len(body)) + size - 1) / size)
+
+		for idx := 1; idx < meta.Chunks; idx++ {
+			end := int64(idx+1) * size
+			if end > int64(len(body)) {
+				end = int64(len(body))
+			}
+			chunk := encodeChunk(body[int64(idx)*size:end], threshold)
+			if err := store.Instance().Set(chunkKey(key, meta.ChunkID, idx), chunk, ttl); err != nil {
+				log.Error().Err(err).Str("key", key).Msg("unable to store the cache entry chunk")
+				return
+			}
+		}
+		body = body[:size]
+	}
+
+	raw, err := encodeEntry(&entry{
+		Status: e.Status,
+		Header: header,
+		Body:   body,
+		meta:   meta,
+	}, threshold)
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Msg("unable to encode the cache entry")
+		return
+	}
+
+	if err := store.Instance().Set(buildStoreKey(entryKeyHead, key), raw, ttl); err != nil {
+		log.Error().Err(err).Str("key", key).Msg("unable to store the cache entry")
+		return
+	}
+	indexEntry(key, e, ttl)
+}
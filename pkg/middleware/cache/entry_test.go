@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/store"
+)
+
+func TestEntryRecord(t *testing.T) {
+	e := &entry{
+		Status: http.StatusCreated,
+		Header: http.Header{
+			"Set-Cookie":   {"a=1", "b=2"},
+			"Content-Type": {"text/plain"},
+		},
+		Body: bytes.Repeat([]byte("crauti"), 100),
+		meta: entryMeta{
+			StoredAt: time.Now().Truncate(time.Second),
+			TTL:      time.Minute,
+			ETag:     `"v1"`,
+		},
+	}
+
+	for _, threshold := range []int64{-1, 0, 1024} {
+		raw, err := encodeEntry(e, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed := raw[1]&flagZstd != 0
+		if compressed != (threshold == 0) {
+			t.Fatalf("threshold %d: unexpected compressed=%v", threshold, compressed)
+		}
+
+		d, err := decodeEntry(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Status != e.Status || !bytes.Equal(d.Body, e.Body) {
+			t.Fatalf("threshold %d: status or body mismatch", threshold)
+		}
+		if len(d.Header.Values("Set-Cookie")) != 2 {
+			t.Fatalf("threshold %d: multi value headers expected", threshold)
+		}
+		if !d.meta.StoredAt.Equal(e.meta.StoredAt) || d.meta.ETag != e.meta.ETag {
+			t.Fatalf("threshold %d: meta mismatch", threshold)
+		}
+	}
+
+	if _, err := decodeEntry([]byte{99, 0}); err != errInvalidRecord {
+		t.Fatal("unknown versions should be refused")
+	}
+}
+
+// the records written by the legacy format: the headers are joined by
+// CRLF, each one with its values joined by commas
+func setLegacyEntry(key string, meta []byte) {
+	s := store.Instance()
+	s.Set(buildStoreKey(headersKeyHead, key), []byte("Content-Type: text/plain\r\nCache-Control: public, max-age=60"), time.Minute)
+	s.Set(buildStoreKey(statusKeyHead, key), []byte("404"), time.Minute)
+	if meta != nil {
+		s.Set(buildStoreKey(metaKeyHead, key), meta, time.Minute)
+	}
+	s.Set(buildStoreKey(bodyKeyHead, key), []byte("legacy"), time.Minute)
+}
+
+func TestLegacyEntryMigration(t *testing.T) {
+	key := "GET/legacy"
+	meta, _ := json.Marshal(entryMeta{
+		StoredAt: time.Now(),
+		TTL:      time.Minute,
+	})
+	setLegacyEntry(key, meta)
+	s := store.Instance()
+
+	for _, migrate := range []bool{false, true} {
+		e, ok := loadEntry(key, migrate)
+		if !ok || e.Status != 404 || string(e.Body) != "legacy" {
+			t.Fatal("expected the legacy entry")
+		}
+		if e.Header.Get("Content-Type") != "text/plain" || e.Header.Get("Cache-Control") != "public, max-age=60" {
+			t.Fatalf("unexpected legacy headers %v", e.Header)
+		}
+		_, err := s.Get(buildStoreKey(entryKeyHead, key))
+		if !migrate && err != store.ErrNotFound {
+			t.Fatal("the read only loads should not migrate the entry")
+		}
+	}
+
+	if _, err := s.Get(buildStoreKey(bodyKeyHead, key)); err != store.ErrNotFound {
+		t.Fatal("the legacy entry should be removed")
+	}
+	raw, err := s.Get(buildStoreKey(entryKeyHead, key))
+	if err != nil {
+		t.Fatal("the entry should be migrated")
+	}
+	if e, _ := decodeEntry(raw); e == nil || string(e.Body) != "legacy" || e.Header.Get("Content-Type") != "text/plain" {
+		t.Fatal("unexpected migrated entry")
+	}
+
+	// the entries without metadata are served as they are
+	key = "GET/legacy-nometa"
+	setLegacyEntry(key, nil)
+	e, ok := loadEntry(key, true)
+	if !ok || e.Header.Get("Content-Type") != "text/plain" || e.freshness() <= 0 {
+		t.Fatal("expected the legacy entry")
+	}
+	if _, err := s.Get(buildStoreKey(entryKeyHead, key)); err != store.ErrNotFound {
+		t.Fatal("the entries without metadata can't be migrated")
+	}
+}
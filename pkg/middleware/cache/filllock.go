@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/redis"
+)
+
+// how often the replicas waiting for a fill look for the entry
+const lockPollInterval = 50 * time.Millisecond
+
+// A lock shared by all the gateway replicas. It coordinates the cache
+// fills: only the lock holder pokes the upstream
+type fillLocker interface {
+	// on success returns a fencing token
+	AcquireLock(key string, lease time.Duration) (int64, bool, error)
+	ReleaseLock(key string, token int64) error
+	HoldsLock(key string, token int64) (bool, error)
+	LockExists(key string) (bool, error)
+}
+
+// the fill locks live into redis, whatever is the cache store backend
+var fillLocks = func() fillLocker {
+	return redis.CacheInstance()
+}
+
+// an acquired fill lock. A nil lock means that the fill
+// is not coordinated
+type fillLock struct {
+	key   string
+	token int64
+}
+
+// checks that the lease is not expired. If it is, another replica
+// could be filling the entry
+func (l *fillLock) held() bool {
+	if l == nil {
+		return true
+	}
+	held, err := fillLocks().HoldsLock(l.key, l.token)
+	if err != nil {
+		// we can't tell. Nobody else could acquire the lock anyway
+		log.Error().Err(err).Str("key", l.key).Msg("unable to check the fill lock")
+		return true
+	}
+	return held
+}
+
+func (l *fillLock) release() {
+	if l == nil {
+		return
+	}
+	if err := fillLocks().ReleaseLock(l.key, l.token); err != nil {
+		log.Error().Err(err).Str("key", l.key).Msg("unable to release the fill lock")
+	}
+}
+
+// coordinates the cache fill with the other replicas. Returns true if the
+// request was served using an entry filled by another replica. Otherwise
+// the caller needs to poke the upstream and to release the returned lock.
+// If the lock can't be acquired in time or redis is unavailable, the
+// returned lock is nil and the fill is not coordinated
+func (m *CacheMiddleware) distributedFill(cacheKey string, w http.ResponseWriter, r *http.Request) (*fillLock, bool) {
+	ctx := chaincontext.GetChainContext(r)
+	c := ctx.Conf.Middlewares.Cache
+
+	key := buildStoreKey(fillLockKeyHead, cacheKey)
+	deadline := time.Now().Add(c.LockWait)
+
+	for {
+		token, ok, err := fillLocks().AcquireLock(key, c.LockLease)
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Msg("unable to acquire the fill lock")
+			return nil, false
+		}
+		if ok {
+			return &fillLock{key: key, token: token}, false
+		}
+
+		// another replica is filling the entry. Wait for it. If the
+		// holder goes away without storing the entry, try to take over
+		for held := true; held; {
+			select {
+			case <-r.Context().Done():
+				return nil, false
+			case <-time.After(lockPollInterval):
+			}
+
+			e, k := m.lookup(cacheKey, r)
+			if m.serveFromCache(e, k, w, r) {
+				return nil, true
+			}
+			if time.Now().After(deadline) {
+				log.Debug().
+					Str("key", key).
+					Msg("fill lock wait timeout")
+				return nil, false
+			}
+			held, err = fillLocks().LockExists(key)
+			if err != nil {
+				return nil, false
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+// an in process fillLocker shared by the test "replicas"
+type memoryLocker struct {
+	mu     sync.Mutex
+	fence  int64
+	locks  map[string]int64
+	leases map[string]time.Time
+}
+
+func newMemoryLocker() *memoryLocker {
+	return &memoryLocker{
+		locks:  make(map[string]int64),
+		leases: make(map[string]time.Time),
+	}
+}
+
+func (l *memoryLocker) expire(key string) {
+	if time.Now().After(l.leases[key]) {
+		delete(l.locks, key)
+		delete(l.leases, key)
+	}
+}
+
+func (l *memoryLocker) AcquireLock(key string, lease time.Duration) (int64, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(key)
+	if _, ok := l.locks[key]; ok {
+		return 0, false, nil
+	}
+	l.fence++
+	l.locks[key] = l.fence
+	l.leases[key] = time.Now().Add(lease)
+	return l.fence, true, nil
+}
+
+func (l *memoryLocker) ReleaseLock(key string, token int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks[key] == token {
+		delete(l.locks, key)
+		delete(l.leases, key)
+	}
+	return nil
+}
+
+func (l *memoryLocker) HoldsLock(key string, token int64) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(key)
+	return l.locks[key] == token, nil
+}
+
+func (l *memoryLocker) LockExists(key string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(key)
+	_, ok := l.locks[key]
+	return ok, nil
+}
+
+func useMemoryLocker(t *testing.T) *memoryLocker {
+	locker := newMemoryLocker()
+	prev := fillLocks
+	fillLocks = func() fillLocker { return locker }
+	t.Cleanup(func() { fillLocks = prev })
+	return locker
+}
+
+func distributedLockConf() conf.Cache {
+	enabled := true
+	return conf.Cache{
+		Enabled:         &enabled,
+		TTL:             time.Minute,
+		Methods:         []string{http.MethodGet},
+		DistributedLock: &enabled,
+		LockLease:       5 * time.Second,
+		LockWait:        3 * time.Second,
+	}
+}
+
+func TestDistributedFill(t *testing.T) {
+	useMemoryLocker(t)
+
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("done"))
+		},
+	}
+	// two replicas sharing the store
+	replicas := []string{}
+	for i := 0; i < 2; i++ {
+		s := buildServer(distributedLockConf(), u)
+		defer s.Close()
+		replicas = append(replicas, s.URL+"/coalesce")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			if _, body := getBody(t, url); body != "done" {
+				t.Errorf("unexpected body '%s'", body)
+			}
+		}(replicas[i%2])
+	}
+	wg.Wait()
+
+	if u.calls.Load() != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", u.calls.Load())
+	}
+}
+
+func TestDistributedFillHolderDies(t *testing.T) {
+	locker := useMemoryLocker(t)
+
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("done"))
+		},
+	}
+	s := buildServer(distributedLockConf(), u)
+	defer s.Close()
+
+	// a replica acquired the lock and died
+	lease := 300 * time.Millisecond
+	locker.AcquireLock(buildStoreKey(fillLockKeyHead, "GET/dead-holder"), lease)
+
+	start := time.Now()
+	if _, body := getBody(t, s.URL+"/dead-holder"); body != "done" {
+		t.Fatalf("unexpected body '%s'", body)
+	}
+	if time.Since(start) < lease {
+		t.Fatal("expected to wait for the lease expiration")
+	}
+	if u.calls.Load() != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", u.calls.Load())
+	}
+}
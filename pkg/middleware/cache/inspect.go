@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ferama/crauti/pkg/store"
+)
+
+// EntryInfo describes a cached entry
+type EntryInfo struct {
+	Key      string      `json:"key"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header,omitempty"`
+	Size     int64       `json:"size"`
+	StoredAt time.Time   `json:"storedAt"`
+	// seconds
+	Age float64 `json:"age"`
+	// remaining freshness in seconds. Negative for stale entries
+	TTL        float64  `json:"ttl"`
+	Tags       []string `json:"tags,omitempty"`
+	URL        string   `json:"url,omitempty"`
+	MountPoint string   `json:"mountPoint,omitempty"`
+	MatchHost  string   `json:"matchHost,omitempty"`
+	Chunks     int      `json:"chunks,omitempty"`
+}
+
+func newEntryInfo(key string, e *entry, withHeader bool) EntryInfo {
+	size := e.meta.Size
+	if size == 0 {
+		size = int64(len(e.Body))
+	}
+	info := EntryInfo{
+		Key:        key,
+		Status:     e.Status,
+		Size:       size,
+		StoredAt:   e.meta.StoredAt,
+		Age:        e.age().Seconds(),
+		TTL:        e.freshness().Seconds(),
+		URL:        e.meta.URL,
+		MountPoint: e.meta.MountPoint,
+		MatchHost:  e.meta.MatchHost,
+		Chunks:     e.meta.Chunks,
+	}
+	info.Tags = responseTags(e.Header)
+	if withHeader {
+		info.Header = e.Header
+	}
+	return info
+}
+
+// Inspect returns the metadata of the entry stored with key
+func Inspect(key string) (EntryInfo, bool) {
+	e, ok := loadEntry(key, false)
+	if !ok {
+		return EntryInfo{}, false
+	}
+	return newEntryInfo(key, e, true), true
+}
+
+// Delete removes the entry stored with key
+func Delete(key string) error {
+	_, err := hardPurge(key)
+	return err
+}
+
+// the max number of entries ListEntries returns
+const maxListLimit = 1000
+
+// the max number of entries Stats loads to compute the size
+var statsSampleSize = 1000
+
+// ListEntries returns a page of the entries of the mount point matching
+// matchHost (empty for any host) and path, ordered by expiration. The
+// limit is capped to 1000 entries. The total is the number of the not
+// expired index members: it may count some purged entries that are not
+// returned
+func ListEntries(matchHost string, mountPoint string, offset int, limit int) ([]EntryInfo, int, error) {
+	index := mountIndexKey(matchHost, mountPoint)
+	total, err := store.Instance().ZCard(index)
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 || limit > maxListLimit {
+		limit = maxListLimit
+	}
+	keys, err := store.Instance().ZRange(index, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := []EntryInfo{}
+	for _, key := range keys {
+		if e, ok := loadEntry(key, false); ok {
+			entries = append(entries, newEntryInfo(key, e, false))
+		}
+	}
+	return entries, total, nil
+}
+
+// MountPointStats are the cache stats of a mount point
+type MountPointStats struct {
+	Entries int
+	// the body size of the entries. If Estimated is true it is
+	// extrapolated from a sample of them
+	Bytes     int64
+	Estimated bool
+}
+
+// Stats returns the number of the entries of the mount point matching
+// matchHost (empty for any host) and path, and their body size. At most
+// 1000 entries are loaded: the size of the larger mount points is
+// estimated from them
+func Stats(matchHost string, mountPoint string) (MountPointStats, error) {
+	index := mountIndexKey(matchHost, mountPoint)
+	stats := MountPointStats{}
+	count, err := store.Instance().ZCard(index)
+	if err != nil {
+		return stats, err
+	}
+	keys, err := store.Instance().ZRange(index, 0, statsSampleSize)
+	if err != nil {
+		return stats, err
+	}
+
+	sampled := 0
+	for _, key := range keys {
+		if e, ok := loadEntry(key, false); ok {
+			sampled++
+			stats.Bytes += newEntryInfo(key, e, false).Size
+		}
+	}
+	stats.Entries = count
+	if count <= len(keys) {
+		// the whole index was loaded: skip the purged entries
+		stats.Entries = sampled
+	} else if sampled > 0 {
+		stats.Bytes = stats.Bytes * int64(count) / int64(sampled)
+		stats.Estimated = true
+	}
+	return stats, nil
+}
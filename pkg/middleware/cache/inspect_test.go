@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+func TestInspect(t *testing.T) {
+	u := &upstream{
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(CacheTagHeaderKey, "inspect")
+			w.Write([]byte("done"))
+		},
+	}
+	enabled := true
+	s := buildServer(conf.Cache{
+		Enabled: &enabled,
+		TTL:     time.Minute,
+		Methods: []string{http.MethodGet},
+	}, u)
+	defer s.Close()
+
+	get(t, s.URL+"/inspect", nil)
+
+	// the mount point is shared with the other tests
+	entries, total, err := ListEntries("", "/", 0, 0)
+	if err != nil || total < len(entries) {
+		t.Fatalf("unexpected listing %d %d %v", len(entries), total, err)
+	}
+	key := ""
+	for _, e := range entries {
+		if e.URL == "/inspect" {
+			key = e.Key
+		}
+	}
+	if key == "" {
+		t.Fatal("the entry should be listed")
+	}
+	if page, _, _ := ListEntries("", "/", total, 10); len(page) != 0 {
+		t.Fatal("expected an empty page")
+	}
+
+	info, ok := Inspect(key)
+	if !ok {
+		t.Fatal("the entry should exist")
+	}
+	if info.Status != http.StatusOK || info.Size != 4 || info.MountPoint != "/" {
+		t.Fatalf("unexpected entry %+v", info)
+	}
+	if info.TTL <= 0 || info.TTL > 60 || len(info.Tags) != 1 || info.Tags[0] != "inspect" {
+		t.Fatalf("unexpected entry %+v", info)
+	}
+
+	stats, err := Stats("", "/")
+	if err != nil || stats.Entries < 1 || stats.Bytes < 4 {
+		t.Fatalf("unexpected stats %+v %v", stats, err)
+	}
+
+	if err := Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Inspect(key); ok {
+		t.Fatal("the entry should be deleted")
+	}
+}
+
+func TestMountPointHosts(t *testing.T) {
+	for i, host := range []string{"a.example", "b.example", "b.example"} {
+		storeEntry(fmt.Sprintf("GET%s/shared/%d", host, i), &entry{
+			Status: http.StatusOK,
+			Header: http.Header{},
+			Body:   []byte("body"),
+			meta: entryMeta{
+				StoredAt:   time.Now(),
+				TTL:        time.Minute,
+				URL:        "/shared",
+				MountPoint: "/shared",
+				MatchHost:  host,
+			},
+		}, 0)
+	}
+
+	// the mount points share the path but not the index
+	if entries, total, _ := ListEntries("a.example", "/shared", 0, 0); total != 1 || len(entries) != 1 {
+		t.Fatalf("unexpected listing %d %d", len(entries), total)
+	}
+	if stats, _ := Stats("b.example", "/shared"); stats.Entries != 2 || stats.Bytes != 8 || stats.Estimated {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the size of the larger mount points is estimated from a sample
+	defer func(size int) { statsSampleSize = size }(statsSampleSize)
+	statsSampleSize = 1
+	if stats, _ := Stats("b.example", "/shared"); stats.Entries != 2 || stats.Bytes != 8 || !stats.Estimated {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if purged, _ := PurgeMountPoint("a.example", "/shared", false); purged != 1 {
+		t.Fatalf("expected 1 purged entry, got %d", purged)
+	}
+	if stats, _ := Stats("b.example", "/shared"); stats.Entries != 2 {
+		t.Fatalf("the other mount point should be kept, got %+v", stats)
+	}
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+// tracks the invalidations running in background
+var invalidations sync.WaitGroup
+
+// wraps the response writer of the unsafe requests to record the
+// response status. The cached responses are invalidated once the upstream
+// response is forwarded, so the client is not delayed by the purges
+type invalidationWriter struct {
+	w http.ResponseWriter
+	r *http.Request
+
+	conf       conf.CacheInvalidation
+	mountPoint string
+	matchHost  string
+	// the final status. 0 until it is written
+	statusCode int
+}
+
+func (iw *invalidationWriter) Header() http.Header {
+	return iw.w.Header()
+}
+
+func (iw *invalidationWriter) WriteHeader(statusCode int) {
+	// skip the informational responses
+	if iw.statusCode == 0 && statusCode >= http.StatusOK {
+		iw.statusCode = statusCode
+	}
+	iw.w.WriteHeader(statusCode)
+}
+
+// runs the invalidation in background if the request succeeded. To be
+// called once the response is forwarded
+func (iw *invalidationWriter) done() {
+	if iw.statusCode == 0 {
+		// nothing was written: the server replies 200
+		iw.statusCode = http.StatusOK
+	}
+	if iw.statusCode >= http.StatusBadRequest {
+		return
+	}
+	paths := invalidatedPaths(iw.r, iw.w.Header(), iw.conf)
+	method := iw.r.Method
+	c := iw.conf
+	matchHost, mountPoint := iw.matchHost, iw.mountPoint
+
+	invalidations.Add(1)
+	go func() {
+		defer invalidations.Done()
+		invalidate(method, paths, c, matchHost, mountPoint)
+	}()
+}
+
+func (iw *invalidationWriter) Write(data []byte) (int, error) {
+	if iw.statusCode == 0 {
+		iw.WriteHeader(http.StatusOK)
+	}
+	return iw.w.Write(data)
+}
+
+func (iw *invalidationWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := iw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	return h.Hijack()
+}
+
+func (iw *invalidationWriter) Flush() {
+	if f, ok := iw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// allows the http.ResponseController to reach the underlying
+// response writer
+func (iw *invalidationWriter) Unwrap() http.ResponseWriter {
+	return iw.w
+}
+
+// returns the paths invalidated by an unsafe request: the request path and,
+// if enabled, the Location and Content-Location ones
+func invalidatedPaths(r *http.Request, header http.Header, c conf.CacheInvalidation) []string {
+	paths := []string{r.URL.EscapedPath()}
+	if !c.IsLocation() {
+		return paths
+	}
+	for _, k := range []string{"Location", "Content-Location"} {
+		v := header.Get(k)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			continue
+		}
+		// other origins are not ours to invalidate
+		if u.Host != "" && !strings.EqualFold(u.Host, r.Host) {
+			continue
+		}
+		p := r.URL.ResolveReference(u).EscapedPath()
+		if !contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// purges the cached responses of the mount point invalidated by a
+// successful unsafe request
+func invalidate(method string, paths []string, c conf.CacheInvalidation, matchHost string, mountPoint string) {
+	soft := c.IsSoft()
+	purged := 0
+
+	purge := func(target string, fn func() (int, error)) {
+		n, err := fn()
+		purged += n
+		if err != nil {
+			log.Error().Err(err).Str("path", target).Msg("cache invalidation failed")
+		}
+	}
+	purgePath := func(p string) (int, error) {
+		return purgeIndex(mountPathIndexKey(matchHost, mountPoint, p), soft)
+	}
+	for _, p := range paths {
+		purge(p, func() (int, error) { return purgePath(p) })
+	}
+	for _, p := range c.RelatedPaths {
+		if p == "" {
+			continue
+		}
+		if strings.ContainsAny(p, `*?[\`) {
+			purge(p, func() (int, error) { return purgeMatching(matchHost, mountPoint, p, soft) })
+		} else {
+			purge(p, func() (int, error) { return purgePath(p) })
+		}
+	}
+
+	log.Debug().
+		Str("method", method).
+		Str("path", paths[0]).
+		Int("purged", purged).
+		Msg("cache invalidated")
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+// the response header carrying the computed cache key (see the
+// cache key DebugHeader option)
+const CacheKeyHeaderKey = "X-Cache-Key"
+
+// checks if the query parameter name matches one of the patterns.
+// A trailing * matches by prefix
+func paramMatches(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// applies the key policy to the raw query. The parameters are kept
+// encoded as sent from the client
+func normalizeQuery(rawQuery string, policy conf.CacheKey) string {
+	if rawQuery == "" ||
+		(!policy.IsSortQuery() && len(policy.IncludeParams) == 0 && len(policy.IgnoreParams) == 0) {
+		return rawQuery
+	}
+
+	params := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if len(policy.IncludeParams) > 0 && !paramMatches(name, policy.IncludeParams) {
+			continue
+		}
+		if paramMatches(name, policy.IgnoreParams) {
+			continue
+		}
+		params = append(params, param)
+	}
+	if policy.IsSortQuery() {
+		sort.Strings(params)
+	}
+	return strings.Join(params, "&")
+}
+
+// builds the key part derived from the request url
+func urlKey(r *http.Request, policy conf.CacheKey) string {
+	u := *r.URL
+	u.RawQuery = normalizeQuery(u.RawQuery, policy)
+	if policy.IsLowercasePath() {
+		u.Path = strings.ToLower(u.Path)
+		u.RawPath = strings.ToLower(u.RawPath)
+	}
+
+	key := u.String()
+	if policy.IsHost() {
+		key = strings.ToLower(r.Host) + key
+	}
+	return key
+}
+
+// builds the key part derived from the request cookies
+func cookiesKey(r *http.Request, policy conf.CacheKey) string {
+	names := append([]string(nil), policy.Cookies...)
+	sort.Strings(names)
+
+	key := ""
+	for _, name := range names {
+		if c, err := r.Cookie(name); err == nil {
+			key = key + ";" + name + "=" + c.Value
+		}
+	}
+	return key
+}
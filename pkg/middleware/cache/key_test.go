@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+func keyFor(t *testing.T, url string, policy conf.CacheKey, cookies ...*http.Cookie) string {
+	r, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	// server requests have no scheme and host into the url
+	r.URL.Scheme = ""
+	r.URL.Host = ""
+
+	cc := chaincontext.NewChainContext()
+	cc.Reset(&conf.MountPoint{
+		Path: "/",
+		Middlewares: conf.Middlewares{
+			Cache: conf.Cache{Key: policy},
+		},
+	}, r)
+	r = cc.Update()
+	return (&CacheMiddleware{}).buildCacheKey(r)
+}
+
+func TestCacheKeyPolicy(t *testing.T) {
+	enabled := true
+
+	tests := []struct {
+		url     string
+		policy  conf.CacheKey
+		cookies []*http.Cookie
+		key     string
+	}{
+		// the default policy keeps the url as is
+		{"http://h/Path?b=2&a=1", conf.CacheKey{}, nil, "GET/Path?b=2&a=1"},
+		{"http://h/p?b=2&a=1&a=0", conf.CacheKey{SortQuery: &enabled}, nil, "GET/p?a=0&a=1&b=2"},
+		{"http://h/p?utm_source=x&a=1&utm_medium=y", conf.CacheKey{
+			IgnoreParams: []string{"utm_*"},
+		}, nil, "GET/p?a=1"},
+		{"http://h/p?a=1&b=2&c=3", conf.CacheKey{
+			IncludeParams: []string{"c", "a"},
+		}, nil, "GET/p?a=1&c=3"},
+		{"http://h/p?utm_id=1", conf.CacheKey{
+			IgnoreParams: []string{"utm_*"},
+		}, nil, "GET/p"},
+		{"http://h/Some/Path", conf.CacheKey{LowercasePath: &enabled}, nil, "GET/some/path"},
+		{"http://Example.com/p", conf.CacheKey{Host: &enabled}, nil, "GETexample.com/p"},
+		{"http://h/p", conf.CacheKey{Cookies: []string{"session", "lang"}}, []*http.Cookie{
+			{Name: "session", Value: "s1"},
+			{Name: "lang", Value: "en"},
+			{Name: "other", Value: "x"},
+		}, "GET/p;lang=en;session=s1"},
+	}
+
+	for idx, test := range tests {
+		key := keyFor(t, test.url, test.policy, test.cookies...)
+		if key != test.key {
+			t.Fatalf("%d: expected '%s', got '%s'", idx, test.key, key)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ferama/crauti/pkg/store"
+)
+
+const (
+	// Upstream responses can be tagged using one of these headers. Purging
+	// a tag removes all the responses tagged with it.
+	// Surrogate-Key tags are space separated, Cache-Tag ones are
+	// comma separated
+	SurrogateKeyHeaderKey = "Surrogate-Key"
+	CacheTagHeaderKey     = "Cache-Tag"
+
+	// index key heads. An index is a set of cache keys
+	tagIndexKeyHead   = "TAG"
+	urlIndexKeyHead   = "URL"
+	pathIndexKeyHead  = "PATH"
+	mountIndexKeyHead = "MOUNT"
+	// the entries of a path within a mount point
+	mountPathIndexKeyHead = "MOUNTPATH"
+)
+
+// returns the index of the entries of a mount point. Mount points that
+// share the path but match different hosts have their own index
+func mountIndexKey(matchHost string, path string) string {
+	return buildStoreKey(mountIndexKeyHead, matchHost+path)
+}
+
+// returns the index of the entries of a path within a mount point. The
+// paths are escaped: the space can't be part of them
+func mountPathIndexKey(matchHost string, mountPoint string, p string) string {
+	return buildStoreKey(mountPathIndexKeyHead, matchHost+mountPoint+" "+p)
+}
+
+// strips the query from a request uri
+func urlPath(uri string) string {
+	p, _, _ := strings.Cut(uri, "?")
+	return p
+}
+
+// returns the tags of an upstream response
+func responseTags(header http.Header) []string {
+	tags := []string{}
+	for _, v := range header.Values(SurrogateKeyHeaderKey) {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	for _, v := range header.Values(CacheTagHeaderKey) {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// adds the cache key to the indexes the entry can be purged by
+func indexEntry(key string, e *entry, ttl time.Duration) {
+	indexes := []string{}
+	for _, tag := range responseTags(e.Header) {
+		indexes = append(indexes, buildStoreKey(tagIndexKeyHead, tag))
+	}
+	if e.meta.URL != "" {
+		indexes = append(indexes, buildStoreKey(urlIndexKeyHead, e.meta.URL))
+		indexes = append(indexes, buildStoreKey(pathIndexKeyHead, urlPath(e.meta.URL)))
+	}
+	if e.meta.MountPoint != "" {
+		indexes = append(indexes, mountIndexKey(e.meta.MatchHost, e.meta.MountPoint))
+		if e.meta.URL != "" {
+			indexes = append(indexes,
+				mountPathIndexKey(e.meta.MatchHost, e.meta.MountPoint, urlPath(e.meta.URL)))
+		}
+	}
+
+	for _, index := range indexes {
+		if err := store.Instance().ZAdd(index, []string{key}, ttl); err != nil {
+			log.Error().Err(err).Str("index", index).Msg("unable to index the cache entry")
+		}
+	}
+}
+
+// removes the entry from the store. The bool is false if the entry
+// was not found
+func hardPurge(key string) (bool, error) {
+	keys := []string{buildStoreKey(entryKeyHead, key)}
+	if e, ok := loadEntry(key, false); ok {
+		keys = append(keys, e.chunks...)
+	}
+	keys = append(keys, legacyEntryKeys(key)...)
+	deleted, err := store.Instance().Del(keys...)
+	return deleted > 0, err
+}
+
+// marks the entry as stale. It is revalidated on the next request and can
+// be still served as stale content (stale-while-revalidate, stale-if-error).
+// The bool is false if the entry was not found
+func softPurge(key string) (bool, error) {
+	raw, err := store.Instance().Get(buildStoreKey(entryKeyHead, key))
+	if err != nil {
+		// legacy entries can't be marked as stale
+		return hardPurge(key)
+	}
+	e, err := decodeEntry(raw)
+	if err != nil {
+		return hardPurge(key)
+	}
+
+	// keep the entry into the store for its remaining lifetime
+	remaining := time.Until(e.meta.StoredAt.Add(e.meta.TTL + e.meta.Retention))
+	if remaining <= 0 {
+		return false, nil
+	}
+	e.meta.TTL = e.meta.InitialAge + time.Since(e.meta.StoredAt)
+	raw, err = encodeEntry(e, compressionThreshold())
+	if err != nil {
+		return true, err
+	}
+	return true, store.Instance().Set(buildStoreKey(entryKeyHead, key), raw, remaining)
+}
+
+func purge(key string, soft bool) (bool, error) {
+	if soft {
+		return softPurge(key)
+	}
+	return hardPurge(key)
+}
+
+// removes the index members whose entry is gone
+func pruneIndex(index string, dead []string) {
+	if len(dead) == 0 {
+		return
+	}
+	if err := store.Instance().ZRem(index, dead...); err != nil {
+		log.Error().Err(err).Str("index", index).Msg("unable to prune the cache index")
+	}
+}
+
+// purges all the entries of an index. Returns the number of purged entries
+func purgeIndex(index string, soft bool) (int, error) {
+	keys, err := store.Instance().ZMembers(index)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	dead := []string{}
+	for _, key := range keys {
+		found, err := purge(key, soft)
+		if err != nil {
+			pruneIndex(index, dead)
+			return purged, err
+		}
+		if !found {
+			dead = append(dead, key)
+			continue
+		}
+		purged++
+	}
+	if soft {
+		pruneIndex(index, dead)
+	} else {
+		_, err = store.Instance().Del(index)
+	}
+
+	log.Debug().
+		Str("index", index).
+		Bool("soft", soft).
+		Int("purged", purged).Msg("cache purge")
+	return purged, err
+}
+
+// PurgeTag purges all the cached responses tagged with tag. If soft is true
+// the responses are marked as stale instead of being removed
+func PurgeTag(tag string, soft bool) (int, error) {
+	return purgeIndex(buildStoreKey(tagIndexKeyHead, tag), soft)
+}
+
+// PurgeURL purges all the cached responses for the given url. Only the
+// request uri (path and query) is taken into account
+func PurgeURL(rawURL string, soft bool) (int, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	return purgeIndex(buildStoreKey(urlIndexKeyHead, u.RequestURI()), soft)
+}
+
+// PurgePath purges all the cached responses for the given path, whatever
+// their query is
+func PurgePath(p string, soft bool) (int, error) {
+	return purgeIndex(buildStoreKey(pathIndexKeyHead, p), soft)
+}
+
+// purges the entries of a mount point whose path matches the
+// path.Match pattern. All the mount point entries are loaded
+func purgeMatching(matchHost string, mountPoint string, pattern string, soft bool) (int, error) {
+	index := mountIndexKey(matchHost, mountPoint)
+	keys, err := store.Instance().ZMembers(index)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	// the removed entries are pruned from the index
+	dead := []string{}
+	defer func() { pruneIndex(index, dead) }()
+	for _, key := range keys {
+		e, ok := loadEntry(key, false)
+		if !ok {
+			dead = append(dead, key)
+			continue
+		}
+		if match, _ := path.Match(pattern, urlPath(e.meta.URL)); !match {
+			continue
+		}
+		found, err := purge(key, soft)
+		if err != nil {
+			return purged, err
+		}
+		if !found || !soft {
+			dead = append(dead, key)
+		}
+		if found {
+			purged++
+		}
+	}
+
+	log.Debug().
+		Str("pattern", pattern).
+		Bool("soft", soft).
+		Int("purged", purged).Msg("cache purge")
+	return purged, nil
+}
+
+// PurgeMountPoint purges all the cached responses of the mount point
+// matching matchHost (empty for any host) and path
+func PurgeMountPoint(matchHost string, path string, soft bool) (int, error) {
+	return purgeIndex(mountIndexKey(matchHost, path), soft)
+}
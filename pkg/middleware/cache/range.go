@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// how range requests are handled on cache misses
+const (
+	// the request is forwarded as is. Partial responses are not stored
+	RangeMissPassthrough = "passthrough"
+	// the full object is requested to the upstream and stored. The
+	// requested range is served from it
+	RangeMissFull = "full"
+)
+
+// reads the body of a chunked entry loading the chunks on demand
+type chunkReader struct {
+	e         *entry
+	size      int64
+	chunkSize int64
+
+	off   int64
+	idx   int
+	chunk []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.off >= c.size {
+		return 0, io.EOF
+	}
+	idx := int(c.off / c.chunkSize)
+	if idx != c.idx {
+		// the first chunk is the entry body
+		chunk := c.e.Body
+		if idx > 0 {
+			if idx > len(c.e.chunks) {
+				return 0, errors.New("chunk index out of range")
+			}
+			var err error
+			if chunk, err = loadChunk(c.e.chunks[idx-1]); err != nil {
+				return 0, err
+			}
+		}
+		c.idx = idx
+		c.chunk = chunk
+	}
+	start := c.off - int64(idx)*c.chunkSize
+	if start >= int64(len(c.chunk)) {
+		return 0, errors.New("truncated chunk")
+	}
+	n := copy(p, c.chunk[start:])
+	c.off += int64(n)
+	return n, nil
+}
+
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.off
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	c.off = offset
+	return offset, nil
+}
+
+// returns a reader of the entry body
+func (e *entry) reader() (io.ReadSeeker, error) {
+	if len(e.chunks) == 0 {
+		return bytes.NewReader(e.Body), nil
+	}
+	// entries stored without the size: load the whole body
+	if e.meta.Size == 0 || len(e.Body) == 0 {
+		if err := e.loadBody(); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(e.Body), nil
+	}
+	return &chunkReader{
+		e:         e,
+		size:      e.meta.Size,
+		chunkSize: int64(len(e.Body)),
+		chunk:     e.Body,
+	}, nil
+}
+
+// serves the ranges requested from the client (single and multi range
+// requests, If-Range) from a full cached response
+func (m *CacheMiddleware) serveRange(e *entry, cond conditions, w http.ResponseWriter) {
+	reader, err := e.reader()
+	if err != nil {
+		log.Error().Err(err).Msg("unable to read the cache entry")
+		panic(http.ErrAbortHandler)
+	}
+
+	// the other client conditions are already evaluated
+	req := &http.Request{
+		Method: cond.method,
+		Header: http.Header{},
+	}
+	req.Header.Set("Range", cond.ranges)
+	if cond.ifRange != "" {
+		req.Header.Set("If-Range", cond.ifRange)
+	}
+	// a zero time if the header is missing
+	modtime, _ := http.ParseTime(e.Header.Get("Last-Modified"))
+	http.ServeContent(w, req, "", modtime, reader)
+}
+
+// writes a response held by the cache response writer
+func (m *CacheMiddleware) writeHeld(rw *responseWriter, cond conditions, w http.ResponseWriter) {
+	s := *rw.signal
+	s.fwdStatus = rw.statusCode
+	if rw.statusCode != http.StatusOK {
+		s.apply(w.Header(), nil)
+		w.WriteHeader(rw.statusCode)
+		w.Write(rw.bodyBuf.Bytes())
+		return
+	}
+	m.writeEntry(&entry{
+		Status: rw.statusCode,
+		Header: rw.Header().Clone(),
+		Body:   rw.bodyBuf.Bytes(),
+	}, cond, w, s)
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+const rangeBody = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func rangeUpstream() *upstream {
+	u := &upstream{}
+	u.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"r1"`)
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(rangeBody))
+	}
+	return u
+}
+
+func rangeConf(rangeMiss string) conf.Cache {
+	enabled := true
+	return conf.Cache{
+		Enabled:   &enabled,
+		TTL:       time.Minute,
+		Methods:   []string{http.MethodGet},
+		RangeMiss: rangeMiss,
+	}
+}
+
+func getRange(t *testing.T, url string, headers map[string]string) (*http.Response, string) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestRangeFromCache(t *testing.T) {
+	u := rangeUpstream()
+	s := buildServer(rangeConf(RangeMissPassthrough), u)
+	defer s.Close()
+
+	url := s.URL + "/range"
+	getBody(t, url)
+
+	res, body := getRange(t, url, map[string]string{"Range": "bytes=2-5"})
+	if res.StatusCode != http.StatusPartialContent || body != "2345" {
+		t.Fatalf("single range: got %d '%s'", res.StatusCode, body)
+	}
+	if res.Header.Get("Content-Range") != "bytes 2-5/36" {
+		t.Fatalf("unexpected Content-Range '%s'", res.Header.Get("Content-Range"))
+	}
+
+	res, _ = getRange(t, url, map[string]string{"Range": "bytes=0-1,10-11"})
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode != http.StatusPartialContent || mediaType != "multipart/byteranges" {
+		t.Fatalf("multi range: got %d '%s'", res.StatusCode, mediaType)
+	}
+
+	res, body = getRange(t, url, map[string]string{"Range": "bytes=0-1", "If-Range": `"old"`})
+	if res.StatusCode != http.StatusOK || body != rangeBody {
+		t.Fatalf("If-Range mismatch: expected the full body, got %d", res.StatusCode)
+	}
+	res, _ = getRange(t, url, map[string]string{"Range": "bytes=0-1", "If-Range": `"r1"`})
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("If-Range match: expected 206, got %d", res.StatusCode)
+	}
+
+	res, _ = getRange(t, url, map[string]string{"Range": "bytes=100-200"})
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416, got %d", res.StatusCode)
+	}
+
+	if u.calls.Load() != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", u.calls.Load())
+	}
+}
+
+func TestRangeChunkedEntry(t *testing.T) {
+	chunkSize := conf.ConfInst.CacheStore.ChunkSize
+	conf.ConfInst.CacheStore.ChunkSize = "10b"
+	defer func() {
+		conf.ConfInst.CacheStore.ChunkSize = chunkSize
+	}()
+
+	s := buildServer(rangeConf(RangeMissPassthrough), rangeUpstream())
+	defer s.Close()
+
+	url := s.URL + "/range-chunked"
+	getBody(t, url)
+
+	res, body := getRange(t, url, map[string]string{"Range": "bytes=8-21"})
+	if res.StatusCode != http.StatusPartialContent || body != rangeBody[8:22] {
+		t.Fatalf("got %d '%s'", res.StatusCode, body)
+	}
+
+	// the second range goes back to the first chunk
+	res, body = getRange(t, url, map[string]string{"Range": "bytes=20-22,0-1"})
+	mediaType, params, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode != http.StatusPartialContent || mediaType != "multipart/byteranges" {
+		t.Fatalf("multi range: got %d '%s'", res.StatusCode, mediaType)
+	}
+	parts := []string{}
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Range")+" "+string(data))
+	}
+	expected := []string{"bytes 20-22/36 " + rangeBody[20:23], "bytes 0-1/36 " + rangeBody[0:2]}
+	if strings.Join(parts, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected parts %v", parts)
+	}
+}
+
+func TestRangeMiss(t *testing.T) {
+	// partial responses are not stored
+	u := rangeUpstream()
+	s := buildServer(rangeConf(RangeMissPassthrough), u)
+	url := s.URL + "/range-passthrough"
+	res, body := getRange(t, url, map[string]string{"Range": "bytes=0-3"})
+	if res.StatusCode != http.StatusPartialContent || body != "0123" {
+		t.Fatalf("passthrough: got %d '%s'", res.StatusCode, body)
+	}
+	_, body = getBody(t, url)
+	if body != rangeBody || u.calls.Load() != 2 {
+		t.Fatal("passthrough: the partial response should not be stored")
+	}
+	s.Close()
+
+	// the full object is stored
+	u = rangeUpstream()
+	s = buildServer(rangeConf(RangeMissFull), u)
+	defer s.Close()
+	url = s.URL + "/range-full"
+	res, body = getRange(t, url, map[string]string{"Range": "bytes=0-3"})
+	if res.StatusCode != http.StatusPartialContent || body != "0123" {
+		t.Fatalf("full: got %d '%s'", res.StatusCode, body)
+	}
+	_, body = getBody(t, url)
+	if body != rangeBody || u.calls.Load() != 1 {
+		t.Fatal("full: the full object should be stored")
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
-	"fmt"
+	"mime"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/ferama/crauti/pkg/redis"
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/store"
 )
 
 type responseWriter struct {
@@ -19,7 +22,34 @@ type responseWriter struct {
 
 	bodyBuf bytes.Buffer
 
-	statusCode int
+	statusCode  int
+	wroteHeader bool
+	// streaming responses are unbounded. They are never buffered
+	// nor cached
+	streaming bool
+	// responses larger than maxObjectSize are passed through and
+	// not cached. Values lesser or equal to 0 disable the limit
+	maxObjectSize int64
+	oversized     bool
+	// true if the request is a conditional one, sent to revalidate
+	// a stale entry
+	revalidating bool
+	// the upstream answered the revalidation with a 304. The response
+	// is not forwarded to the client: it will get the cached one
+	notModified bool
+	// the response is buffered and not forwarded to the client: the
+	// caller is going to write it. Streaming and oversized responses
+	// release the hold and are forwarded as they are
+	holding bool
+	// a stale entry can replace an upstream error (stale-if-error)
+	staleIfError bool
+	// the upstream failed and a stale entry is going to be served. The
+	// error response is not forwarded to the client
+	failed bool
+	// the cache status reported when the response is forwarded
+	// to the client, and the Cache-Status member added
+	signal      *signal
+	cacheStatus string
 
 	cacheKey string
 }
@@ -28,6 +58,62 @@ func (rw *responseWriter) Reset(r *http.Request, w http.ResponseWriter, cacheKey
 	rw.r = r
 	rw.w = w
 	rw.cacheKey = cacheKey
+	rw.bodyBuf.Reset()
+	rw.statusCode = http.StatusOK
+	rw.wroteHeader = false
+	rw.streaming = false
+	rw.maxObjectSize = 0
+	rw.oversized = false
+	rw.holding = false
+	rw.revalidating = false
+	rw.notModified = false
+	rw.staleIfError = false
+	rw.failed = false
+	rw.signal = nil
+	rw.cacheStatus = ""
+}
+
+// sets the cache status headers before forwarding the response
+func (rw *responseWriter) applySignal() {
+	if rw.signal == nil {
+		return
+	}
+	s := *rw.signal
+	s.fwdStatus = rw.statusCode
+	rw.cacheStatus = s.apply(rw.w.Header(), nil)
+}
+
+// the buffering limit of the responses of unknown length (chunked for
+// example) when maxObjectSize doesn't set one
+var unknownLengthLimit int64 = 64 << 20
+
+// switches to pass-through mode if the upstream declares a response
+// larger than maxObjectSize. The responses of unknown length are
+// always buffered up to a limit
+func (rw *responseWriter) detectOversized() {
+	cl, err := strconv.ParseInt(rw.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		if rw.maxObjectSize <= 0 {
+			rw.maxObjectSize = unknownLengthLimit
+		}
+		return
+	}
+	if rw.maxObjectSize > 0 && cl > rw.maxObjectSize {
+		rw.oversized = true
+	}
+}
+
+// checks the response content type and switch to pass-through mode if
+// the upstream is sending a stream
+func (rw *responseWriter) detectStreaming() {
+	ct := rw.Header().Get("Content-Type")
+	if ct == "" {
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(ct); mediaType == "text/event-stream" {
+		rw.streaming = true
+		rw.bodyBuf.Reset()
+	}
 }
 
 func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
@@ -45,38 +131,182 @@ func (rw *responseWriter) Header() http.Header {
 func (rw *responseWriter) WriteHeader(statusCode int) {
 	// store the status code to be able to cache it laters
 	rw.statusCode = statusCode
+	rw.wroteHeader = true
+	if rw.revalidating && statusCode == http.StatusNotModified {
+		rw.notModified = true
+		return
+	}
+	if rw.staleIfError && statusCode >= http.StatusInternalServerError {
+		rw.failed = true
+		return
+	}
+	rw.detectStreaming()
+	rw.detectOversized()
+	if rw.holding {
+		if !rw.streaming && !rw.oversized {
+			return
+		}
+		rw.holding = false
+	}
+	rw.applySignal()
 	rw.w.WriteHeader(statusCode)
 }
 
 func (rw *responseWriter) Write(data []byte) (int, error) {
-	rw.bodyBuf.Write(data)
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.notModified || rw.failed {
+		return len(data), nil
+	}
+	if !rw.streaming && !rw.oversized {
+		// the limit was crossed mid-stream
+		if rw.maxObjectSize > 0 && int64(rw.bodyBuf.Len()+len(data)) > rw.maxObjectSize {
+			rw.oversized = true
+			rw.release()
+			rw.bodyBuf.Reset()
+		} else {
+			rw.bodyBuf.Write(data)
+		}
+	}
+	if rw.holding {
+		return len(data), nil
+	}
 	return rw.w.Write(data)
 }
 
-func (rw *responseWriter) Done(cacheTTL time.Duration) {
-	// build headers cache content. The idea here is to store
-	// all the headers sent from backend to send them back to the client
-	// when the request hit the cache
-	headers := ""
-	for k, v := range rw.Header() {
-		if k == "X-Generator" {
-			continue
-		}
-		if headers != "" {
-			headers = fmt.Sprintf("%s\r\n%s: %s", headers, k, strings.Join(v, ","))
-		} else {
-			headers = fmt.Sprintf("%s: %s", k, strings.Join(v, ","))
-		}
+// forwards the held response to the client
+func (rw *responseWriter) release() {
+	if !rw.holding {
+		return
+	}
+	rw.holding = false
+	rw.applySignal()
+	rw.w.WriteHeader(rw.statusCode)
+	rw.w.Write(rw.bodyBuf.Bytes())
+}
+
+// implements the http.Flusher interface. Required to support streaming
+// responses (Server-Sent Events for example)
+func (rw *responseWriter) Flush() {
+	if rw.notModified || rw.failed || rw.holding {
+		return
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// allows the http.ResponseController to reach the underlying
+// response writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// stores the upstream response into the cache
+func (rw *responseWriter) Done(c conf.Cache) {
+	if rw.notModified || rw.failed {
+		return
+	}
+	if rw.streaming {
+		rw.notStored("streaming response")
+		return
+	}
+	if rw.oversized {
+		rw.notStored("response larger than maxObjectSize")
+		return
+	}
+	// partial responses are never stored
+	if rw.statusCode == http.StatusPartialContent {
+		return
 	}
 	// do not cache empty responses if they are not OPTIONS or HEAD request
-	if len(rw.bodyBuf.Bytes()) > 0 ||
-		rw.r.Method == http.MethodOptions ||
-		rw.r.Method == http.MethodHead {
-		// headers
-		redis.CacheInstance().Set(buildRedisKey(headersKeyHead, rw.cacheKey), []byte(headers), cacheTTL)
-		// status
-		redis.CacheInstance().Set(buildRedisKey(statusKeyHead, rw.cacheKey), rw.statusCode, cacheTTL)
-		// body
-		redis.CacheInstance().Set(buildRedisKey(bodyKeyHead, rw.cacheKey), rw.bodyBuf.Bytes(), cacheTTL)
+	if rw.bodyBuf.Len() == 0 &&
+		rw.r.Method != http.MethodOptions &&
+		rw.r.Method != http.MethodHead {
+		return
+	}
+	ttl, ok := c.StatusTTL(rw.statusCode)
+	if !ok {
+		rw.notStored("status not cacheable")
+		return
+	}
+
+	header := rw.Header().Clone()
+	stripSignals(header, c, rw.cacheStatus)
+	key := rw.cacheKey
+	meta := entryMeta{
+		StoredAt:   time.Now(),
+		TTL:        ttl,
+		URL:        rw.r.URL.RequestURI(),
+		MountPoint: chaincontext.GetChainContext(rw.r).Conf.Path,
+		MatchHost:  chaincontext.GetChainContext(rw.r).Conf.MatchHost,
+	}
+	retention := staleRetention(header, c)
+
+	if c.IsRFC9111() {
+		// the status TTL is used as heuristic freshness
+		ttl, ok := storable(rw.r, authenticated(rw.r), rw.statusCode, header, ttl)
+		if !ok {
+			rw.notStored("response not storable")
+			return
+		}
+		meta.TTL = ttl
+		meta.InitialAge = initialAge(header)
+		if ttl+retention <= 0 {
+			return
+		}
+
+		// always write the vary list. An empty one clears the value
+		// stored by a previous response
+		vary, _ := varyHeaders(header)
+		store.Instance().Set(buildStoreKey(varyKeyHead, rw.cacheKey), []byte(strings.Join(vary, ",")), ttl+retention)
+		key = varyKey(rw.cacheKey, vary, rw.r)
 	}
+	// the cookies belong to the client that triggered the fill. The
+	// middlewares in front of the cache (the oidc session refresh for
+	// example) set them into the same header
+	header.Del("Set-Cookie")
+
+	// the buffer is reused by the pool: store a copy
+	body := make([]byte, rw.bodyBuf.Len())
+	copy(body, rw.bodyBuf.Bytes())
+
+	storeEntry(key, &entry{
+		Status: rw.statusCode,
+		Header: header,
+		Body:   body,
+		meta:   meta,
+	}, retention)
+
+	cacheContext := chaincontext.GetChainContext(rw.r).Cache
+	cacheContext.Stored = true
+	cacheContext.TTL = meta.TTL
+}
+
+// logs why the response was not stored and reports it into the
+// chain context
+func (rw *responseWriter) notStored(reason string) {
+	log.Debug().
+		Int("upstreamStatus", rw.statusCode).
+		Str("key", rw.cacheKey).
+		Msg(reason + ": not cached")
+
+	chaincontext.GetChainContext(rw.r).Cache.NotStored = reason
 }
+
+// a response writer that drops everything. Used by the background
+// refreshes: there is no client waiting for the response
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (d *discardWriter) WriteHeader(statusCode int) {}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/utils"
+)
+
+const (
+	AgeHeaderKey         = "Age"
+	CacheStatusHeaderKey = "Cache-Status"
+	XCacheHeaderKey      = "X-Cache"
+	defaultCacheName     = "crauti"
+)
+
+// the cache status reported to the client
+type signal struct {
+	conf conf.Cache
+	// one of the utils.CacheStatus values
+	status string
+	// the cache key. Empty if it was not computed
+	key string
+	// overrides the forward reason derived from the status
+	fwd string
+	// the upstream response status, if the request was forwarded
+	fwdStatus int
+	detail    string
+}
+
+func headerName(name string, def string) string {
+	if name == "" {
+		return def
+	}
+	return name
+}
+
+func generatorHeader(c conf.Cache) string {
+	return headerName(c.Headers.GeneratorName, GeneratorHeaderKey)
+}
+
+// sets the generator header, unless it is hidden
+func setGenerator(h http.Header, c conf.Cache, value string) {
+	if c.Headers.IsHideGenerator() {
+		return
+	}
+	h.Set(generatorHeader(c), value)
+}
+
+// the legacy X-Cache values
+func xCacheValue(status string) string {
+	switch status {
+	case utils.CacheStatusHit:
+		return "HIT"
+	case utils.CacheStatusStale:
+		return "STALE"
+	case utils.CacheStatusRevalidated:
+		return "REVALIDATED"
+	case utils.CacheStatusMiss:
+		return "MISS"
+	}
+	return "BYPASS"
+}
+
+// the RFC 9211 Cache-Status member of the gateway. e is the entry used
+// to build the response, if any
+func (s signal) cacheStatus(e *entry) string {
+	params := []string{headerName(s.conf.Headers.CacheName, defaultCacheName)}
+
+	fwd := s.fwd
+	switch s.status {
+	case utils.CacheStatusHit:
+		params = append(params, "hit")
+	case utils.CacheStatusStale:
+		// stale-while-revalidate responses are not forwarded
+		if s.fwdStatus == 0 {
+			params = append(params, "hit")
+		} else if fwd == "" {
+			fwd = "stale"
+		}
+	case utils.CacheStatusRevalidated:
+		if fwd == "" {
+			fwd = "stale"
+		}
+	case utils.CacheStatusMiss:
+		if fwd == "" {
+			fwd = "uri-miss"
+		}
+	case utils.CacheStatusIgnored:
+		if fwd == "" {
+			fwd = "request"
+		}
+	default:
+		if fwd == "" {
+			fwd = "bypass"
+		}
+	}
+	if fwd != "" {
+		params = append(params, "fwd="+fwd)
+	}
+	if s.fwdStatus != 0 {
+		params = append(params, fmt.Sprintf("fwd-status=%d", s.fwdStatus))
+	}
+	if e != nil && !e.meta.StoredAt.IsZero() {
+		params = append(params, fmt.Sprintf("ttl=%d", int64(e.freshness().Seconds())))
+	}
+	if s.key != "" {
+		sum := sha256.Sum256([]byte(s.key))
+		params = append(params, fmt.Sprintf("key=%q", hex.EncodeToString(sum[:8])))
+	}
+	if s.detail != "" {
+		params = append(params, fmt.Sprintf("detail=%q", s.detail))
+	}
+	return strings.Join(params, "; ")
+}
+
+// sets the cache status headers. e is the entry used to build the
+// response, if any. Returns the Cache-Status member added, if any.
+// Needs to be called before the response header is written
+func (s signal) apply(h http.Header, e *entry) string {
+	c := s.conf.Headers
+
+	if e != nil && c.IsAge() && !e.meta.StoredAt.IsZero() {
+		h.Set(AgeHeaderKey, strconv.FormatInt(int64(e.age().Seconds()), 10))
+	}
+	if c.IsXCache() {
+		h.Set(headerName(c.XCacheName, XCacheHeaderKey), xCacheValue(s.status))
+	}
+	if !c.IsCacheStatus() {
+		return ""
+	}
+	// the upstream caches members come first
+	member := s.cacheStatus(e)
+	h.Add(headerName(c.CacheStatusName, CacheStatusHeaderKey), member)
+	return member
+}
+
+// removes the headers set by the gateway from a response that
+// is going to be stored. member is the Cache-Status member added
+func stripSignals(h http.Header, c conf.Cache, member string) {
+	h.Del(generatorHeader(c))
+	h.Del(headerName(c.Headers.XCacheName, XCacheHeaderKey))
+
+	if member == "" {
+		return
+	}
+	name := headerName(c.Headers.CacheStatusName, CacheStatusHeaderKey)
+	values := []string{}
+	for _, v := range h.Values(name) {
+		if v != member {
+			values = append(values, v)
+		}
+	}
+	h.Del(name)
+	for _, v := range values {
+		h.Add(name, v)
+	}
+}
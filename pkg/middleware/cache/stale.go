@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+// returns the stale-while-revalidate and stale-if-error windows of a
+// response (RFC 5861). The response directives win over the configured
+// values
+func staleWindows(header http.Header, c conf.Cache) (time.Duration, time.Duration) {
+	swr := c.StaleWhileRevalidate
+	sie := c.StaleIfError
+
+	cc := parseCacheControl(header)
+	if d, ok := cc.duration("stale-while-revalidate"); ok {
+		swr = d
+	}
+	if d, ok := cc.duration("stale-if-error"); ok {
+		sie = d
+	}
+	return swr, sie
+}
+
+// returns how long a response is kept into the store after its
+// expiration. It needs to cover the stale windows
+func staleRetention(header http.Header, c conf.Cache) time.Duration {
+	retention := c.KeepStale
+	swr, sie := staleWindows(header, c)
+	if swr > retention {
+		retention = swr
+	}
+	if sie > retention {
+		retention = sie
+	}
+	return retention
+}
+
+// checks if a stale entry can be served without validating it with
+// the upstream. In rfc9111 mode the entry and the client directives
+// may forbid it
+func staleAllowed(e *entry, r *http.Request, c conf.Cache) bool {
+	if !c.IsRFC9111() {
+		return true
+	}
+	cc := parseCacheControl(e.Header)
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("no-cache") {
+		return false
+	}
+	reqCC := parseCacheControl(r.Header)
+	return !reqCC.has("max-age") && !reqCC.has("min-fresh")
+}
@@ -81,13 +81,41 @@ func (m *CollectorMiddleware) emitLogs(r *http.Request) {
 	if ctx.Conf.Middlewares.Cache.IsEnabled() {
 		cacheContext := ctx.Cache
 		event.Str("cache", cacheContext.Status)
+		if cacheContext.Stored {
+			event.Str("cacheTTL", cacheContext.TTL.String())
+		}
+		if cacheContext.NotStored != "" {
+			event.Str("cacheNotStored", cacheContext.NotStored)
+		}
+	}
+
+	if ctx.GraphQL.Operation != "" {
+		graphqlDict := zerolog.Dict().
+			Str("operation", ctx.GraphQL.Operation).
+			Str("name", ctx.GraphQL.OperationName)
+		event.Dict("graphql", graphqlDict)
+	}
+
+	// label synthetic faults, so they will not be confused
+	// with real errors
+	if ctx.Fault.Injected() {
+		faultDict := zerolog.Dict().
+			Bool("injected", true).
+			Str("delay", ctx.Fault.Delay.String()).
+			Int("abortStatus", ctx.Fault.AbortStatus)
+		event.Dict("fault", faultDict)
 	}
 
 	proxyContext := ctx.Proxy
 	upstreamLatency := time.Since(proxyContext.UpstreamRequestStartTime)
 
+	// the mount point may have more than one target
+	upstream := ctx.Proxy.Upstream
+	if upstream == "" {
+		upstream = ctx.Conf.Upstream
+	}
 	proxyUpstreamDict := zerolog.Dict().
-		Str("url", ctx.Conf.Upstream).
+		Str("url", upstream).
 		Str("mountPath", ctx.Conf.Path).
 		Str("uri", ctx.Proxy.URI).
 		Float64("latency", upstreamLatency.Seconds()).
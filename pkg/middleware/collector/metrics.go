@@ -7,6 +7,7 @@ import (
 	"github.com/ferama/crauti/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
@@ -21,6 +22,17 @@ const (
 	CrautiCacheTotal             = "crauti_cache_total"
 )
 
+// all the cache statuses exposed by the crauti_cache_total metric
+var cacheStatuses = []string{
+	utils.CacheStatusBypass,
+	utils.CacheStatusBypassError,
+	utils.CacheStatusHit,
+	utils.CacheStatusIgnored,
+	utils.CacheStatusMiss,
+	utils.CacheStatusRevalidated,
+	utils.CacheStatusStale,
+}
+
 func MetricsInstance() *metrics {
 	once.Do(func() {
 		instance = newMetrics()
@@ -137,34 +149,15 @@ func (m *metrics) RegisterMountPath(mountPath string, upstream string, matchHost
 	// cache
 	// Query example:
 	//   1 - (sum(crauti_cache_total{status!="HIT"}) / sum(crauti_cache_total{status="HIT"}))
-	mapKey = m.GetCacheTotalMapKey(mountPath, utils.CacheStatusBypass, matchHost)
-	m.collectors[mapKey] = promauto.NewCounter(prometheus.CounterOpts{
-		Name: CrautiCacheTotal,
-		Help: "Total cache",
-		ConstLabels: prometheus.Labels{
-			"status": utils.CacheStatusBypass, "mountPath": mountPath, "upstream": upstream, "host": matchHost},
-	})
-	mapKey = m.GetCacheTotalMapKey(mountPath, utils.CacheStatusHit, matchHost)
-	m.collectors[mapKey] = promauto.NewCounter(prometheus.CounterOpts{
-		Name: CrautiCacheTotal,
-		Help: "Total cache",
-		ConstLabels: prometheus.Labels{
-			"status": utils.CacheStatusHit, "mountPath": mountPath, "upstream": upstream, "host": matchHost},
-	})
-	mapKey = m.GetCacheTotalMapKey(mountPath, utils.CacheStatusIgnored, matchHost)
-	m.collectors[mapKey] = promauto.NewCounter(prometheus.CounterOpts{
-		Name: CrautiCacheTotal,
-		Help: "Total cache",
-		ConstLabels: prometheus.Labels{
-			"status": utils.CacheStatusIgnored, "mountPath": mountPath, "upstream": upstream, "host": matchHost},
-	})
-	mapKey = m.GetCacheTotalMapKey(mountPath, utils.CacheStatusMiss, matchHost)
-	m.collectors[mapKey] = promauto.NewCounter(prometheus.CounterOpts{
-		Name: CrautiCacheTotal,
-		Help: "Total cache",
-		ConstLabels: prometheus.Labels{
-			"status": utils.CacheStatusMiss, "mountPath": mountPath, "upstream": upstream, "host": matchHost},
-	})
+	for _, status := range cacheStatuses {
+		mapKey = m.GetCacheTotalMapKey(mountPath, status, matchHost)
+		m.collectors[mapKey] = promauto.NewCounter(prometheus.CounterOpts{
+			Name: CrautiCacheTotal,
+			Help: "Total cache",
+			ConstLabels: prometheus.Labels{
+				"status": status, "mountPath": mountPath, "upstream": upstream, "host": matchHost},
+		})
+	}
 }
 
 func (m *metrics) Get(key string) (prometheus.Collector, bool) {
@@ -175,6 +168,24 @@ func (m *metrics) Get(key string) (prometheus.Collector, bool) {
 	return val, ok
 }
 
+// Returns the crauti_cache_total values of a mount path by cache status.
+// The values are local to this instance
+func (m *metrics) CacheTotals(mountPath string, matchHost string) map[string]float64 {
+	totals := make(map[string]float64)
+	for _, status := range cacheStatuses {
+		c, ok := m.Get(m.GetCacheTotalMapKey(mountPath, status, matchHost))
+		if !ok {
+			continue
+		}
+		metric := &dto.Metric{}
+		if err := c.(prometheus.Counter).Write(metric); err != nil {
+			continue
+		}
+		totals[status] = metric.GetCounter().GetValue()
+	}
+	return totals
+}
+
 func (m *metrics) UnregisterAll() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
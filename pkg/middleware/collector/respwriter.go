@@ -54,7 +54,26 @@ func (rw *responseWriter) WriteHeader(statusCode int) {
 }
 
 func (rw *responseWriter) Write(data []byte) (int, error) {
+	// the handler could write the body without calling WriteHeader
+	// explicitly. Record the implicit status in that case
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
 	n, err := rw.w.Write(data)
 	rw.bytesWritten += n
 	return n, err
 }
+
+// implements the http.Flusher interface. Required to support streaming
+// responses (Server-Sent Events for example)
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// allows the http.ResponseController to reach the underlying
+// response writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
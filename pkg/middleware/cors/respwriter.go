@@ -53,3 +53,17 @@ func (rw *responseWriter) WriteHeader(statusCode int) {
 func (rw *responseWriter) Write(data []byte) (int, error) {
 	return rw.w.Write(data)
 }
+
+// implements the http.Flusher interface. Required to support streaming
+// responses (Server-Sent Events for example)
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// allows the http.ResponseController to reach the underlying
+// response writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
@@ -0,0 +1,261 @@
+package esi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/logger"
+	"github.com/ferama/crauti/pkg/middleware"
+	"github.com/ferama/crauti/pkg/utils"
+	"github.com/rs/zerolog"
+)
+
+const BodyResponseFragmentError = "crauti: esi fragment failed\n"
+
+type contextKey string
+
+// marks the fragment requests. They are processed by the
+// document including them
+const fragmentContextKey contextKey = "esi-fragment"
+
+var log *zerolog.Logger
+
+func init() {
+	log = logger.GetLogger("esi")
+}
+
+// Processes the Edge Side Includes tags of the html responses. Supported
+// tags are esi:include (src, alt and onerror attributes), esi:remove and
+// esi:comment.
+// The fragments are fetched through the gateway chain, so each one is
+// cached following the rules of the mount point serving it. They carry
+// the client request headers (cookies and credentials included).
+// A failing fragment is replaced by the alt one. If that fails too, it is
+// removed if onerror="continue" is set, otherwise the whole response fails.
+// The client conditional, range and Accept-Encoding headers are dropped:
+// the processed documents are built from uncompressed full responses.
+// Sample usage:
+//
+//	middlewares:
+//	  esi:
+//	    enabled: true
+//	    maxDepth: 3
+//	    timeout: 2s
+//	    maxIncludes: 32
+//	    maxSize: 5mb
+type ESIMiddleware struct {
+	middleware.Middleware
+
+	// serves the fragment requests. It is the gateway handler
+	Handler http.Handler
+
+	next http.Handler
+}
+
+func (m *ESIMiddleware) Init(next http.Handler) middleware.Middleware {
+	m.next = next
+	return m
+}
+
+func isFragment(r *http.Request) bool {
+	v, _ := r.Context().Value(fragmentContextKey).(bool)
+	return v
+}
+
+func (m *ESIMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := chaincontext.GetChainContext(r)
+	c := ctx.Conf.Middlewares.ESI
+	if !c.IsEnabled() || r.Method != http.MethodGet || isFragment(r) {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	for _, h := range []string{"Accept-Encoding", "If-None-Match", "If-Modified-Since", "Range", "If-Range"} {
+		r.Header.Del(h)
+	}
+	maxSize, _ := utils.ConvertToBytes(c.MaxSize)
+	rw := &responseWriter{w: w, maxSize: maxSize}
+	m.next.ServeHTTP(rw, r)
+
+	if !rw.buffering {
+		return
+	}
+	if !hasTags(rw.buf.Bytes()) {
+		rw.release()
+		return
+	}
+
+	p := &processor{
+		handler: m.Handler,
+		conf:    c,
+		r:       r,
+		maxSize: maxSize,
+	}
+	out, err := p.process(r.Context(), rw.buf.Bytes(), 0)
+
+	// the validators and the length of the template are not
+	// valid anymore
+	h := w.Header()
+	h.Del("ETag")
+	h.Del("Last-Modified")
+	if err != nil {
+		log.Error().Err(err).Str("uri", r.URL.RequestURI()).Msg("esi processing failed")
+
+		h.Set("Cache-Control", "no-store")
+		h.Set("Content-Length", strconv.Itoa(len(BodyResponseFragmentError)))
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(BodyResponseFragmentError))
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(rw.statusCode)
+	w.Write(out)
+}
+
+// resolves the includes of a client request
+type processor struct {
+	handler http.Handler
+	conf    conf.ESI
+	// the client request
+	r       *http.Request
+	maxSize int64
+	// the includes processed so far, nested ones included
+	includes atomic.Int32
+}
+
+// replaces the esi tags of the document. The includes are fetched
+// concurrently. depth is the nesting level of the document
+func (p *processor) process(ctx context.Context, doc []byte, depth int) ([]byte, error) {
+	nodes := parse(doc)
+	results := make([][]byte, len(nodes))
+	errs := make([]error, len(nodes))
+
+	var wg sync.WaitGroup
+	for idx, n := range nodes {
+		if n.include == nil {
+			results[idx] = n.text
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, inc *include) {
+			defer wg.Done()
+			results[idx], errs[idx] = p.include(ctx, inc, depth+1)
+		}(idx, n.include)
+	}
+	wg.Wait()
+
+	out := bytes.Buffer{}
+	for idx := range nodes {
+		if errs[idx] != nil {
+			return nil, errs[idx]
+		}
+		out.Write(results[idx])
+	}
+	return out.Bytes(), nil
+}
+
+// returns the content of an include, falling back to the alt
+// source and to the onerror policy
+func (p *processor) include(ctx context.Context, inc *include, depth int) ([]byte, error) {
+	body, err := p.fetch(ctx, inc.src, depth)
+	if err != nil && inc.alt != "" {
+		log.Debug().Err(err).Str("include", inc.src).Msg("esi include failed: trying alt")
+		body, err = p.fetch(ctx, inc.alt, depth)
+	}
+	if err == nil {
+		return body, nil
+	}
+	log.Debug().Err(err).Str("include", inc.src).Msg("esi include failed")
+	if inc.continueOnError {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("include '%s': %w", inc.src, err)
+}
+
+// fetches a fragment through the gateway and processes its
+// nested includes
+func (p *processor) fetch(ctx context.Context, src string, depth int) ([]byte, error) {
+	if depth > p.conf.MaxDepth {
+		return nil, errors.New("max depth exceeded")
+	}
+	if p.conf.MaxIncludes > 0 && int(p.includes.Add(1)) > p.conf.MaxIncludes {
+		return nil, errors.New("max includes exceeded")
+	}
+	if p.handler == nil {
+		return nil, errors.New("no fragments handler")
+	}
+
+	u, err := p.r.URL.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	fctx := ctx
+	if p.conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		fctx, cancel = context.WithTimeout(ctx, p.conf.Timeout)
+		defer cancel()
+	}
+
+	r := p.r.Clone(context.WithValue(fctx, fragmentContextKey, true))
+	r.Method = http.MethodGet
+	r.URL = &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	r.RequestURI = r.URL.RequestURI()
+	if u.Host != "" {
+		r.Host = u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		r.TLS = &tls.ConnectionState{}
+	case "http":
+		r.TLS = nil
+	}
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	r.Header.Del("Content-Length")
+
+	rec := &recorder{header: http.Header{}, limit: p.maxSize}
+	if err := serve(p.handler, rec, r); err != nil {
+		return nil, err
+	}
+	if err := fctx.Err(); err != nil {
+		return nil, err
+	}
+	if !rec.wroteHeader {
+		rec.status = http.StatusOK
+	}
+	if rec.status < http.StatusOK || rec.status >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("status %d", rec.status)
+	}
+	if rec.overflow {
+		return nil, fmt.Errorf("fragment larger than %d bytes", p.maxSize)
+	}
+
+	body := rec.body.Bytes()
+	if isHTML(rec.header) && hasTags(body) {
+		return p.process(ctx, body, depth)
+	}
+	return body, nil
+}
+
+// the handlers abort the responses panicking. The http server
+// recovers them, do the same here
+func serve(handler http.Handler, w http.ResponseWriter, r *http.Request) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("request aborted: %v", p)
+		}
+	}()
+	handler.ServeHTTP(w, r)
+	return nil
+}
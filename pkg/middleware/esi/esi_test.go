@@ -0,0 +1,153 @@
+package esi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+func TestParse(t *testing.T) {
+	doc := `<p>a</p><esi:include src="/f?a=1&amp;b=2" alt='/alt' onerror="continue"/>` +
+		`<esi:remove><a href="/f">f</a></esi:remove>` +
+		`<esi:comment text="hidden"/>` +
+		`<esi:include src="/g"></esi:include>` +
+		`<esi:vars>$(HTTP_HOST)</esi:vars><esi:include/>`
+
+	nodes := parse([]byte(doc))
+	got := []string{}
+	for _, n := range nodes {
+		if n.include != nil {
+			got = append(got, fmt.Sprintf("include(%s|%s|%v)", n.include.src, n.include.alt, n.include.continueOnError))
+			continue
+		}
+		got = append(got, string(n.text))
+	}
+	expected := []string{
+		"<p>a</p>",
+		"include(/f?a=1&b=2|/alt|true)",
+		"include(/g||false)",
+		// unsupported and malformed tags are left as they are
+		"<esi:vars>",
+		"$(HTTP_HOST)</esi:vars>",
+		"<esi:include/>",
+	}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected nodes: %v", got)
+	}
+}
+
+// builds a test server with the esi middleware in front of the upstream.
+// The fragments are served by the same upstream
+func buildServer(c conf.ESI, upstream http.Handler) *httptest.Server {
+	m := &ESIMiddleware{Handler: upstream}
+	m.Init(upstream)
+
+	chain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				ESI: c,
+			},
+		}, r)
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	})
+	return httptest.NewServer(chain)
+}
+
+func writeHTML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", `"v1"`)
+	w.Write([]byte(body))
+}
+
+func TestESI(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		writeHTML(w, "hello "+r.Header.Get("X-User"))
+	})
+	mux.HandleFunc("/nested", func(w http.ResponseWriter, r *http.Request) {
+		writeHTML(w, `[<esi:include src="/nested" onerror="continue"/>]`)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		writeHTML(w, "slow")
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/alt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("alt"))
+	})
+	mux.HandleFunc("/page/", func(w http.ResponseWriter, r *http.Request) {
+		writeHTML(w, r.URL.Query().Get("t"))
+	})
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(`<esi:include src="/user"/>`))
+	})
+
+	enabled := true
+	s := buildServer(conf.ESI{
+		Enabled:     &enabled,
+		MaxDepth:    2,
+		Timeout:     100 * time.Millisecond,
+		MaxIncludes: 10,
+	}, mux)
+	defer s.Close()
+
+	tests := []struct {
+		template string
+		status   int
+		body     string
+	}{
+		{`<b><esi:include src="/user"/></b><esi:remove>no esi</esi:remove><esi:comment text="x"/>`, http.StatusOK, "<b>hello bob</b>"},
+		{`<esi:include src="../user"/>`, http.StatusOK, "hello bob"},
+		{`<esi:include src="/fail" alt="/alt"/>`, http.StatusOK, "alt"},
+		{`a<esi:include src="/fail" onerror="continue"/>b`, http.StatusOK, "ab"},
+		{`<esi:include src="/slow" alt="/alt"/>`, http.StatusOK, "alt"},
+		{`<esi:include src="/nested"/>`, http.StatusOK, "[[]]"},
+		{`<esi:include src="/fail"/>`, http.StatusBadGateway, BodyResponseFragmentError},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, s.URL+"/page/?t="+url.QueryEscape(tt.template), nil)
+		req.Header.Set("X-User", "bob")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tt.status || string(body) != tt.body {
+			t.Fatalf("%s: unexpected response %d %q", tt.template, res.StatusCode, body)
+		}
+		if res.Header.Get("ETag") != "" {
+			t.Fatalf("%s: the template etag should be removed", tt.template)
+		}
+	}
+
+	// only html responses are processed
+	res, err := http.Get(s.URL + "/text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != `<esi:include src="/user"/>` {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
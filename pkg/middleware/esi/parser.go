@@ -0,0 +1,123 @@
+package esi
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+)
+
+var (
+	tagOpen   = []byte("<esi:")
+	attrRegex = regexp.MustCompile(`([a-zA-Z_:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// an esi:include tag
+type include struct {
+	src string
+	alt string
+	// the tag is removed silently if both src and alt fail
+	continueOnError bool
+}
+
+// a piece of the parsed document. It is either a literal text or
+// an include
+type node struct {
+	text    []byte
+	include *include
+}
+
+// returns true if the document contains esi tags
+func hasTags(doc []byte) bool {
+	return bytes.Contains(doc, tagOpen)
+}
+
+// splits the document into text and include nodes. The esi:remove
+// and esi:comment tags are dropped. Unsupported and malformed tags
+// are left as they are
+func parse(doc []byte) []node {
+	nodes := []node{}
+	text := func(b []byte) {
+		if len(b) > 0 {
+			nodes = append(nodes, node{text: b})
+		}
+	}
+
+	for {
+		idx := bytes.Index(doc, tagOpen)
+		if idx < 0 {
+			text(doc)
+			return nodes
+		}
+		text(doc[:idx])
+		doc = doc[idx:]
+
+		name := tagName(doc[len(tagOpen):])
+		end := bytes.IndexByte(doc, '>')
+		if end < 0 {
+			text(doc)
+			return nodes
+		}
+		selfClosing := doc[end-1] == '/'
+
+		switch name {
+		case "remove":
+			// the content is shown by the clients not supporting esi only
+			closing := bytes.Index(doc, []byte("</esi:remove>"))
+			if closing < 0 {
+				text(doc)
+				return nodes
+			}
+			doc = doc[closing+len("</esi:remove>"):]
+		case "comment":
+			doc = skipClosing(doc[end+1:], "comment", selfClosing)
+		case "include":
+			attrs := parseAttrs(doc[len(tagOpen)+len(name) : end])
+			if attrs["src"] == "" {
+				text(doc[:end+1])
+				doc = doc[end+1:]
+				continue
+			}
+			nodes = append(nodes, node{include: &include{
+				src:             attrs["src"],
+				alt:             attrs["alt"],
+				continueOnError: attrs["onerror"] == "continue",
+			}})
+			doc = skipClosing(doc[end+1:], "include", selfClosing)
+		default:
+			text(doc[:end+1])
+			doc = doc[end+1:]
+		}
+	}
+}
+
+func tagName(b []byte) string {
+	end := 0
+	for end < len(b) && (b[end] >= 'a' && b[end] <= 'z') {
+		end++
+	}
+	return string(b[:end])
+}
+
+// skips the closing tag of a non self-closing element
+func skipClosing(doc []byte, name string, selfClosing bool) []byte {
+	if selfClosing {
+		return doc
+	}
+	closing := []byte("</esi:" + name + ">")
+	if idx := bytes.Index(doc, closing); idx >= 0 {
+		return doc[idx+len(closing):]
+	}
+	return doc
+}
+
+func parseAttrs(b []byte) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrRegex.FindAllSubmatch(b, -1) {
+		v := m[2]
+		if len(m[3]) > 0 {
+			v = m[3]
+		}
+		attrs[string(m[1])] = html.UnescapeString(string(v))
+	}
+	return attrs
+}
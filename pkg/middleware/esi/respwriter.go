@@ -0,0 +1,165 @@
+package esi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// returns true if the response is an uncompressed html document
+func isHTML(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType != "text/html" {
+		return false
+	}
+	ce := header.Get("Content-Encoding")
+	return ce == "" || ce == "identity"
+}
+
+// buffers the html responses, so they can be processed. Other
+// responses are forwarded as they are
+type responseWriter struct {
+	w http.ResponseWriter
+
+	statusCode  int
+	wroteHeader bool
+	// the response is held into the buffer
+	buffering bool
+	buf       bytes.Buffer
+	// larger responses are forwarded without processing them. Values
+	// lesser or equal to 0 disable the limit
+	maxSize int64
+}
+
+func (rw *responseWriter) processable(statusCode int) bool {
+	if statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		return false
+	}
+	if !isHTML(rw.w.Header()) {
+		return false
+	}
+	if rw.maxSize <= 0 {
+		return true
+	}
+	cl, err := strconv.ParseInt(rw.w.Header().Get("Content-Length"), 10, 64)
+	return err != nil || cl <= rw.maxSize
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	// the informational responses are forwarded
+	if statusCode < http.StatusOK {
+		rw.w.WriteHeader(statusCode)
+		return
+	}
+	if rw.wroteHeader {
+		return
+	}
+	rw.statusCode = statusCode
+	rw.wroteHeader = true
+	if rw.processable(statusCode) {
+		rw.buffering = true
+		return
+	}
+	rw.w.WriteHeader(statusCode)
+}
+
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.buffering {
+		return rw.w.Write(data)
+	}
+	// the limit was crossed mid-stream
+	if rw.maxSize > 0 && int64(rw.buf.Len()+len(data)) > rw.maxSize {
+		rw.release()
+		return rw.w.Write(data)
+	}
+	return rw.buf.Write(data)
+}
+
+// forwards the buffered response without processing it
+func (rw *responseWriter) release() {
+	if !rw.buffering {
+		return
+	}
+	rw.buffering = false
+	rw.w.WriteHeader(rw.statusCode)
+	rw.w.Write(rw.buf.Bytes())
+	rw.buf.Reset()
+}
+
+// the buffered responses are not flushed: they are sent at once
+// after processing
+func (rw *responseWriter) Flush() {
+	if rw.buffering {
+		return
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	return h.Hijack()
+}
+
+// allows the http.ResponseController to reach the underlying
+// response writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// captures a fragment response up to limit bytes. Values lesser
+// or equal to 0 disable the limit
+type recorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+
+	limit    int64
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(statusCode int) {
+	if r.wroteHeader || statusCode < http.StatusOK {
+		return
+	}
+	r.status = statusCode
+	r.wroteHeader = true
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.overflow {
+		return len(data), nil
+	}
+	if r.limit > 0 && int64(r.body.Len()+len(data)) > r.limit {
+		r.overflow = true
+		r.body.Reset()
+		return len(data), nil
+	}
+	return r.body.Write(data)
+}
+
+// the streaming responses flush
+func (r *recorder) Flush() {}
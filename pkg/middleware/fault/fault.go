@@ -0,0 +1,99 @@
+package fault
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/middleware"
+)
+
+const BodyResponseAbort = "crauti: fault injected\n"
+
+// Injects synthetic delays and errors for resilience testing. The
+// upstream is never touched: an aborted request doesn't reach it and
+// a delayed one reaches it late.
+// Sample usage:
+//
+//	middlewares:
+//	  faultInjection:
+//	    enabled: true
+//	    header: X-Crauti-Fault
+//	    delay:
+//	      percentage: 50
+//	      duration: 100ms
+//	      maxDuration: 2s
+//	    abort:
+//	      percentage: 10
+//	      status: 503
+type FaultInjectionMiddleware struct {
+	middleware.Middleware
+
+	next http.Handler
+}
+
+func (m *FaultInjectionMiddleware) Init(next http.Handler) middleware.Middleware {
+	m.next = next
+	return m
+}
+
+// returns true with the given probability (expressed in percentage)
+func (m *FaultInjectionMiddleware) hit(percentage float64) bool {
+	if percentage <= 0 {
+		return false
+	}
+	return rand.Float64()*100 < percentage
+}
+
+func (m *FaultInjectionMiddleware) delay(c conf.FaultInjection) time.Duration {
+	d := c.Delay.Duration
+	if c.Delay.MaxDuration > d {
+		d += time.Duration(rand.Int63n(int64(c.Delay.MaxDuration - d)))
+	}
+	return d
+}
+
+func (m *FaultInjectionMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := chaincontext.GetChainContext(r)
+	c := ctx.Conf.Middlewares.FaultInjection
+	if !c.IsEnabled() {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	// apply faults to marked requests only
+	if c.Header != "" {
+		if r.Header.Get(c.Header) == "" {
+			m.next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(c.Header)
+	}
+
+	if m.hit(c.Delay.Percentage) {
+		d := m.delay(c)
+		ctx.Fault.Delay = d
+
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+	}
+
+	if m.hit(c.Abort.Percentage) {
+		status := c.Abort.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		ctx.Fault.AbortStatus = status
+		w.WriteHeader(status)
+		w.Write([]byte(BodyResponseAbort))
+		return
+	}
+
+	m.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,112 @@
+package fault
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+func buildServer(c conf.FaultInjection) *httptest.Server {
+	root := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Crauti-Fault") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("done"))
+	})
+	m := &FaultInjectionMiddleware{
+		next: root,
+	}
+	chain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "https://httpbin.org/get",
+			Middlewares: conf.Middlewares{
+				FaultInjection: c,
+			},
+		}, r)
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	})
+	return httptest.NewServer(chain)
+}
+
+func TestNotMarked(t *testing.T) {
+	enabled := true
+	c := conf.FaultInjection{
+		Enabled: &enabled,
+		Header:  "X-Crauti-Fault",
+	}
+	c.Abort.Percentage = 100
+	s := buildServer(c)
+	defer s.Close()
+
+	// not marked: the request must not be touched
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+}
+
+func TestAbortMarked(t *testing.T) {
+	enabled := true
+	c := conf.FaultInjection{
+		Enabled: &enabled,
+		Header:  "X-Crauti-Fault",
+	}
+	c.Abort.Percentage = 100
+	c.Abort.Status = http.StatusTeapot
+	s := buildServer(c)
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Header.Set("X-Crauti-Fault", "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusTeapot {
+		t.Fatalf("expected 418, got %d", res.StatusCode)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != BodyResponseAbort {
+		t.Fatalf("expected '%s', got '%s'", BodyResponseAbort, body)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	enabled := true
+	c := conf.FaultInjection{
+		Enabled: &enabled,
+		Header:  "X-Crauti-Fault",
+	}
+	c.Delay.Percentage = 100
+	c.Delay.Duration = 200 * time.Millisecond
+	s := buildServer(c)
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Header.Set("X-Crauti-Fault", "1")
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < c.Delay.Duration {
+		t.Fatal("expected delayed response")
+	}
+	// the trigger header must be stripped before reaching the upstream
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+}
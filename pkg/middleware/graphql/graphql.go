@@ -0,0 +1,242 @@
+package graphql
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/logger"
+	"github.com/ferama/crauti/pkg/middleware"
+	"github.com/ferama/crauti/pkg/store"
+	"github.com/rs/zerolog"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/formatter"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+const (
+	// bounds the parsing cost of the documents
+	maxTokens = 15000
+
+	// the store key head of the persisted queries
+	persistedQueryKeyHead = "GQLPQ"
+
+	// the error codes
+	CodeBadRequest             = "BAD_REQUEST"
+	CodeParseFailed            = "GRAPHQL_PARSE_FAILED"
+	CodeValidationFailed       = "GRAPHQL_VALIDATION_FAILED"
+	CodeMaxDepth               = "MAX_DEPTH_EXCEEDED"
+	CodeMaxComplexity          = "MAX_COMPLEXITY_EXCEEDED"
+	CodeMaxAliases             = "MAX_ALIASES_EXCEEDED"
+	CodePersistedQueryNotFound = "PERSISTED_QUERY_NOT_FOUND"
+	CodePersistedQueryMismatch = "PERSISTED_QUERY_HASH_MISMATCH"
+)
+
+var log *zerolog.Logger
+
+func init() {
+	log = logger.GetLogger("graphql")
+}
+
+// Inspects the GraphQL requests (GET, POST with json or application/graphql
+// body). The operations exceeding the configured limits are rejected with
+// GraphQL error responses, and the query operations are marked as
+// cacheable into the chain context (see the cache middleware).
+// Batched requests are checked against the limits but never cached.
+// Sample usage:
+//
+//	middlewares:
+//	  graphql:
+//	    enabled: true
+//	    maxDepth: 10
+//	    maxComplexity: 500
+//	    maxAliases: 30
+//	    persistedQueries: true
+//	    persistedQueryTTL: 24h
+type GraphQLMiddleware struct {
+	middleware.Middleware
+
+	next http.Handler
+}
+
+func (m *GraphQLMiddleware) Init(next http.Handler) middleware.Middleware {
+	m.next = next
+	return m
+}
+
+// a GraphQL error. It is returned to the client into the errors list
+type gqlError struct {
+	status  int
+	code    string
+	message string
+}
+
+func newError(status int, code string, format string, args ...any) *gqlError {
+	return &gqlError{
+		status:  status,
+		code:    code,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+func writeError(w http.ResponseWriter, e *gqlError) {
+	type gqlErrorExtensions struct {
+		Code string `json:"code"`
+	}
+	type gqlErrorBody struct {
+		Message    string             `json:"message"`
+		Extensions gqlErrorExtensions `json:"extensions"`
+	}
+	body, _ := json.Marshal(map[string][]gqlErrorBody{
+		"errors": {{Message: e.message, Extensions: gqlErrorExtensions{Code: e.code}}},
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(e.status)
+	w.Write(body)
+}
+
+func (m *GraphQLMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := chaincontext.GetChainContext(r)
+	c := ctx.Conf.Middlewares.GraphQL
+	if !c.IsEnabled() {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	reqs, err := readRequests(r)
+	if err != nil {
+		writeError(w, newError(http.StatusBadRequest, CodeBadRequest, "invalid request: %s", err))
+		return
+	}
+
+	if len(reqs) == 1 {
+		if gerr := m.inspect(r, &reqs[0], c); gerr != nil {
+			writeError(w, gerr)
+			return
+		}
+	} else {
+		for idx := range reqs {
+			if reqs[idx].Query == "" {
+				continue
+			}
+			if _, gerr := check(r, &reqs[idx], c); gerr != nil {
+				writeError(w, gerr)
+				return
+			}
+		}
+	}
+	m.next.ServeHTTP(w, r)
+}
+
+// inspects a single operation request and sets the chain context
+func (m *GraphQLMiddleware) inspect(r *http.Request, req *request, c conf.GraphQL) *gqlError {
+	hash := req.hash()
+	persisted := c.IsPersistedQueries() && hash != ""
+
+	if req.Query == "" {
+		// without the persisted queries support the hash only
+		// requests are up to the upstream
+		if !persisted {
+			return nil
+		}
+		query, err := store.Instance().Get(buildStoreKey(persistedQueryKeyHead, hash))
+		if err != nil {
+			// the clients retry sending the full query
+			return newError(http.StatusOK, CodePersistedQueryNotFound, "PersistedQueryNotFound")
+		}
+		req.Query = string(query)
+		if err := injectQuery(r, req.Query); err != nil {
+			return newError(http.StatusBadRequest, CodeBadRequest, "invalid request: %s", err)
+		}
+	} else if persisted {
+		sum := sha256.Sum256([]byte(req.Query))
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), hash) {
+			return newError(http.StatusBadRequest, CodePersistedQueryMismatch, "provided sha does not match query")
+		}
+	}
+
+	doc, gerr := check(r, req, c)
+	if gerr != nil {
+		return gerr
+	}
+	if persisted {
+		err := store.Instance().Set(buildStoreKey(persistedQueryKeyHead, hash), []byte(req.Query), c.PersistedQueryTTL)
+		if err != nil {
+			log.Error().Err(err).Str("hash", hash).Msg("unable to store the persisted query")
+		}
+	}
+
+	op := doc.Operations.ForName(req.OperationName)
+	ctx := chaincontext.GetChainContext(r)
+	ctx.GraphQL.Operation = string(op.Operation)
+	ctx.GraphQL.OperationName = op.Name
+	ctx.GraphQL.Key = operationKey(doc, req)
+	return nil
+}
+
+// parses the query and checks it against the limits
+func check(r *http.Request, req *request, c conf.GraphQL) (*ast.QueryDocument, *gqlError) {
+	doc, err := parser.ParseQueryWithTokenLimit(&ast.Source{Input: req.Query}, maxTokens)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, CodeParseFailed, "%s", err)
+	}
+	op := doc.Operations.ForName(req.OperationName)
+	if op == nil {
+		if req.OperationName == "" {
+			return nil, newError(http.StatusBadRequest, CodeValidationFailed, "operationName is required")
+		}
+		return nil, newError(http.StatusBadRequest, CodeValidationFailed, "unknown operation \"%s\"", req.OperationName)
+	}
+	// GET requests can be cached by anyone: they must be safe
+	if r.Method == http.MethodGet && op.Operation != ast.Query {
+		return nil, newError(http.StatusMethodNotAllowed, CodeBadRequest, "%s operations are not allowed over GET", op.Operation)
+	}
+
+	cost, err := measure(doc, op)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, CodeValidationFailed, "%s", err)
+	}
+	if c.MaxDepth > 0 && cost.depth > c.MaxDepth {
+		return nil, newError(http.StatusBadRequest, CodeMaxDepth, "query depth %d exceeds the limit of %d", cost.depth, c.MaxDepth)
+	}
+	if c.MaxComplexity > 0 && cost.complexity > c.MaxComplexity {
+		return nil, newError(http.StatusBadRequest, CodeMaxComplexity, "query complexity %d exceeds the limit of %d", cost.complexity, c.MaxComplexity)
+	}
+	if c.MaxAliases > 0 && cost.aliases > c.MaxAliases {
+		return nil, newError(http.StatusBadRequest, CodeMaxAliases, "query aliases %d exceed the limit of %d", cost.aliases, c.MaxAliases)
+	}
+	return doc, nil
+}
+
+// identifies the operation. The document is normalized (formatting
+// and comments don't matter) and so are the variables (key order)
+func operationKey(doc *ast.QueryDocument, req *request) string {
+	normalized := strings.Builder{}
+	formatter.NewFormatter(&normalized).FormatQueryDocument(doc)
+
+	variables := []byte("null")
+	var v any
+	// keep the numbers as they are: large integers would lose
+	// precision as float64
+	dec := json.NewDecoder(bytes.NewReader(req.Variables))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err == nil {
+		// maps are marshalled with sorted keys
+		variables, _ = json.Marshal(v)
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s", req.OperationName, normalized.String(), variables)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func buildStoreKey(keyHead string, key string) string {
+	return fmt.Sprintf("%s:%s", keyHead, key)
+}
@@ -0,0 +1,245 @@
+package graphql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/store"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+func init() {
+	conf.ConfInst.CacheStore.Backend = store.BackendMemory
+	store.Update()
+}
+
+func TestMeasure(t *testing.T) {
+	tests := []struct {
+		query string
+		cost  cost
+		err   bool
+	}{
+		{`{ a { b c } }`, cost{depth: 2, complexity: 3}, false},
+		{`{ x: a { b } y: a { b } a }`, cost{depth: 2, complexity: 5, aliases: 2}, false},
+		{`{ a { ...F ... on T { d { e } } } } fragment F on T { b { c } }`, cost{depth: 3, complexity: 5}, false},
+		// each spread counts
+		{`{ ...F ...F } fragment F on Q { a b }`, cost{depth: 1, complexity: 4}, false},
+		{`{ ...F } fragment F on Q { a { ...F } }`, cost{}, true},
+		{`{ ...Missing }`, cost{}, true},
+	}
+	for _, tt := range tests {
+		doc, err := parser.ParseQuery(&ast.Source{Input: tt.query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := measure(doc, doc.Operations[0])
+		if tt.err != (err != nil) {
+			t.Fatalf("%s: unexpected error %v", tt.query, err)
+		}
+		if err == nil && got != tt.cost {
+			t.Fatalf("%s: got %+v", tt.query, got)
+		}
+	}
+
+	// a fragment bomb is measured in linear time
+	doc, _ := parser.ParseQuery(&ast.Source{Input: bomb(50)})
+	got, err := measure(doc, doc.Operations[0])
+	if err != nil || got.complexity != maxCost {
+		t.Fatalf("unexpected bomb cost %+v %v", got, err)
+	}
+}
+
+// each fragment spreads the previous one twice
+func bomb(levels int) string {
+	name := func(i int) string { return "F" + strings.Repeat("x", i) }
+	query := "{ ..." + name(levels) + " } fragment " + name(0) + " on Q { a }"
+	for i := 1; i <= levels; i++ {
+		query += " fragment " + name(i) + " on Q { ..." + name(i-1) + " x: a { ..." + name(i-1) + " } }"
+	}
+	return query
+}
+
+type result struct {
+	status int
+	body   string
+	// the context seen by the upstream
+	graphql chaincontext.GraphQLContext
+	// the body received by the upstream
+	upstreamBody string
+}
+
+func buildServer(c conf.GraphQL, res *result) *httptest.Server {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res.graphql = *chaincontext.GetChainContext(r).GraphQL
+		body, _ := io.ReadAll(r.Body)
+		res.upstreamBody = string(body)
+		if r.Method == http.MethodGet {
+			res.upstreamBody = r.URL.Query().Get("query")
+		}
+		w.Write([]byte(`{"data":{}}`))
+	})
+	m := (&GraphQLMiddleware{}).Init(upstream)
+
+	chain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				GraphQL: c,
+			},
+		}, r)
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	})
+	return httptest.NewServer(chain)
+}
+
+func post(t *testing.T, s *httptest.Server, res *result, body string) {
+	*res = result{}
+	r, err := http.Post(s.URL+"/graphql", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r.Body)
+	r.Body.Close()
+	res.status = r.StatusCode
+	res.body = string(b)
+}
+
+func errorCode(body string) string {
+	data := struct {
+		Errors []struct {
+			Extensions struct {
+				Code string `json:"code"`
+			} `json:"extensions"`
+		} `json:"errors"`
+	}{}
+	json.Unmarshal([]byte(body), &data)
+	if len(data.Errors) == 0 {
+		return ""
+	}
+	return data.Errors[0].Extensions.Code
+}
+
+func TestMiddleware(t *testing.T) {
+	enabled := true
+	res := &result{}
+	s := buildServer(conf.GraphQL{
+		Enabled:          &enabled,
+		MaxDepth:         3,
+		MaxComplexity:    10,
+		MaxAliases:       1,
+		PersistedQueries: &enabled,
+	}, res)
+	defer s.Close()
+
+	tests := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"query": "{ a { b } }"}`, http.StatusOK, ""},
+		{`{"query": "{ a { b { c { d } } } }"}`, http.StatusBadRequest, CodeMaxDepth},
+		{`{"query": "{ a b c d e f g h i j k }"}`, http.StatusBadRequest, CodeMaxComplexity},
+		{`{"query": "{ x: a y: a }"}`, http.StatusBadRequest, CodeMaxAliases},
+		{`{"query": "{ a "}`, http.StatusBadRequest, CodeParseFailed},
+		{`{"query": "query A { a } query B { b }"}`, http.StatusBadRequest, CodeValidationFailed},
+		{`{"query": "query A { a } query B { b }", "operationName": "B"}`, http.StatusOK, ""},
+		{`{"query": "mutation { a }"}`, http.StatusOK, ""},
+		{`[{"query": "{ a }"}, {"query": "{ x: a y: a }"}]`, http.StatusBadRequest, CodeMaxAliases},
+		{`not json`, http.StatusBadRequest, CodeBadRequest},
+	}
+	for _, tt := range tests {
+		post(t, s, res, tt.body)
+		if res.status != tt.status || errorCode(res.body) != tt.code {
+			t.Fatalf("%s: unexpected response %d %s", tt.body, res.status, res.body)
+		}
+	}
+
+	post(t, s, res, `{"query": "mutation M { a }"}`)
+	if res.graphql.Operation != "mutation" || res.graphql.OperationName != "M" || res.graphql.Cacheable() {
+		t.Fatalf("unexpected context %+v", res.graphql)
+	}
+
+	// the normalized query and the variables identify the operation
+	post(t, s, res, `{"query": "query Q($id: ID) { a(id: $id) { b } }", "variables": {"id": 1, "x": 2}}`)
+	key := res.graphql.Key
+	post(t, s, res, `{"query": "query Q($id: ID) {\n  # comment\n  a(id: $id) {\n    b\n  }\n}", "variables": {"x": 2, "id": 1}}`)
+	if !res.graphql.Cacheable() || res.graphql.Key != key {
+		t.Fatal("the same key is expected for the same operation")
+	}
+	post(t, s, res, `{"query": "query Q($id: ID) { a(id: $id) { b } }", "variables": {"id": 2, "x": 2}}`)
+	if res.graphql.Key == key {
+		t.Fatal("a different key is expected for different variables")
+	}
+
+	// mutations are not allowed over GET
+	r, _ := http.Get(s.URL + "/graphql?query=" + url.QueryEscape("mutation { a }"))
+	r.Body.Close()
+	if r.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d", r.StatusCode)
+	}
+}
+
+func TestPersistedQueries(t *testing.T) {
+	enabled := true
+	res := &result{}
+	s := buildServer(conf.GraphQL{
+		Enabled:           &enabled,
+		PersistedQueries:  &enabled,
+		PersistedQueryTTL: time.Hour,
+	}, res)
+	defer s.Close()
+
+	query := "{ persisted }"
+	sum := sha256.Sum256([]byte(query))
+	hash := hex.EncodeToString(sum[:])
+	ext := `"extensions": {"persistedQuery": {"version": 1, "sha256Hash": "` + hash + `"}}`
+
+	post(t, s, res, `{`+ext+`}`)
+	if res.status != http.StatusOK || errorCode(res.body) != CodePersistedQueryNotFound {
+		t.Fatalf("unexpected response %d %s", res.status, res.body)
+	}
+
+	post(t, s, res, `{"query": "{ other }", `+ext+`}`)
+	if errorCode(res.body) != CodePersistedQueryMismatch {
+		t.Fatalf("unexpected response %d %s", res.status, res.body)
+	}
+
+	// registers the query
+	post(t, s, res, `{"query": "`+query+`", `+ext+`}`)
+	if res.status != http.StatusOK || errorCode(res.body) != "" {
+		t.Fatalf("unexpected response %d %s", res.status, res.body)
+	}
+	key := res.graphql.Key
+
+	post(t, s, res, `{`+ext+`}`)
+	if res.status != http.StatusOK || res.graphql.Key != key {
+		t.Fatalf("unexpected response %d %s", res.status, res.body)
+	}
+	// the upstream gets the query
+	if !strings.Contains(res.upstreamBody, `"query":"{ persisted }"`) {
+		t.Fatalf("unexpected upstream body %s", res.upstreamBody)
+	}
+
+	r, err := http.Get(s.URL + "/graphql?extensions=" + url.QueryEscape(`{"persistedQuery": {"version": 1, "sha256Hash": "`+hash+`"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK || res.upstreamBody != query {
+		t.Fatalf("unexpected response %d, upstream query %s", r.StatusCode, res.upstreamBody)
+	}
+}
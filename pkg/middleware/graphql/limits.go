@@ -0,0 +1,109 @@
+package graphql
+
+import (
+	"fmt"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// the measures saturate at this value. A fragment spread doubling at
+// each level would overflow them otherwise
+const maxCost = 1 << 30
+
+func saturate(v int) int {
+	if v > maxCost {
+		return maxCost
+	}
+	return v
+}
+
+// the measures of a selection set
+type cost struct {
+	depth int
+	// the number of selected fields
+	complexity int
+	aliases    int
+}
+
+func (c *cost) add(other cost) {
+	c.complexity = saturate(c.complexity + other.complexity)
+	c.aliases = saturate(c.aliases + other.aliases)
+	if other.depth > c.depth {
+		c.depth = other.depth
+	}
+}
+
+// measures the operations. The fragments are measured once and
+// their cost is reused by each spread, so fragment bombs can't
+// blow up the computation
+type measurer struct {
+	doc *ast.QueryDocument
+	// the measured fragments
+	fragments map[string]cost
+	// the fragments being measured. Used to detect cycles
+	visiting map[string]bool
+}
+
+func measure(doc *ast.QueryDocument, op *ast.OperationDefinition) (cost, error) {
+	m := &measurer{
+		doc:       doc,
+		fragments: make(map[string]cost),
+		visiting:  make(map[string]bool),
+	}
+	return m.selectionSet(op.SelectionSet)
+}
+
+// the depth of a selection set is the one of its deepest field
+func (m *measurer) selectionSet(set ast.SelectionSet) (cost, error) {
+	out := cost{}
+	for _, sel := range set {
+		switch s := sel.(type) {
+		case *ast.Field:
+			c, err := m.selectionSet(s.SelectionSet)
+			if err != nil {
+				return out, err
+			}
+			c.depth++
+			c.complexity++
+			if s.Alias != "" && s.Alias != s.Name {
+				c.aliases++
+			}
+			out.add(c)
+		case *ast.InlineFragment:
+			c, err := m.selectionSet(s.SelectionSet)
+			if err != nil {
+				return out, err
+			}
+			out.add(c)
+		case *ast.FragmentSpread:
+			c, err := m.fragment(s.Name)
+			if err != nil {
+				return out, err
+			}
+			out.add(c)
+		}
+	}
+	return out, nil
+}
+
+func (m *measurer) fragment(name string) (cost, error) {
+	if c, ok := m.fragments[name]; ok {
+		return c, nil
+	}
+	if m.visiting[name] {
+		return cost{}, fmt.Errorf("cannot spread fragment \"%s\" within itself", name)
+	}
+	def := m.doc.Fragments.ForName(name)
+	if def == nil {
+		return cost{}, fmt.Errorf("unknown fragment \"%s\"", name)
+	}
+
+	m.visiting[name] = true
+	c, err := m.selectionSet(def.SelectionSet)
+	delete(m.visiting, name)
+	if err != nil {
+		return c, err
+	}
+	m.fragments[name] = c
+	return c, nil
+}
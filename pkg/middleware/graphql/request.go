@@ -0,0 +1,127 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+type persistedQuery struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+type extensions struct {
+	PersistedQuery *persistedQuery `json:"persistedQuery,omitempty"`
+}
+
+// a GraphQL over HTTP request
+type request struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+	Extensions    extensions      `json:"extensions"`
+}
+
+// the hash of the automatic persisted query, if any
+func (req *request) hash() string {
+	if req.Extensions.PersistedQuery == nil {
+		return ""
+	}
+	return req.Extensions.PersistedQuery.Sha256Hash
+}
+
+// reads the GraphQL requests. The POST body is restored, so it can be
+// forwarded to the upstream. Batched requests return more than one item
+func readRequests(r *http.Request) ([]request, error) {
+	if r.Method == http.MethodGet {
+		req, err := queryRequest(r.URL.Query())
+		if err != nil {
+			return nil, err
+		}
+		return []request{req}, nil
+	}
+	if r.Method != http.MethodPost || r.Body == nil {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	setBody(r, body)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/graphql" {
+		return []request{{Query: string(body)}}, nil
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		reqs := []request{}
+		err = json.Unmarshal(body, &reqs)
+		return reqs, err
+	}
+	req := request{}
+	err = json.Unmarshal(body, &req)
+	return []request{req}, err
+}
+
+func queryRequest(values url.Values) (request, error) {
+	req := request{
+		Query:         values.Get("query"),
+		OperationName: values.Get("operationName"),
+	}
+	if v := values.Get("variables"); v != "" {
+		if !json.Valid([]byte(v)) {
+			return req, errors.New("invalid variables")
+		}
+		req.Variables = json.RawMessage(v)
+	}
+	if v := values.Get("extensions"); v != "" {
+		if err := json.Unmarshal([]byte(v), &req.Extensions); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// replaces the request body. The body can be read again using GetBody
+func setBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+}
+
+// adds the query to a request sending the persisted query hash only, so
+// the upstream doesn't need to know it
+func injectQuery(r *http.Request, query string) error {
+	if r.Method == http.MethodGet {
+		values := r.URL.Query()
+		values.Set("query", query)
+		r.URL.RawQuery = values.Encode()
+		return nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+	fields["query"], _ = json.Marshal(query)
+	if body, err = json.Marshal(fields); err != nil {
+		return err
+	}
+	setBody(r, body)
+	return nil
+}
@@ -0,0 +1,375 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/logger"
+	"github.com/ferama/crauti/pkg/middleware"
+	"github.com/rs/zerolog"
+)
+
+// how long a login can take
+const loginTTL = 10 * time.Minute
+
+var log *zerolog.Logger
+
+func init() {
+	log = logger.GetLogger("oidc")
+}
+
+// the state of a login in progress. Kept into an encrypted cookie
+// until the callback
+type loginState struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	// where the browser goes once logged in
+	RedirectTo string `json:"redirectTo"`
+}
+
+// Makes the gateway an OpenID Connect relying party. The unauthenticated
+// browsers are redirected to the identity provider (authorization code
+// flow with PKCE) and the session is kept into encrypted cookies or into
+// redis. The id token claims populate the chain context auth, like the
+// jwt auth middleware does: the claims based cache keys and the
+// identity forwarding work the same way. Sample usage:
+//
+//	middlewares:
+//	  oidc:
+//	    enabled: true
+//	    issuer: https://keycloak.url/realms/test
+//	    clientID: dashboard
+//	    clientSecret: secret
+//	    cookieSecret: a-long-random-string
+//	    sessionStore: redis
+//
+// The requests carrying a bearer token are left to the jwt auth
+// middleware, if it is enabled. The unauthenticated requests not
+// accepting html get a 401 instead of the redirect
+type OIDCMiddleware struct {
+	middleware.Middleware
+
+	next http.Handler
+
+	// the discovered providers, by issuer
+	providers map[string]*provider
+	mu        sync.Mutex
+}
+
+func (m *OIDCMiddleware) Init(next http.Handler) middleware.Middleware {
+	m.next = next
+
+	m.providers = make(map[string]*provider)
+	return m
+}
+
+// discovers the provider once. The failures are not cached: the next
+// request will try again
+func (m *OIDCMiddleware) getProvider(issuer string) (*provider, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.providers[issuer]; ok {
+		return p, nil
+	}
+	p, err := discover(issuer)
+	if err != nil {
+		return nil, err
+	}
+	m.providers[issuer] = p
+	return p, nil
+}
+
+// the per request state
+type flow struct {
+	conf      conf.OIDC
+	mountPath string
+	// the absolute redirect uri
+	redirectURI string
+	store       sessionStore
+	// the login state cookie
+	login *cookieJar
+}
+
+func newFlow(r *http.Request, mp *conf.MountPoint) *flow {
+	c := mp.Middlewares.OIDC
+	// the client supplied X-Forwarded-Proto is not trusted
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	mountPath := mp.Path
+	if mountPath == "" {
+		mountPath = "/"
+	}
+	callbackPath := path.Join(mountPath, c.CallbackPath)
+	s := newSealer(c.CookieSecret)
+
+	f := &flow{
+		conf:        c,
+		mountPath:   mountPath,
+		redirectURI: scheme + "://" + r.Host + callbackPath,
+		login: &cookieJar{
+			name:   c.CookieName + "_login",
+			path:   callbackPath,
+			secure: scheme == "https",
+			sealer: s,
+		},
+	}
+	jar := &cookieJar{
+		name:   c.CookieName,
+		path:   mountPath,
+		secure: scheme == "https",
+		sealer: s,
+	}
+	if c.SessionStore == SessionStoreRedis {
+		f.store = &redisStore{jar: jar}
+	} else {
+		f.store = &cookieStore{jar: jar}
+	}
+	return f
+}
+
+func (f *flow) isCallback(r *http.Request) bool {
+	return r.URL.Path == path.Join(f.mountPath, f.conf.CallbackPath)
+}
+
+func (f *flow) isLogout(r *http.Request) bool {
+	return r.URL.Path == path.Join(f.mountPath, f.conf.LogoutPath)
+}
+
+func errorResponse(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", message)
+}
+
+func redirect(w http.ResponseWriter, location string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusFound)
+}
+
+func (m *OIDCMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := chaincontext.GetChainContext(r)
+	c := ctx.Conf.Middlewares.OIDC
+	// ignore http options method
+	if !c.IsEnabled() || r.Method == http.MethodOptions {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	f := newFlow(r, ctx.Conf)
+	switch {
+	case f.isCallback(r):
+		m.callback(w, r, f)
+		return
+	case f.isLogout(r):
+		m.logout(w, r, f)
+		return
+	}
+
+	// the api clients
+	auth := r.Header.Get("Authorization")
+	if ctx.Conf.Middlewares.JwksURL != "" && strings.HasPrefix(strings.ToLower(auth), "bearer ") {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	s, err := f.store.load(r)
+	if err == nil && time.Now().After(s.Expires) {
+		err = errNoSession
+	}
+	if err == nil && s.needsRefresh(time.Now()) {
+		err = m.refresh(w, r, f, s)
+	}
+	if err != nil {
+		if err != errNoSession {
+			log.Debug().Err(err).Str("path", r.URL.Path).Msg("invalid session")
+		}
+		m.login(w, r, f)
+		return
+	}
+
+	ctx.Auth.Authorized = true
+	ctx.Auth.JwtClaims = s.Claims
+	if c.IsPassAccessToken() {
+		r.Header.Set("Authorization", "Bearer "+s.AccessToken)
+	}
+	m.next.ServeHTTP(w, r)
+}
+
+// refreshes the tokens and saves the session
+func (m *OIDCMiddleware) refresh(w http.ResponseWriter, r *http.Request, f *flow, s *session) error {
+	if s.RefreshToken == "" {
+		return errNoSession
+	}
+	p, err := m.getProvider(f.conf.Issuer)
+	if err != nil {
+		return err
+	}
+	t, err := p.refresh(f.conf, s.RefreshToken)
+	if err != nil {
+		return err
+	}
+	if t.IDToken != "" {
+		claims, err := p.verify(f.conf, t.IDToken, "")
+		if err != nil {
+			return err
+		}
+		s.Claims = claims
+		s.IDToken = t.IDToken
+	}
+	s.AccessToken = t.AccessToken
+	// the refresh tokens may not be rotated
+	if t.RefreshToken != "" {
+		s.RefreshToken = t.RefreshToken
+	}
+	s.Expiry = expiry(t, s.Claims)
+	return f.store.save(w, r, s, false)
+}
+
+// the access token expiration. The id token one is used if the
+// provider doesn't tell
+func expiry(t *tokens, claims map[string]any) time.Time {
+	if t.ExpiresIn > 0 {
+		return time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0)
+	}
+	return time.Time{}
+}
+
+// starts the authorization code flow
+func (m *OIDCMiddleware) login(w http.ResponseWriter, r *http.Request, f *flow) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		!strings.Contains(r.Header.Get("Accept"), "text/html") {
+		errorResponse(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	p, err := m.getProvider(f.conf.Issuer)
+	if err != nil {
+		log.Err(err).Str("issuer", f.conf.Issuer).Msg("unable to discover the identity provider")
+		errorResponse(w, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+
+	state := loginState{
+		State:      randomString(),
+		Verifier:   randomString(),
+		Nonce:      randomString(),
+		RedirectTo: r.URL.RequestURI(),
+	}
+	data, _ := json.Marshal(state)
+	err = f.login.write(w, r, f.login.sealer.seal(f.login.name, data), int(loginTTL.Seconds()))
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sum := sha256.Sum256([]byte(state.Verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	redirect(w, p.authURL(f.conf, f.redirectURI, state.State, state.Nonce, challenge))
+}
+
+// handles the identity provider redirect: exchanges the code and
+// creates the session
+func (m *OIDCMiddleware) callback(w http.ResponseWriter, r *http.Request, f *flow) {
+	value, err := f.login.read(r)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "no login in progress")
+		return
+	}
+	data, err := f.login.sealer.open(f.login.name, value)
+	state := loginState{}
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	q := r.URL.Query()
+	if err != nil || state.State == "" || q.Get("state") != state.State {
+		errorResponse(w, http.StatusBadRequest, "invalid state")
+		return
+	}
+	// the state is single use
+	f.login.clearFrom(w, r, 0)
+
+	if e := q.Get("error"); e != "" {
+		log.Debug().Str("error", e).Str("description", q.Get("error_description")).Msg("login failed")
+		errorResponse(w, http.StatusUnauthorized, "login failed: "+e)
+		return
+	}
+
+	p, err := m.getProvider(f.conf.Issuer)
+	if err != nil {
+		log.Err(err).Str("issuer", f.conf.Issuer).Msg("unable to discover the identity provider")
+		errorResponse(w, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+	t, err := p.exchange(f.conf, q.Get("code"), state.Verifier, f.redirectURI)
+	if err != nil {
+		log.Err(err).Msg("unable to exchange the authorization code")
+		errorResponse(w, http.StatusBadGateway, "unable to exchange the authorization code")
+		return
+	}
+	claims, err := p.verify(f.conf, t.IDToken, state.Nonce)
+	if err != nil {
+		log.Debug().Err(err).Msg("invalid id token")
+		errorResponse(w, http.StatusUnauthorized, "invalid id token")
+		return
+	}
+
+	s := &session{
+		Claims:       claims,
+		IDToken:      t.IDToken,
+		AccessToken:  t.AccessToken,
+		RefreshToken: t.RefreshToken,
+		Expiry:       expiry(t, claims),
+		Expires:      time.Now().Add(f.conf.SessionTTL),
+	}
+	if err := f.store.save(w, r, s, true); err != nil {
+		log.Err(err).Msg("unable to save the session")
+		errorResponse(w, http.StatusInternalServerError, "unable to save the session")
+		return
+	}
+
+	// relative urls only: no open redirects
+	to := state.RedirectTo
+	if !strings.HasPrefix(to, "/") || strings.HasPrefix(to, "//") || strings.HasPrefix(to, "/\\") {
+		to = f.mountPath
+	}
+	redirect(w, to)
+}
+
+// removes the session and, if supported, logs out from the identity
+// provider too
+func (m *OIDCMiddleware) logout(w http.ResponseWriter, r *http.Request, f *flow) {
+	idToken := ""
+	if s, err := f.store.load(r); err == nil {
+		idToken = s.IDToken
+	}
+	f.store.clear(w, r)
+
+	to := f.conf.PostLogoutRedirectURL
+	if p, err := m.getProvider(f.conf.Issuer); err == nil {
+		if u := p.logoutURL(f.conf, idToken); u != "" {
+			to = u
+		}
+	}
+	if to == "" {
+		to = f.mountPath
+	}
+	redirect(w, to)
+}
@@ -0,0 +1,350 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/middleware/cache"
+	"github.com/ferama/crauti/pkg/store"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// a minimal identity provider. The authorization requests are
+// approved right away
+type stubIdP struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// the authorization requests, by code
+	codes map[string]url.Values
+	// the access tokens lifetime. The refreshed ones last an hour
+	expiresIn int
+	issued    int
+	refreshed int
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &stubIdP{
+		key:       key,
+		codes:     make(map[string]url.Values),
+		expiresIn: 3600,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+			"end_session_endpoint":   idp.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "idp",
+				"alg": "RS256",
+				"n":   encode(key.N.Bytes()),
+				"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		idp.mu.Lock()
+		code := fmt.Sprintf("code-%d", len(idp.codes))
+		idp.codes[code] = q
+		idp.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("logged out"))
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *stubIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	fail := func() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+	}
+	if user, pass, _ := r.BasicAuth(); user != "dashboard" || pass != "secret" {
+		fail()
+		return
+	}
+	r.ParseForm()
+	expiresIn := idp.expiresIn
+	claims := jwt.MapClaims{
+		"iss": idp.URL,
+		"aud": "dashboard",
+		"sub": "bob",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		req, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != req.Get("code_challenge") ||
+			r.PostForm.Get("redirect_uri") != req.Get("redirect_uri") {
+			fail()
+			return
+		}
+		claims["nonce"] = req.Get("nonce")
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != "refresh" {
+			fail()
+			return
+		}
+		idp.refreshed++
+		expiresIn = 3600
+	default:
+		fail()
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp"
+	idToken, _ := token.SignedString(idp.key)
+	idp.issued++
+	json.NewEncoder(w).Encode(map[string]any{
+		"id_token":      idToken,
+		"access_token":  fmt.Sprintf("access-%d", idp.issued),
+		"refresh_token": "refresh",
+		"expires_in":    expiresIn,
+	})
+}
+
+func oidcConf(issuer string) conf.OIDC {
+	enabled := true
+	return conf.OIDC{
+		Enabled:         &enabled,
+		Issuer:          issuer,
+		ClientID:        "dashboard",
+		ClientSecret:    "secret",
+		Scopes:          []string{"openid"},
+		CallbackPath:    "/oauth2/callback",
+		LogoutPath:      "/oauth2/logout",
+		SessionStore:    SessionStoreCookie,
+		CookieName:      "session",
+		CookieSecret:    "test",
+		SessionTTL:      time.Hour,
+		PassAccessToken: &enabled,
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	idp := newStubIdP(t)
+	defer idp.Close()
+
+	var sub, authorization string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, _ = chaincontext.GetChainContext(r).Auth.JwtClaims["sub"].(string)
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("dashboard"))
+	})
+	m := (&OIDCMiddleware{}).Init(upstream)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				OIDC: oidcConf(idp.URL),
+			},
+		}, r)
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	get := func(client *http.Client, u string, accept string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(body)
+	}
+
+	// the api clients are not redirected
+	res, _ := get(browser, s.URL+"/page", "application/json")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+
+	// login. The browser follows the redirects back to the page
+	res, body := get(browser, s.URL+"/page?a=1", "text/html")
+	if res.StatusCode != http.StatusOK || body != "dashboard" || res.Request.URL.RequestURI() != "/page?a=1" {
+		t.Fatalf("unexpected response %d %s %s", res.StatusCode, body, res.Request.URL)
+	}
+	if sub != "bob" || authorization != "Bearer access-1" || idp.refreshed != 0 {
+		t.Fatalf("unexpected upstream auth %s %s", sub, authorization)
+	}
+	get(browser, s.URL+"/page", "application/json")
+	if idp.refreshed != 0 || sub != "bob" {
+		t.Fatalf("the session should be used: %d %s", idp.refreshed, sub)
+	}
+
+	// the access token is about to expire: it is refreshed
+	browser.Jar, _ = cookiejar.New(nil)
+	idp.expiresIn = 5
+	get(browser, s.URL+"/page", "text/html")
+	if idp.refreshed != 1 || authorization != "Bearer access-3" {
+		t.Fatalf("the token should be refreshed: %d %s", idp.refreshed, authorization)
+	}
+	get(browser, s.URL+"/page", "application/json")
+	if idp.refreshed != 1 {
+		t.Fatalf("the refreshed token should be used: %d", idp.refreshed)
+	}
+
+	// a forged state is rejected
+	res, _ = get(browser, s.URL+"/oauth2/callback?code=code-0&state=forged", "text/html")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+
+	// logout, from the identity provider too
+	res, body = get(browser, s.URL+"/oauth2/logout", "text/html")
+	if body != "logged out" || !strings.HasPrefix(res.Request.URL.String(), idp.URL+"/logout") {
+		t.Fatalf("unexpected logout response %s %s", body, res.Request.URL)
+	}
+	noRedirect := &http.Client{
+		Jar: browser.Jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, _ = get(noRedirect, s.URL+"/page", "text/html")
+	if res.StatusCode != http.StatusFound || !strings.HasPrefix(res.Header.Get("Location"), idp.URL+"/authorize") {
+		t.Fatalf("unexpected response %d %s", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	// the scheme doesn't come from the client headers
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/page", nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	res, err := noRedirect.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	location, _ := url.Parse(res.Header.Get("Location"))
+	if !strings.HasPrefix(location.Query().Get("redirect_uri"), "http://") {
+		t.Fatalf("unexpected redirect uri %s", location.Query().Get("redirect_uri"))
+	}
+	for _, c := range res.Cookies() {
+		if c.Secure {
+			t.Fatalf("unexpected secure cookie %s", c.Name)
+		}
+	}
+}
+
+func TestSessionCookiesNotCached(t *testing.T) {
+	conf.ConfInst.CacheStore.Backend = store.BackendMemory
+	store.Update()
+
+	idp := newStubIdP(t)
+	defer idp.Close()
+	// the session is refreshed right after the login
+	idp.expiresIn = 5
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("dashboard"))
+	})
+	c := (&cache.CacheMiddleware{}).Init(upstream)
+	m := (&OIDCMiddleware{}).Init(c)
+
+	enabled := true
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(&conf.MountPoint{
+			Path:     "/",
+			Upstream: "http://upstream",
+			Middlewares: conf.Middlewares{
+				OIDC: oidcConf(idp.URL),
+				Cache: conf.Cache{
+					Enabled: &enabled,
+					TTL:     time.Minute,
+					Methods: []string{http.MethodGet},
+				},
+			},
+		}, r)
+		r = cc.Update()
+		// the anonymous requests reach the cache directly, like the
+		// ones of another mount point sharing the cache key
+		if r.Header.Get("X-Anonymous") != "" {
+			c.ServeHTTP(w, r)
+			return
+		}
+		m.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/page", nil)
+	req.Header.Set("Accept", "text/html")
+	res, err := browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if idp.refreshed != 1 || res.Header.Get("Set-Cookie") == "" {
+		t.Fatalf("the session should be refreshed: %d", idp.refreshed)
+	}
+	if !strings.Contains(res.Header.Get("Cache-Control"), "no-store") {
+		t.Fatalf("unexpected Cache-Control '%s'", res.Header.Get("Cache-Control"))
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, s.URL+"/page", nil)
+	req.Header.Set("X-Anonymous", "1")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get(cache.GeneratorHeaderKey) != cache.CachedContentHeaderValue {
+		t.Fatal("expected a cached response")
+	}
+	if res.Header.Get("Set-Cookie") != "" {
+		t.Fatalf("the session cookie was replayed: %s", res.Header.Get("Set-Cookie"))
+	}
+}
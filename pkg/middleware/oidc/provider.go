@@ -0,0 +1,209 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// the signing algorithms accepted for the id tokens
+var idTokenAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// an identity provider, as discovered from its openid configuration
+type provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+	// optional. Used by the RP-initiated logout
+	EndSessionEndpoint string `json:"end_session_endpoint"`
+
+	jwks   *keyfunc.JWKS
+	client *http.Client
+}
+
+// the token endpoint response
+type tokens struct {
+	IDToken      string `json:"id_token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// the token endpoint error response
+type tokenError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func discover(issuer string) (*provider, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	res, err := client.Get(wellKnown)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected discovery response status %d", res.StatusCode)
+	}
+
+	p := &provider{client: client}
+	if err := json.NewDecoder(res.Body).Decode(p); err != nil {
+		return nil, err
+	}
+	// OpenID Connect Discovery 1.0, section 4.3
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("unexpected issuer '%s'", p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JwksURI == "" {
+		return nil, errors.New("incomplete openid configuration")
+	}
+
+	p.jwks, err = keyfunc.Get(p.JwksURI, keyfunc.Options{
+		Client: client,
+		RefreshErrorHandler: func(err error) {
+			log.Err(err).Send()
+		},
+		RefreshInterval:   time.Hour,
+		RefreshRateLimit:  time.Minute * 5,
+		RefreshTimeout:    time.Second * 10,
+		RefreshUnknownKID: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// the authorization request url. The code challenge is the S256 one
+func (p *provider) authURL(c conf.OIDC, redirectURI string, state string, nonce string, challenge string) string {
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", c.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(c.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// exchanges the authorization code
+func (p *provider) exchange(c conf.OIDC, code string, verifier string, redirectURI string) (*tokens, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("code_verifier", verifier)
+	form.Set("redirect_uri", redirectURI)
+	return p.token(c, form)
+}
+
+func (p *provider) refresh(c conf.OIDC, refreshToken string) (*tokens, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	return p.token(c, form)
+}
+
+// calls the token endpoint. The confidential clients authenticate
+// using client_secret_basic
+func (p *provider) token(c conf.OIDC, form url.Values) (*tokens, error) {
+	if c.ClientSecret == "" {
+		form.Set("client_id", c.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		e := tokenError{}
+		json.Unmarshal(body, &e)
+		return nil, fmt.Errorf("token endpoint status %d: %s %s", res.StatusCode, e.Error, e.ErrorDescription)
+	}
+
+	t := &tokens{}
+	if err := json.Unmarshal(body, t); err != nil {
+		return nil, err
+	}
+	if t.AccessToken == "" {
+		return nil, errors.New("no access token returned")
+	}
+	return t, nil
+}
+
+// verifies the id token and returns its claims. The nonce is not
+// checked if empty (refreshed tokens)
+func (p *provider) verify(c conf.OIDC, idToken string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(jwt.WithValidMethods(idTokenAlgorithms)).ParseWithClaims(idToken, claims, p.jwks.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, errors.New("unexpected issuer")
+	}
+	if !claims.VerifyAudience(c.ClientID, true) {
+		return nil, errors.New("unexpected audience")
+	}
+	if nonce != "" && claims["nonce"] != nonce {
+		return nil, errors.New("unexpected nonce")
+	}
+	return claims, nil
+}
+
+// the RP-initiated logout url. Empty if the provider doesn't support it
+func (p *provider) logoutURL(c conf.OIDC, idToken string) string {
+	if p.EndSessionEndpoint == "" {
+		return ""
+	}
+	q := url.Values{}
+	q.Set("client_id", c.ClientID)
+	if idToken != "" {
+		q.Set("id_token_hint", idToken)
+	}
+	if c.PostLogoutRedirectURL != "" {
+		q.Set("post_logout_redirect_uri", c.PostLogoutRedirectURL)
+	}
+
+	sep := "?"
+	if strings.Contains(p.EndSessionEndpoint, "?") {
+		sep = "&"
+	}
+	return p.EndSessionEndpoint + sep + q.Encode()
+}
@@ -0,0 +1,288 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferama/crauti/pkg/redis"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	SessionStoreCookie = "cookie"
+	SessionStoreRedis  = "redis"
+
+	// the redis key head of the sessions
+	sessionKeyHead = "OIDCSESSION"
+
+	// the browsers limit the cookies to 4kb. The larger values are
+	// split into more cookies
+	cookieChunkSize = 3800
+	maxCookieChunks = 8
+)
+
+var errNoSession = errors.New("no session")
+
+// an authenticated browser session
+type session struct {
+	// the id token claims
+	Claims       jwt.MapClaims `json:"claims"`
+	IDToken      string        `json:"idToken,omitempty"`
+	AccessToken  string        `json:"accessToken"`
+	RefreshToken string        `json:"refreshToken,omitempty"`
+	// the access token expiration
+	Expiry time.Time `json:"expiry"`
+	// the session expiration. The tokens are not refreshed after it
+	Expires time.Time `json:"expires"`
+}
+
+// the access token is refreshed a bit before its expiration
+func (s *session) needsRefresh(now time.Time) bool {
+	return !s.Expiry.IsZero() && now.Add(10*time.Second).After(s.Expiry)
+}
+
+// encrypts and authenticates the cookie values using AES-GCM
+type sealer struct {
+	aead cipher.AEAD
+}
+
+var (
+	ephemeralSecretOnce sync.Once
+	ephemeralSecret     string
+)
+
+func newSealer(secret string) *sealer {
+	if secret == "" {
+		ephemeralSecretOnce.Do(func() {
+			log.Warn().Msg("using an ephemeral oidc cookie secret")
+			ephemeralSecret = randomString()
+		})
+		secret = ephemeralSecret
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &sealer{aead: aead}
+}
+
+// the name binds the value to its cookie: a value can't be moved
+// to another cookie
+func (s *sealer) seal(name string, value []byte) string {
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	out := s.aead.Seal(nonce, nonce, value, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+func (s *sealer) open(name string, value string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("invalid cookie value")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, []byte(name))
+}
+
+// 32 random bytes, base64url encoded
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// the cookies attributes
+type cookieJar struct {
+	name   string
+	path   string
+	secure bool
+	sealer *sealer
+}
+
+func (j *cookieJar) cookie(name string, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     j.path,
+		MaxAge:   maxAge,
+		Secure:   j.secure,
+		HttpOnly: true,
+		// the cookies must be sent back by the identity provider
+		// redirects to the callback
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// sets the cookie. The responses setting cookies are never stored by
+// the shared caches
+func (j *cookieJar) set(w http.ResponseWriter, c *http.Cookie) {
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.SetCookie(w, c)
+}
+
+// the cookie chunks names
+func (j *cookieJar) chunkName(idx int) string {
+	if idx == 0 {
+		return j.name
+	}
+	return fmt.Sprintf("%s_%d", j.name, idx)
+}
+
+// reads the value split into the chunk cookies
+func (j *cookieJar) read(r *http.Request) (string, error) {
+	value := strings.Builder{}
+	for idx := 0; idx < maxCookieChunks; idx++ {
+		c, err := r.Cookie(j.chunkName(idx))
+		if err != nil {
+			break
+		}
+		value.WriteString(c.Value)
+	}
+	if value.Len() == 0 {
+		return "", errNoSession
+	}
+	return value.String(), nil
+}
+
+// writes the value splitting it into chunks. The chunks left over by
+// a larger value are removed
+func (j *cookieJar) write(w http.ResponseWriter, r *http.Request, value string, maxAge int) error {
+	if len(value) > cookieChunkSize*maxCookieChunks {
+		return errors.New("the session is too large")
+	}
+	idx := 0
+	for ; len(value) > 0; idx++ {
+		size := min(len(value), cookieChunkSize)
+		j.set(w, j.cookie(j.chunkName(idx), value[:size], maxAge))
+		value = value[size:]
+	}
+	j.clearFrom(w, r, idx)
+	return nil
+}
+
+// removes the chunk cookies from the idx one on
+func (j *cookieJar) clearFrom(w http.ResponseWriter, r *http.Request, idx int) {
+	for ; idx < maxCookieChunks; idx++ {
+		if _, err := r.Cookie(j.chunkName(idx)); err != nil {
+			break
+		}
+		j.set(w, j.cookie(j.chunkName(idx), "", -1))
+	}
+}
+
+// keeps the sessions
+type sessionStore interface {
+	load(r *http.Request) (*session, error)
+	// renew is true on login: the redis session ids are never
+	// reused, to prevent the session fixation
+	save(w http.ResponseWriter, r *http.Request, s *session, renew bool) error
+	clear(w http.ResponseWriter, r *http.Request)
+}
+
+// keeps the whole session into the encrypted cookies
+type cookieStore struct {
+	jar *cookieJar
+}
+
+func (s *cookieStore) load(r *http.Request) (*session, error) {
+	value, err := s.jar.read(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.jar.sealer.open(s.jar.name, value)
+	if err != nil {
+		return nil, err
+	}
+	out := &session{}
+	err = json.Unmarshal(data, out)
+	return out, err
+}
+
+func (s *cookieStore) save(w http.ResponseWriter, r *http.Request, sess *session, renew bool) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	maxAge := int(time.Until(sess.Expires).Seconds())
+	return s.jar.write(w, r, s.jar.sealer.seal(s.jar.name, data), maxAge)
+}
+
+func (s *cookieStore) clear(w http.ResponseWriter, r *http.Request) {
+	s.jar.clearFrom(w, r, 0)
+}
+
+// keeps the sessions into redis. The cookie holds the encrypted session
+// id only. The keys are persistent: the cache purge all keeps them
+type redisStore struct {
+	jar *cookieJar
+}
+
+func (s *redisStore) id(r *http.Request) (string, error) {
+	value, err := s.jar.read(r)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.jar.sealer.open(s.jar.name, value)
+	return string(id), err
+}
+
+func (s *redisStore) key(id string) string {
+	return fmt.Sprintf("%s%s:%s", redis.PersistentKeyHead, sessionKeyHead, id)
+}
+
+func (s *redisStore) load(r *http.Request) (*session, error) {
+	id, err := s.id(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := redis.CacheInstance().Get(s.key(id))
+	if err != nil {
+		return nil, err
+	}
+	out := &session{}
+	err = json.Unmarshal(data, out)
+	return out, err
+}
+
+func (s *redisStore) save(w http.ResponseWriter, r *http.Request, sess *session, renew bool) error {
+	id, err := s.id(r)
+	previous := ""
+	if err != nil || renew {
+		if err == nil {
+			previous = id
+		}
+		id = randomString()
+	}
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(sess.Expires)
+	if err := redis.CacheInstance().Set(s.key(id), data, ttl); err != nil {
+		return err
+	}
+	// the renewed session replaces the previous one
+	if previous != "" {
+		redis.CacheInstance().Del(s.key(previous))
+	}
+	return s.jar.write(w, r, s.jar.sealer.seal(s.jar.name, []byte(id)), int(ttl.Seconds()))
+}
+
+func (s *redisStore) clear(w http.ResponseWriter, r *http.Request) {
+	if id, err := s.id(r); err == nil {
+		redis.CacheInstance().Del(s.key(id))
+	}
+	s.jar.clearFrom(w, r, 0)
+}
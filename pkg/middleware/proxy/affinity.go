@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+// returns the value the request is hashed on. Empty if the request
+// doesn't carry it
+func affinityKey(r *http.Request, ctx chaincontext.ChainContext) string {
+	c := ctx.Conf.Middlewares.Affinity.Hash
+	switch c.Source {
+	case conf.AffinityHashHeader:
+		return r.Header.Get(c.Name)
+	case conf.AffinityHashIP:
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return ip
+	case conf.AffinityHashClaim:
+		if v, ok := ctx.Auth.JwtClaims[c.Name]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// pins the client to a target with the affinity cookie. The cookie is
+// (re)issued if it is missing or if its target is gone or unhealthy
+func pickByCookie(w http.ResponseWriter, r *http.Request, ctx chaincontext.ChainContext, b *balancer) *target {
+	c := ctx.Conf.Middlewares.Affinity.Cookie
+	if cookie, err := r.Cookie(c.Name); err == nil {
+		if t := b.byID(cookie.Value); t != nil && t.healthy() {
+			return t
+		}
+	}
+
+	t := b.roundRobin()
+	cookie := &http.Cookie{
+		Name:     c.Name,
+		Value:    t.id,
+		Path:     ctx.Conf.Path,
+		Secure:   c.IsSecure(),
+		HttpOnly: c.IsHTTPOnly(),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if c.TTL > 0 {
+		cookie.MaxAge = int(c.TTL.Seconds())
+	}
+	http.SetCookie(w, cookie)
+	return t
+}
+
+// picks the upstream target of the request
+func pickTarget(w http.ResponseWriter, r *http.Request, ctx chaincontext.ChainContext, b *balancer) *target {
+	if len(b.targets) == 1 {
+		return b.targets[0]
+	}
+	switch ctx.Conf.Middlewares.Affinity.Mode {
+	case conf.AffinityModeCookie:
+		return pickByCookie(w, r, ctx, b)
+	case conf.AffinityModeHash:
+		if key := affinityKey(r, ctx); key != "" {
+			return b.hashed(key)
+		}
+	}
+	return b.roundRobin()
+}
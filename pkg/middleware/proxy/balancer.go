@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+// virtual nodes of each target into the consistent hashing ring. More
+// nodes spread the keys more evenly
+const ringReplicas = 100
+
+// an upstream target of a mount point and its passive health
+type target struct {
+	url *url.URL
+	// identifies the target into the affinity cookie without
+	// disclosing its address
+	id string
+
+	mu       sync.Mutex
+	failures int
+	// the target is skipped until then
+	unhealthyUntil time.Time
+}
+
+func (t *target) healthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !time.Now().Before(t.unhealthyUntil)
+}
+
+// records a failed request. The target is marked unhealthy after
+// MaxFails consecutive failures
+func (t *target) failed(c conf.UpstreamHealth) {
+	if c.MaxFails <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures++
+	if t.failures >= c.MaxFails {
+		t.failures = 0
+		t.unhealthyUntil = time.Now().Add(c.FailTimeout)
+		log.Warn().
+			Str("upstream", t.url.String()).
+			Str("failTimeout", c.FailTimeout.String()).
+			Msg("upstream target marked unhealthy")
+	}
+}
+
+func (t *target) succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures = 0
+}
+
+type ringNode struct {
+	hash   uint32
+	target *target
+}
+
+// Balances the requests across the upstream targets of a mount point
+type balancer struct {
+	targets []*target
+	// the targets virtual nodes sorted by hash
+	ring []ringNode
+	next atomic.Uint64
+}
+
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// builds the balancer of the mount point targets: the Upstream one and
+// the Upstreams. The invalid urls are skipped
+func newBalancer(mp *conf.MountPoint) *balancer {
+	b := &balancer{}
+	for _, raw := range append([]string{mp.Upstream}, mp.Upstreams...) {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			log.Error().Str("upstream", raw).Str("mountPath", mp.Path).Msg("invalid upstream url. skipping it")
+			continue
+		}
+		sum := sha256.Sum256([]byte(u.String()))
+		t := &target{
+			url: u,
+			id:  hex.EncodeToString(sum[:8]),
+		}
+		b.targets = append(b.targets, t)
+		for i := 0; i < ringReplicas; i++ {
+			b.ring = append(b.ring, ringNode{
+				hash:   hashKey(t.id + "-" + strconv.Itoa(i)),
+				target: t,
+			})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+	return b
+}
+
+// picks the next healthy target. If all of them are unhealthy, the
+// next one is returned anyway
+func (b *balancer) roundRobin() *target {
+	n := uint64(len(b.targets))
+	start := b.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if t := b.targets[(start+i)%n]; t.healthy() {
+			return t
+		}
+	}
+	return b.targets[start%n]
+}
+
+// picks the target owning the key into the ring. The unhealthy targets
+// are skipped: their keys move to the next targets of the ring, the
+// other keys keep their target
+func (b *balancer) hashed(key string) *target {
+	h := hashKey(key)
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= h
+	})
+	for i := 0; i < len(b.ring); i++ {
+		if t := b.ring[(start+i)%len(b.ring)].target; t.healthy() {
+			return t
+		}
+	}
+	return b.ring[start%len(b.ring)].target
+}
+
+// returns nil if there is no target with the id
+func (b *balancer) byID(id string) *target {
+	for _, t := range b.targets {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
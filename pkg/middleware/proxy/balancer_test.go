@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/chaincontext"
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+func TestBalancerHashed(t *testing.T) {
+	b := newBalancer(&conf.MountPoint{
+		Upstream:  "http://backend-1",
+		Upstreams: []string{"http://backend-2", "http://backend-3", "::invalid"},
+	})
+	if len(b.targets) != 3 {
+		t.Fatalf("expected 3 targets, got %d", len(b.targets))
+	}
+
+	pinned := map[string]*target{}
+	used := map[*target]bool{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		pinned[key] = b.hashed(key)
+		used[pinned[key]] = true
+		if b.hashed(key) != pinned[key] {
+			t.Fatal("the keys should be pinned to their target")
+		}
+	}
+	if len(used) != 3 {
+		t.Fatal("the keys should be spread across the targets")
+	}
+
+	// only the keys of the unhealthy target move
+	down := b.targets[0]
+	down.failed(conf.UpstreamHealth{MaxFails: 1, FailTimeout: time.Minute})
+	for key, target := range pinned {
+		got := b.hashed(key)
+		if got == down || (target != down && got != target) {
+			t.Fatalf("unexpected target for %s", key)
+		}
+	}
+}
+
+// proxies the requests to the upstreams using the cookie affinity
+func buildServer(upstreams ...string) *httptest.Server {
+	mp := &conf.MountPoint{
+		Path:      "/",
+		Upstream:  upstreams[0],
+		Upstreams: upstreams[1:],
+		Middlewares: conf.Middlewares{
+			Affinity: conf.Affinity{Mode: conf.AffinityModeCookie},
+			UpstreamHealth: conf.UpstreamHealth{
+				MaxFails:    1,
+				FailTimeout: time.Minute,
+			},
+		},
+	}
+	mp.Middlewares.Affinity.Cookie.Name = "affinity"
+	m := (&ReverseProxyMiddleware{}).Init(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := chaincontext.NewChainContext()
+		cc.Reset(mp, r)
+		r = cc.Update()
+		m.ServeHTTP(w, r)
+	}))
+}
+
+func TestCookieAffinity(t *testing.T) {
+	backends := map[string]*httptest.Server{}
+	upstreams := []string{}
+	for _, name := range []string{"a", "b"} {
+		name := name
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer s.Close()
+		backends[name] = s
+		upstreams = append(upstreams, s.URL)
+	}
+	s := buildServer(upstreams...)
+	defer s.Close()
+
+	get := func(cookie *http.Cookie) (string, *http.Response) {
+		req, _ := http.NewRequest(http.MethodGet, s.URL+"/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body), res
+	}
+	affinityCookie := func(res *http.Response) *http.Cookie {
+		for _, c := range res.Cookies() {
+			if c.Name == "affinity" {
+				return c
+			}
+		}
+		return nil
+	}
+
+	pinned, res := get(nil)
+	cookie := affinityCookie(res)
+	if cookie == nil {
+		t.Fatal("the affinity cookie should be issued")
+	}
+	for i := 0; i < 5; i++ {
+		if got, res := get(cookie); got != pinned || affinityCookie(res) != nil {
+			t.Fatalf("expected %s without a new cookie, got %s", pinned, got)
+		}
+	}
+
+	// the pinned target goes down: the request fails and marks it
+	// unhealthy
+	backends[pinned].Close()
+	if _, res := get(cookie); res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected a bad gateway, got %d", res.StatusCode)
+	}
+	got, res := get(cookie)
+	newCookie := affinityCookie(res)
+	if got == pinned || newCookie == nil || newCookie.Value == cookie.Value {
+		t.Fatalf("expected a failover to a new target, got %s", got)
+	}
+	if again, _ := get(newCookie); again != got {
+		t.Fatalf("expected %s, got %s", got, again)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ferama/crauti/pkg/chaincontext"
@@ -45,6 +46,10 @@ type ReverseProxyMiddleware struct {
 	next http.Handler
 
 	patternMatcher *rewriter
+
+	// the mount point upstream targets. Built on the first request
+	balancerOnce sync.Once
+	balancer     *balancer
 }
 
 func (m *ReverseProxyMiddleware) Init(next http.Handler) middleware.Middleware {
@@ -52,17 +57,13 @@ func (m *ReverseProxyMiddleware) Init(next http.Handler) middleware.Middleware {
 	return m
 }
 
-func (m *ReverseProxyMiddleware) director(proxy *httputil.ReverseProxy) func(r *http.Request) {
+func (m *ReverseProxyMiddleware) director(proxy *httputil.ReverseProxy, upstreamUrl *url.URL) func(r *http.Request) {
 	director := proxy.Director
 
 	return func(r *http.Request) {
 		director(r)
 
 		ctx := chaincontext.GetChainContext(r)
-		upstreamUrl, err := url.Parse(ctx.Conf.Upstream)
-		if err != nil {
-			log.Fatal().Err(err)
-		}
 		// set the request host to the real upstream host
 		if ctx.Conf.Middlewares.IsPreserveHostHeader() {
 			r.Host = upstreamUrl.Host
@@ -100,23 +101,37 @@ func (m *ReverseProxyMiddleware) director(proxy *httputil.ReverseProxy) func(r *
 	}
 }
 
-// Creates a new SingleHostReverseProxy object and configures it as needed
-func (m *ReverseProxyMiddleware) buildProxy(upstreamUrl *url.URL) *httputil.ReverseProxy {
+// Creates a new SingleHostReverseProxy object for the upstream target and
+// configures it as needed. The transport errors count as target failures
+func (m *ReverseProxyMiddleware) buildProxy(t *target, mw conf.Middlewares) *httputil.ReverseProxy {
+	upstreamUrl := t.url
 	proxy := httputil.NewSingleHostReverseProxy(upstreamUrl)
 
 	// install the buffer pool
 	proxy.BufferPool = bpool
-	proxy.Director = m.director(proxy)
-
+	proxy.Director = m.director(proxy, upstreamUrl)
+	// the ReverseProxy already flushes immediately text/event-stream
+	// responses and responses of unknown length. This requires that
+	// all the response writers in the chain implement the http.Flusher
+	// interface
+	proxy.FlushInterval = mw.FlushInterval
+
+	proxy.ModifyResponse = func(res *http.Response) error {
+		t.succeeded()
+		return nil
+	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		log.Debug().
 			Str("upstream", fmt.Sprintf("%s://%s", upstreamUrl.Scheme, upstreamUrl.Host)).
 			Msg(err.Error())
 
 		select {
+		// the requests canceled by the client or by the timeout
+		// middleware don't tell anything about the target health
 		case <-r.Context().Done():
 			w.WriteHeader(http.StatusGatewayTimeout)
 		default:
+			t.failed(mw.UpstreamHealth)
 			w.WriteHeader(http.StatusBadGateway)
 		}
 	}
@@ -130,12 +145,9 @@ func (m *ReverseProxyMiddleware) buildProxy(upstreamUrl *url.URL) *httputil.Reve
 func (m *ReverseProxyMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := chaincontext.GetChainContext(r)
 
-	upstreamUrl, err := url.Parse(ctx.Conf.Upstream)
-	if err != nil {
-		log.Fatal().Err(err)
-	}
-
-	proxy := m.buildProxy(upstreamUrl)
+	m.balancerOnce.Do(func() {
+		m.balancer = newBalancer(ctx.Conf)
+	})
 
 	ctx.Proxy.UpstreamRequestStartTime = time.Now()
 
@@ -145,12 +157,22 @@ func (m *ReverseProxyMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	// if we do not have tha cache middleware enabled or if it is enabled but the requests
 	// doesn't hit the cache, poke the upstream
 	cacheEnabled := ctx.Conf.Middlewares.Cache.IsEnabled()
-	if !cacheEnabled || cacheContext.Status != utils.CacheStatusHit {
+	if !cacheEnabled || !cacheContext.ServedFromCache() {
+		if len(m.balancer.targets) == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			m.next.ServeHTTP(w, r)
+			return
+		}
+		t := pickTarget(w, r, ctx, m.balancer)
+		upstreamUrl := t.url
+		ctx.Proxy.Upstream = upstreamUrl.String()
+		rp := m.buildProxy(t, ctx.Conf.Middlewares)
+
 		log.Debug().
 			Str("upstream", fmt.Sprintf("%s://%s", upstreamUrl.Scheme, upstreamUrl.Host)).
 			Msg("poke upstream")
 
-		proxy := http.StripPrefix(ctx.Conf.Path, proxy)
+		proxy := http.StripPrefix(ctx.Conf.Path, rp)
 
 		defer func() {
 			// the call to proxy.ServeHTTP some rows below, will panic if
@@ -175,7 +197,7 @@ func (m *ReverseProxyMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Reques
 
 	} else {
 		log.Debug().
-			Str("upstream", fmt.Sprintf("%s://%s", upstreamUrl.Scheme, upstreamUrl.Host)).
+			Str("mountPath", ctx.Conf.Path).
 			Msg("do not poke upstream: already got from cache")
 	}
 	m.next.ServeHTTP(w, r)
@@ -0,0 +1,116 @@
+package redis
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// the circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrUnavailable is returned without calling redis while the circuit
+// breaker is open
+var ErrUnavailable = errors.New("redis unavailable: circuit breaker open")
+
+// stops calling redis after a number of consecutive failures. After the
+// cooldown a single probe command is let through: the breaker is closed
+// if it succeeds, opened again otherwise
+type breaker struct {
+	mu sync.Mutex
+
+	// 0 disables the breaker
+	failures int
+	cooldown time.Duration
+
+	state    string
+	failed   int
+	openedAt time.Time
+	lastErr  error
+}
+
+func newBreaker(failures int, cooldown time.Duration) *breaker {
+	return &breaker{
+		failures: failures,
+		cooldown: cooldown,
+		state:    BreakerClosed,
+	}
+}
+
+// reports if a command can be sent. The first caller after the
+// cooldown sends the probe
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		// the probe is in flight
+		return false
+	}
+	return true
+}
+
+// like allow, but it doesn't start the probe
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.cooldown
+	case BreakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// records the result of an allowed command
+func (b *breaker) record(err error) {
+	if b.failures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || errors.Is(err, redis.Nil) {
+		if b.state != BreakerClosed {
+			log.Info().Msg("redis is back: circuit breaker closed")
+		}
+		b.state = BreakerClosed
+		b.failed = 0
+		breakerOpen.Set(0)
+		return
+	}
+
+	b.lastErr = err
+	b.failed++
+	if b.state == BreakerHalfOpen || b.failed >= b.failures {
+		if b.state == BreakerClosed {
+			log.Error().Err(err).Msg("redis is failing: circuit breaker open")
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		breakerOpen.Set(1)
+	}
+}
+
+// returns the breaker state and the last error
+func (b *breaker) status() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.lastErr
+}
@@ -0,0 +1,76 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(2, 50*time.Millisecond)
+	failure := errors.New("failure")
+
+	b.record(failure)
+	// not found keys are not failures
+	b.record(redis.Nil)
+	b.record(failure)
+	if !b.allow() {
+		t.Fatal("the failures are not consecutive")
+	}
+	b.record(failure)
+	b.record(failure)
+	if b.allow() || b.available() {
+		t.Fatal("the breaker should be open")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.available() || !b.allow() {
+		t.Fatal("the probe should be allowed")
+	}
+	if b.allow() || b.available() {
+		t.Fatal("only one probe should be allowed")
+	}
+	// the probe failed
+	b.record(failure)
+	if state, _ := b.status(); state != BreakerOpen {
+		t.Fatal("the breaker should be open again")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.allow()
+	b.record(nil)
+	if state, _ := b.status(); state != BreakerClosed || !b.allow() {
+		t.Fatal("the breaker should be closed")
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	// nothing listens there: the commands fail immediately
+	red := conf.Redis{
+		Host:             "127.0.0.1",
+		Port:             1,
+		OperationTimeout: time.Second,
+	}
+	red.CircuitBreaker.Failures = 2
+	red.CircuitBreaker.Cooldown = time.Minute
+	c := newCache(red)
+	defer c.rdb.Close()
+
+	// the startup command is the first failure
+	if _, err := c.Get("key"); err == nil || err == ErrUnavailable {
+		t.Fatalf("expected a connection error, got %v", err)
+	}
+	if c.Available() {
+		t.Fatal("the breaker should be open")
+	}
+	if _, err := c.Get("key"); err != ErrUnavailable {
+		t.Fatal("the command should not be sent")
+	}
+	h := c.Health()
+	if h.Status != "down" || h.Breaker != BreakerOpen || h.Error == ErrUnavailable.Error() {
+		t.Fatalf("unexpected health %+v", h)
+	}
+}
@@ -2,66 +2,212 @@ package redis
 
 import (
 	"context"
-	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/logger"
 	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
 )
 
 var (
-	once     sync.Once
+	log      *zerolog.Logger
+	mu       sync.Mutex
 	instance *cache
 )
 
+const (
+	// fencing counters outlive the locks: tokens must not be reused
+	// while an old lock holder could be still running
+	fenceTTL = 24 * time.Hour
+	// on config changes, the replaced client is closed after this
+	// time, letting the in flight commands complete
+	closeGracePeriod = 10 * time.Second
+
+	// the keys under this head are not cache entries (the oidc sessions
+	// for example): the flushes keep them
+	PersistentKeyHead = "PERSISTENT:"
+)
+
+var (
+	// KEYS[1] lock key, KEYS[2] fencing counter key
+	// ARGV[1] lease (ms), ARGV[2] fencing counter ttl (ms)
+	acquireLockScript = redis.NewScript(`
+if redis.call("exists", KEYS[1]) == 1 then
+	return 0
+end
+local token = redis.call("incr", KEYS[2])
+redis.call("pexpire", KEYS[2], ARGV[2])
+redis.call("set", KEYS[1], token, "px", ARGV[1])
+return token
+`)
+	// KEYS[1] lock key, ARGV[1] token
+	releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+)
+
+func init() {
+	log = logger.GetLogger("redis")
+}
+
 func CacheInstance() *cache {
-	once.Do(func() {
-		var red = conf.ConfInst.Redis
-		instance = newCache(red.Host, red.Port, red.Password)
-	})
+	mu.Lock()
+	defer mu.Unlock()
 
+	if instance == nil {
+		instance = newCache(conf.ConfInst.Redis)
+	}
 	return instance
 }
 
-// intended to be used on config changes
+// intended to be used on config changes. The old client is closed
 func Update() {
-	var red = conf.ConfInst.Redis
-	instance = newCache(red.Host, red.Port, red.Password)
+	mu.Lock()
+	old := instance
+	instance = newCache(conf.ConfInst.Redis)
+	mu.Unlock()
+
+	if old != nil {
+		time.AfterFunc(closeGracePeriod, func() {
+			old.rdb.Close()
+		})
+	}
 }
 
 type cache struct {
-	rdb *redis.Client
+	rdb redis.UniversalClient
+	// the deadline of each command. 0 disables it
+	timeout time.Duration
+	breaker *breaker
 }
 
-func newCache(host string, port int, password string) *cache {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", host, port),
-		Password: password,
-		DB:       0, // use default DB
-	})
+// Health reports the redis status
+type Health struct {
+	// one of: up, down
+	Status string `json:"status"`
+	// the circuit breaker state
+	Breaker string `json:"breaker"`
+	// the last error seen
+	Error string `json:"error,omitempty"`
+}
+
+func newCache(red conf.Redis) *cache {
+	rdb, err := newClient(red)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid redis configuration")
+		// every command fails with the configuration error
+		rdb = redis.NewClient(&redis.Options{
+			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, err
+			},
+		})
+	}
 	c := &cache{
-		rdb: rdb,
+		rdb:     rdb,
+		timeout: red.OperationTimeout,
+		breaker: newBreaker(red.CircuitBreaker.Failures, red.CircuitBreaker.Cooldown),
 	}
-	ctx := context.Background()
 	// run an unintrusive command to start the client connection
-	rdb.Time(ctx)
+	c.do("time", c.timeout, func(ctx context.Context) error {
+		return rdb.Time(ctx).Err()
+	})
 
 	return c
 }
 
-func (c *cache) GetInt(key string) (int, error) {
+// runs a command through the circuit breaker, with a deadline if
+// timeout is greater than 0. It records the command latency and errors
+func (c *cache) do(op string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if !c.breaker.allow() {
+		errorsTotal.WithLabelValues(op, "unavailable").Inc()
+		return ErrUnavailable
+	}
 	ctx := context.Background()
-	val, err := c.rdb.Get(ctx, key).Int()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := fn(ctx)
+	observe(op, time.Since(start), err)
+	c.breaker.record(err)
+	return err
+}
+
+// Available is false while the circuit breaker is open
+func (c *cache) Available() bool {
+	return c.breaker.available()
+}
+
+// Health pings redis and reports its status
+func (c *cache) Health() Health {
+	err := c.do("ping", c.timeout, func(ctx context.Context) error {
+		return c.rdb.Ping(ctx).Err()
+	})
+	state, lastErr := c.breaker.status()
+	h := Health{
+		Status:  "up",
+		Breaker: state,
+	}
 	if err != nil {
-		return 0, err
+		h.Status = "down"
+		h.Error = err.Error()
+		if err == ErrUnavailable && lastErr != nil {
+			h.Error = lastErr.Error()
+		}
 	}
-	return val, nil
+	return h
+}
+
+// runs fn on each master in cluster mode, on the only server otherwise.
+// The masters are visited concurrently
+func (c *cache) forEachMaster(ctx context.Context, fn func(ctx context.Context, node redis.Cmdable) error) error {
+	if cluster, ok := c.rdb.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return fn(ctx, node)
+		})
+	}
+	return fn(ctx, c.rdb)
+}
+
+// in cluster mode the keys handled together by a script must share the
+// slot. The hash tag covers the whole key
+func lockKey(key string) string {
+	return "{" + key + "}"
+}
+
+func fenceKey(key string) string {
+	return lockKey(key) + ":fence"
+}
+
+func (c *cache) GetInt(key string) (int, error) {
+	var val int
+	err := c.do("get", c.timeout, func(ctx context.Context) error {
+		var err error
+		val, err = c.rdb.Get(ctx, key).Int()
+		return err
+	})
+	return val, err
 }
 
 func (c *cache) Get(key string) ([]byte, error) {
-	ctx := context.Background()
-	val, err := c.rdb.Get(ctx, key).Bytes()
+	var val []byte
+	err := c.do("get", c.timeout, func(ctx context.Context) error {
+		var err error
+		val, err = c.rdb.Get(ctx, key).Bytes()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -69,58 +215,265 @@ func (c *cache) Get(key string) ([]byte, error) {
 }
 
 func (c *cache) Set(key string, body interface{}, ttl time.Duration) error {
-	ctx := context.Background()
-	err := c.rdb.Set(ctx, key, body, ttl)
-	if err != nil {
-		return err.Err()
+	return c.do("set", c.timeout, func(ctx context.Context) error {
+		return c.rdb.Set(ctx, key, body, ttl).Err()
+	})
+}
+
+// Del removes the keys and returns the number of removed ones
+func (c *cache) Del(keys ...string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
 	}
-	return nil
+	deleted := 0
+	err := c.do("del", c.timeout, func(ctx context.Context) error {
+		if _, ok := c.rdb.(*redis.ClusterClient); !ok {
+			n, err := c.rdb.Del(ctx, keys...).Result()
+			deleted = int(n)
+			return err
+		}
+
+		// the keys may belong to different slots: delete them one by one.
+		// The pipeline groups the commands by node
+		cmds := make([]*redis.IntCmd, len(keys))
+		pipe := c.rdb.Pipeline()
+		for i, key := range keys {
+			cmds[i] = pipe.Del(ctx, key)
+		}
+		_, err := pipe.Exec(ctx)
+		for _, cmd := range cmds {
+			deleted += int(cmd.Val())
+		}
+		return err
+	})
+	return deleted, err
 }
 
-// FlushallAsync (useful for tests)
-func (c *cache) Flushall() error {
-	ctx := context.Background()
-	err := c.rdb.FlushAll(ctx)
+// the sorted set score of a time: unix milliseconds
+func score(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// Publish posts the message to the channel
+func (c *cache) Publish(channel string, message []byte) error {
+	return c.do("publish", c.timeout, func(ctx context.Context) error {
+		return c.rdb.Publish(ctx, channel, message).Err()
+	})
+}
+
+// Subscribe calls fn with the messages posted to the channel until the
+// returned function is called. The subscription is restored on
+// reconnections, the messages posted meanwhile are lost
+func (c *cache) Subscribe(channel string, fn func(message string)) func() {
+	pubsub := c.rdb.Subscribe(context.Background(), channel)
+	go func() {
+		for msg := range pubsub.Channel() {
+			fn(msg.Payload)
+		}
+	}()
+	return func() {
+		pubsub.Close()
+	}
+}
+
+// ZAdd adds the members to the sorted set stored at key, scored by their
+// expiration (now + ttl). The expired members are removed. The set
+// expiration is extended to ttl, it is never shortened
+func (c *cache) ZAdd(key string, members []string, ttl time.Duration) error {
+	if len(members) == 0 {
+		return nil
+	}
+	now := time.Now()
+	expiresAt := float64(now.Add(ttl).UnixMilli())
+	values := make([]redis.Z, len(members))
+	for i, m := range members {
+		values[i] = redis.Z{Score: expiresAt, Member: m}
+	}
+
+	return c.do("zadd", c.timeout, func(ctx context.Context) error {
+		pipe := c.rdb.TxPipeline()
+		pipe.ZAdd(ctx, key, values...)
+		pipe.ZRemRangeByScore(ctx, key, "-inf", score(now))
+		current := pipe.PTTL(ctx, key)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		// a negative value means that the key has no expiration yet
+		if current.Val() < ttl {
+			return c.rdb.PExpire(ctx, key, ttl).Err()
+		}
+		return nil
+	})
+}
+
+// ZMembers returns the members of the sorted set stored at key that are
+// not expired. The expired ones are removed
+func (c *cache) ZMembers(key string) ([]string, error) {
+	var members []string
+	err := c.do("zmembers", c.timeout, func(ctx context.Context) error {
+		now := score(time.Now())
+		pipe := c.rdb.TxPipeline()
+		pipe.ZRemRangeByScore(ctx, key, "-inf", now)
+		cmd := pipe.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: "(" + now, Max: "+inf"})
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		members = cmd.Val()
+		return nil
+	})
+	return members, err
+}
+
+// ZRange returns a page of the not expired members of the sorted set
+// stored at key, ordered by expiration. A count lesser or equal to 0
+// returns all the members from offset
+func (c *cache) ZRange(key string, offset int, count int) ([]string, error) {
+	if count <= 0 {
+		count = -1
+	}
+	var members []string
+	err := c.do("zrange", c.timeout, func(ctx context.Context) error {
+		var err error
+		members, err = c.rdb.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+			Min:    "(" + score(time.Now()),
+			Max:    "+inf",
+			Offset: int64(offset),
+			Count:  int64(count),
+		}).Result()
+		return err
+	})
+	return members, err
+}
+
+// ZCard returns the number of the not expired members of the sorted set
+// stored at key
+func (c *cache) ZCard(key string) (int, error) {
+	var n int64
+	err := c.do("zcard", c.timeout, func(ctx context.Context) error {
+		var err error
+		n, err = c.rdb.ZCount(ctx, key, "("+score(time.Now()), "+inf").Result()
+		return err
+	})
+	return int(n), err
+}
+
+// ZRem removes the members from the sorted set stored at key
+func (c *cache) ZRem(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(members))
+	for i, m := range members {
+		values[i] = m
+	}
+	return c.do("zrem", c.timeout, func(ctx context.Context) error {
+		return c.rdb.ZRem(ctx, key, values...).Err()
+	})
+}
+
+// AcquireLock tries to acquire the lock stored at key for the lease time.
+// On success it returns a fencing token. Tokens are increasing across the
+// lock holders
+func (c *cache) AcquireLock(key string, lease time.Duration) (int64, bool, error) {
+	var token int64
+	err := c.do("lock", c.timeout, func(ctx context.Context) error {
+		var err error
+		token, err = acquireLockScript.Run(ctx, c.rdb,
+			[]string{lockKey(key), fenceKey(key)},
+			lease.Milliseconds(), fenceTTL.Milliseconds()).Int64()
+		return err
+	})
 	if err != nil {
-		return err.Err()
+		return 0, false, err
 	}
-	return nil
+	return token, token != 0, nil
 }
 
-// FlushallAsync deletes all cache keys
-func (c *cache) FlushallAsync() error {
-	ctx := context.Background()
-	err := c.rdb.FlushAllAsync(ctx)
+// ReleaseLock releases the lock if it is still held with the token
+func (c *cache) ReleaseLock(key string, token int64) error {
+	return c.do("unlock", c.timeout, func(ctx context.Context) error {
+		return releaseLockScript.Run(ctx, c.rdb, []string{lockKey(key)}, token).Err()
+	})
+}
+
+// HoldsLock checks that the lock is still held with the token. It is
+// false if the lease expired
+func (c *cache) HoldsLock(key string, token int64) (bool, error) {
+	var val int64
+	err := c.do("get", c.timeout, func(ctx context.Context) error {
+		var err error
+		val, err = c.rdb.Get(ctx, lockKey(key)).Int64()
+		return err
+	})
+	if err == redis.Nil {
+		return false, nil
+	}
 	if err != nil {
-		return err.Err()
+		return false, err
 	}
-	return nil
+	return val == token, nil
 }
 
-// Flush all keys matching pattern
-func (c *cache) Flush(match string) (int, error) {
-	ctx := context.Background()
-	var cursor uint64 = 0
-	flushedKeys := 0
-	for {
-		var keys []string
+// LockExists checks if someone holds the lock
+func (c *cache) LockExists(key string) (bool, error) {
+	var n int64
+	err := c.do("exists", c.timeout, func(ctx context.Context) error {
 		var err error
-		keys, cursor, err = c.rdb.Scan(ctx, cursor, match, 0).Result()
-		if err != nil {
-			return flushedKeys, err
-		}
+		n, err = c.rdb.Exists(ctx, lockKey(key)).Result()
+		return err
+	})
+	return n == 1, err
+}
 
-		for _, key := range keys {
-			// I'm using expire with 0 here because it's complexity as per docs
-			// is O(1) while del is O(n)
-			c.rdb.Expire(ctx, key, 0)
-			flushedKeys++
-		}
+// FlushallAsync (useful for tests)
+func (c *cache) Flushall() error {
+	return c.do("flushall", 0, func(ctx context.Context) error {
+		return c.forEachMaster(ctx, func(ctx context.Context, node redis.Cmdable) error {
+			return node.FlushAll(ctx).Err()
+		})
+	})
+}
 
-		// no more keys
-		if cursor == 0 {
-			break
-		}
-	}
-	return flushedKeys, nil
+// FlushallAsync deletes all keys, the persistent ones too
+func (c *cache) FlushallAsync() error {
+	return c.do("flushall", 0, func(ctx context.Context) error {
+		return c.forEachMaster(ctx, func(ctx context.Context, node redis.Cmdable) error {
+			return node.FlushAllAsync(ctx).Err()
+		})
+	})
+}
+
+// Flush all keys matching pattern. The keys under the PersistentKeyHead
+// are kept
+func (c *cache) Flush(match string) (int, error) {
+	var flushedKeys atomic.Int64
+	err := c.do("flush", 0, func(ctx context.Context) error {
+		return c.forEachMaster(ctx, func(ctx context.Context, node redis.Cmdable) error {
+			var cursor uint64 = 0
+			for {
+				var keys []string
+				var err error
+				keys, cursor, err = node.Scan(ctx, cursor, match, 0).Result()
+				if err != nil {
+					return err
+				}
+
+				for _, key := range keys {
+					if strings.HasPrefix(key, PersistentKeyHead) {
+						continue
+					}
+					// I'm using expire with 0 here because it's complexity as per docs
+					// is O(1) while del is O(n)
+					node.Expire(ctx, key, 0)
+					flushedKeys.Add(1)
+				}
+
+				// no more keys
+				if cursor == 0 {
+					return nil
+				}
+			}
+		})
+	})
+	return int(flushedKeys.Load()), err
 }
@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/redis/go-redis/v9"
+)
+
+// builds the client for the configured mode: sentinel if a master name
+// is set, cluster if seed nodes are set, single node otherwise.
+// The clients honour the context deadlines (see OperationTimeout)
+func newClient(c conf.Redis) (redis.UniversalClient, error) {
+	tlsConf, err := tlsConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Sentinel.MasterName != "" {
+		if len(c.Sentinel.Addresses) == 0 {
+			return nil, errors.New("sentinel mode requires at least one sentinel address")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       c.Sentinel.MasterName,
+			SentinelAddrs:    c.Sentinel.Addresses,
+			SentinelUsername: c.Sentinel.Username,
+			SentinelPassword: c.Sentinel.Password,
+			Username:         c.Username,
+			Password:         c.Password,
+			DB:               c.DB,
+			TLSConfig:        tlsConf,
+			PoolSize:         c.PoolSize,
+			MinIdleConns:     c.MinIdleConns,
+			DialTimeout:      c.DialTimeout,
+			ReadTimeout:      c.ReadTimeout,
+			WriteTimeout:     c.WriteTimeout,
+			PoolTimeout:      c.PoolTimeout,
+
+			ContextTimeoutEnabled: true,
+		}), nil
+	}
+
+	if len(c.Cluster.Nodes) > 0 {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        c.Cluster.Nodes,
+			Username:     c.Username,
+			Password:     c.Password,
+			TLSConfig:    tlsConf,
+			PoolSize:     c.PoolSize,
+			MinIdleConns: c.MinIdleConns,
+			DialTimeout:  c.DialTimeout,
+			ReadTimeout:  c.ReadTimeout,
+			WriteTimeout: c.WriteTimeout,
+			PoolTimeout:  c.PoolTimeout,
+
+			ContextTimeoutEnabled: true,
+		}), nil
+	}
+
+	return redis.NewClient(&redis.Options{
+		Addr:         fmt.Sprintf("%s:%d", c.Host, c.Port),
+		Username:     c.Username,
+		Password:     c.Password,
+		DB:           c.DB,
+		TLSConfig:    tlsConf,
+		PoolSize:     c.PoolSize,
+		MinIdleConns: c.MinIdleConns,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		PoolTimeout:  c.PoolTimeout,
+
+		ContextTimeoutEnabled: true,
+	}), nil
+}
+
+// returns nil if TLS is disabled
+func tlsConfig(c conf.Redis) (*tls.Config, error) {
+	if !c.TLS.Enabled {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+
+	if c.TLS.CAFile != "" {
+		pem, err := os.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found into '%s'", c.TLS.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		crt, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{crt}
+	}
+	return cfg, nil
+}
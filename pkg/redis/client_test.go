@@ -0,0 +1,67 @@
+package redis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNewClientModes(t *testing.T) {
+	rdb, err := newClient(conf.Redis{Host: "localhost", Port: 6379, DB: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	if c, ok := rdb.(*redis.Client); !ok || c.Options().DB != 2 {
+		t.Fatal("expected a single node client")
+	}
+
+	c := conf.Redis{}
+	c.Cluster.Nodes = []string{"node1:6379", "node2:6379"}
+	rdb, err = newClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	if _, ok := rdb.(*redis.ClusterClient); !ok {
+		t.Fatal("expected a cluster client")
+	}
+
+	c = conf.Redis{}
+	c.Sentinel.MasterName = "mymaster"
+	if _, err := newClient(c); err == nil {
+		t.Fatal("sentinel mode requires the addresses")
+	}
+	c.Sentinel.Addresses = []string{"sentinel:26379"}
+	rdb, err = newClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+}
+
+func TestTLSConfig(t *testing.T) {
+	c := conf.Redis{}
+	if cfg, err := tlsConfig(c); err != nil || cfg != nil {
+		t.Fatal("TLS should be disabled")
+	}
+
+	c.TLS.Enabled = true
+	c.TLS.ServerName = "redis.internal"
+	cfg, err := tlsConfig(c)
+	if err != nil || cfg.ServerName != "redis.internal" {
+		t.Fatal("expected a TLS config")
+	}
+
+	c.TLS.CAFile = filepath.Join(t.TempDir(), "ca.pem")
+	if _, err := tlsConfig(c); err == nil {
+		t.Fatal("a missing CA file should fail")
+	}
+	os.WriteFile(c.TLS.CAFile, []byte("not a certificate"), 0644)
+	if _, err := tlsConfig(c); err == nil {
+		t.Fatal("an invalid CA file should fail")
+	}
+}
@@ -0,0 +1,53 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	CrautiRedisLatency     = "crauti_redis_latency"
+	CrautiRedisErrorsTotal = "crauti_redis_errors_total"
+	CrautiRedisBreakerOpen = "crauti_redis_breaker_open"
+)
+
+// Query example:
+//
+//	histogram_quantile(0.99, rate(crauti_redis_latency_bucket{op="get"}[1m]))
+var latency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    CrautiRedisLatency,
+	Help:    "Redis commands latency",
+	Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+}, []string{"op"})
+
+// the kind label is one of: timeout, error, unavailable (the command
+// was not sent because the circuit breaker is open)
+var errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: CrautiRedisErrorsTotal,
+	Help: "Total redis commands errors",
+}, []string{"op", "kind"})
+
+var breakerOpen = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: CrautiRedisBreakerOpen,
+	Help: "1 if the redis circuit breaker is open",
+})
+
+func observe(op string, took time.Duration, err error) {
+	latency.WithLabelValues(op).Observe(took.Seconds())
+	if err == nil || errors.Is(err, redis.Nil) {
+		return
+	}
+	kind := "error"
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = "timeout"
+	}
+	errorsTotal.WithLabelValues(op, kind).Inc()
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"regexp"
+	"strings"
+)
+
+// converts a redis glob style pattern into a regular expression.
+// Supported patterns:
+//
+//	h?llo matches hello, hallo and hxllo
+//	h*llo matches hllo and heeeello
+//	h[ae]llo matches hello and hallo, but not hillo
+//	h[^e]llo matches hallo, hbllo, ... but not hello
+//	h[a-b]llo matches hallo and hbllo
+//
+// Use \ to escape special characters
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	// (?s): let . match new lines too
+	b.WriteString("(?s)^")
+
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteByte(c)
+		case c == '*':
+			b.WriteString(".*")
+		case c == '?':
+			b.WriteString(".")
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
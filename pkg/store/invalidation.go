@@ -0,0 +1,58 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/ferama/crauti/pkg/redis"
+)
+
+// the redis channel the tiered stores use to propagate the invalidations
+const invalidationChannel = "crauti:store:invalidations"
+
+// asks the other replicas to drop keys from their L1 tier. Exactly one
+// of Keys, Match and All is set
+type invalidation struct {
+	// the replica that published the invalidation
+	Origin string   `json:"origin"`
+	Keys   []string `json:"keys,omitempty"`
+	Match  string   `json:"match,omitempty"`
+	All    bool     `json:"all,omitempty"`
+}
+
+// propagates the invalidations across the replicas
+type invalidationBus interface {
+	publish(inv invalidation) error
+	// calls fn with the invalidations published by any replica, itself
+	// included, until the returned function is called
+	subscribe(fn func(inv invalidation)) func()
+}
+
+func newReplicaID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// the invalidation bus backed by redis pub/sub
+type redisBus struct{}
+
+func (b *redisBus) publish(inv invalidation) error {
+	msg, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return redis.CacheInstance().Publish(invalidationChannel, msg)
+}
+
+func (b *redisBus) subscribe(fn func(inv invalidation)) func() {
+	return redis.CacheInstance().Subscribe(invalidationChannel, func(message string) {
+		inv := invalidation{}
+		if err := json.Unmarshal([]byte(message), &inv); err != nil {
+			log.Error().Err(err).Msg("invalid store invalidation message")
+			return
+		}
+		fn(inv)
+	})
+}
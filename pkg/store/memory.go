@@ -0,0 +1,302 @@
+package store
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+const tierMemory = "memory"
+
+type memoryEntry struct {
+	key   string
+	value []byte
+	// sorted set members and their expiration (see ZAdd)
+	set     map[string]time.Time
+	setSize int64
+
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key)+len(e.value)) + e.setSize
+}
+
+// An in process LRU store bounded by size (keys + values bytes) and
+// entries count
+type memory struct {
+	// values lesser or equal to 0 disable the limit
+	maxSize    int64
+	maxEntries int
+
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	mu sync.Mutex
+}
+
+func newMemory(maxSize int64, maxEntries int) *memory {
+	m := &memory{
+		maxSize:    maxSize,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+	return m
+}
+
+func (m *memory) remove(el *list.Element) {
+	e := el.Value.(*memoryEntry)
+	m.lru.Remove(el)
+	delete(m.entries, e.key)
+	m.size -= e.size()
+}
+
+// evicts the least recently used entries until the limits are
+// satisfied
+func (m *memory) evict() {
+	for m.lru.Len() > 0 {
+		overSize := m.maxSize > 0 && m.size > m.maxSize
+		overEntries := m.maxEntries > 0 && m.lru.Len() > m.maxEntries
+		if !overSize && !overEntries {
+			return
+		}
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *memory) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		lookups(tierMemory, false)
+		return nil, ErrNotFound
+	}
+	e := el.Value.(*memoryEntry)
+	if time.Now().After(e.expiresAt) {
+		m.remove(el)
+		lookups(tierMemory, false)
+		return nil, ErrNotFound
+	}
+	m.lru.MoveToFront(el)
+	lookups(tierMemory, true)
+	return e.value, nil
+}
+
+func (m *memory) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+
+	e := &memoryEntry{
+		key:       key,
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	}
+	// the entry would never fit
+	if m.maxSize > 0 && e.size() > m.maxSize {
+		return nil
+	}
+	m.entries[key] = m.lru.PushFront(e)
+	m.size += e.size()
+	m.evict()
+	return nil
+}
+
+// returns the entry if it exists and it is not expired
+func (m *memory) lookup(key string) (*list.Element, bool) {
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(el.Value.(*memoryEntry).expiresAt) {
+		m.remove(el)
+		return nil, false
+	}
+	return el, true
+}
+
+func (m *memory) Del(keys ...string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		if el, ok := m.lookup(key); ok {
+			m.remove(el)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *memory) ZAdd(key string, members []string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	var e *memoryEntry
+	if el, ok := m.lookup(key); ok {
+		m.lru.MoveToFront(el)
+		e = el.Value.(*memoryEntry)
+		if e.set == nil {
+			e.set = make(map[string]time.Time)
+		}
+		if expiresAt.After(e.expiresAt) {
+			e.expiresAt = expiresAt
+		}
+	} else {
+		e = &memoryEntry{
+			key:       key,
+			set:       make(map[string]time.Time),
+			expiresAt: expiresAt,
+		}
+		m.entries[key] = m.lru.PushFront(e)
+		m.size += e.size()
+	}
+
+	for _, member := range members {
+		if _, ok := e.set[member]; !ok {
+			e.setSize += int64(len(member))
+			m.size += int64(len(member))
+		}
+		e.set[member] = expiresAt
+	}
+	m.prune(e, now)
+	m.evict()
+	return nil
+}
+
+// removes the expired members of the set
+func (m *memory) prune(e *memoryEntry, now time.Time) {
+	for member, expiresAt := range e.set {
+		if now.After(expiresAt) {
+			m.removeMember(e, member)
+		}
+	}
+}
+
+func (m *memory) removeMember(e *memoryEntry, member string) {
+	if _, ok := e.set[member]; !ok {
+		return
+	}
+	delete(e.set, member)
+	e.setSize -= int64(len(member))
+	m.size -= int64(len(member))
+}
+
+func (m *memory) ZMembers(key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := []string{}
+	el, ok := m.lookup(key)
+	if !ok {
+		return members, nil
+	}
+	e := el.Value.(*memoryEntry)
+	m.prune(e, time.Now())
+	for member := range e.set {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (m *memory) ZRange(key string, offset int, count int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := []string{}
+	el, ok := m.lookup(key)
+	if !ok {
+		return members, nil
+	}
+	e := el.Value.(*memoryEntry)
+	m.prune(e, time.Now())
+	for member := range e.set {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := e.set[members[i]], e.set[members[j]]
+		if a.Equal(b) {
+			return members[i] < members[j]
+		}
+		return a.Before(b)
+	})
+
+	if offset > len(members) {
+		offset = len(members)
+	}
+	members = members[offset:]
+	if count > 0 && count < len(members) {
+		members = members[:count]
+	}
+	return members, nil
+}
+
+func (m *memory) ZCard(key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.lookup(key)
+	if !ok {
+		return 0, nil
+	}
+	e := el.Value.(*memoryEntry)
+	m.prune(e, time.Now())
+	return len(e.set), nil
+}
+
+func (m *memory) ZRem(key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.lookup(key); ok {
+		for _, member := range members {
+			m.removeMember(el.Value.(*memoryEntry), member)
+		}
+	}
+	return nil
+}
+
+func (m *memory) Flush(match string) (int, error) {
+	re, err := globToRegexp(match)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	flushed := 0
+	for key, el := range m.entries {
+		if re.MatchString(key) {
+			m.remove(el)
+			flushed++
+		}
+	}
+	return flushed, nil
+}
+
+func (m *memory) Available() bool {
+	return true
+}
+
+func (m *memory) FlushAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lru.Init()
+	m.entries = make(map[string]*list.Element)
+	m.size = 0
+	return nil
+}
@@ -0,0 +1,234 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryMaxEntries(t *testing.T) {
+	m := newMemory(0, 2)
+	m.Set("k1", []byte("v1"), time.Minute)
+	m.Set("k2", []byte("v2"), time.Minute)
+	// k1 is now the most recently used
+	m.Get("k1")
+	m.Set("k3", []byte("v3"), time.Minute)
+
+	if _, err := m.Get("k2"); err != ErrNotFound {
+		t.Fatal("k2 should be evicted")
+	}
+	for _, k := range []string{"k1", "k3"} {
+		if _, err := m.Get(k); err != nil {
+			t.Fatalf("%s expected", k)
+		}
+	}
+}
+
+func TestMemoryMaxSize(t *testing.T) {
+	// each entry is 2 (key) + 8 (value) bytes
+	m := newMemory(25, 0)
+	m.Set("k1", []byte("12345678"), time.Minute)
+	m.Set("k2", []byte("12345678"), time.Minute)
+	m.Set("k3", []byte("12345678"), time.Minute)
+
+	if _, err := m.Get("k1"); err != ErrNotFound {
+		t.Fatal("k1 should be evicted")
+	}
+	if m.size != 20 {
+		t.Fatalf("expected size 20, got %d", m.size)
+	}
+
+	// too large to be stored
+	m.Set("k4", make([]byte, 100), time.Minute)
+	if _, err := m.Get("k4"); err != ErrNotFound {
+		t.Fatal("k4 should not be stored")
+	}
+}
+
+func TestMemoryTTL(t *testing.T) {
+	m := newMemory(0, 0)
+	m.Set("k1", []byte("v1"), 10*time.Millisecond)
+	if _, err := m.Get("k1"); err != nil {
+		t.Fatal("k1 expected")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := m.Get("k1"); err != ErrNotFound {
+		t.Fatal("k1 should be expired")
+	}
+	if m.lru.Len() != 0 || m.size != 0 {
+		t.Fatal("expired entry should be removed")
+	}
+}
+
+func TestMemoryFlush(t *testing.T) {
+	m := newMemory(0, 0)
+	m.Set("BODY:GET/api/config?a=1", []byte("v"), time.Minute)
+	m.Set("BODY:GET/api/other", []byte("v"), time.Minute)
+	m.Set("STATUS:GET/api/config", []byte("v"), time.Minute)
+
+	n, err := m.Flush("*GET/api/config*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 flushed keys, got %d", n)
+	}
+	if _, err := m.Get("BODY:GET/api/other"); err != nil {
+		t.Fatal("BODY:GET/api/other expected")
+	}
+}
+
+func TestGlob(t *testing.T) {
+	tests := map[string]map[string]bool{
+		"h?llo":     {"hello": true, "hallo": true, "hllo": false},
+		"h*llo":     {"hllo": true, "heeeello": true, "hlo": false},
+		"h[ae]llo":  {"hello": true, "hallo": true, "hillo": false},
+		"h[^e]llo":  {"hallo": true, "hello": false},
+		"h[a-b]llo": {"hallo": true, "hbllo": true, "hcllo": false},
+		`h\*llo`:    {"h*llo": true, "hello": false},
+		"a.b":       {"a.b": true, "axb": false},
+	}
+	for pattern, cases := range tests {
+		re, err := globToRegexp(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for input, expected := range cases {
+			if re.MatchString(input) != expected {
+				t.Fatalf("pattern '%s', input '%s': expected %v", pattern, input, expected)
+			}
+		}
+	}
+}
+
+func TestTiered(t *testing.T) {
+	l1 := newMemory(0, 0)
+	l2 := newMemory(0, 0)
+	s := newTiered(l1, l2, time.Minute, nil)
+
+	l2.Set("k1", []byte("v1"), time.Minute)
+	val, err := s.Get("k1")
+	if err != nil || string(val) != "v1" {
+		t.Fatal("v1 expected")
+	}
+	// the entry should be promoted to l1
+	if _, err := l1.Get("k1"); err != nil {
+		t.Fatal("k1 expected in l1")
+	}
+
+	s.Set("k2", []byte("v2"), time.Minute)
+	if _, err := l2.Get("k2"); err != nil {
+		t.Fatal("k2 expected in l2")
+	}
+
+	s.Flush("k*")
+	if _, err := s.Get("k1"); err != ErrNotFound {
+		t.Fatal("k1 should be flushed")
+	}
+}
+
+// delivers the invalidations synchronously to the subscribers
+type localBus struct {
+	subscribers []func(inv invalidation)
+}
+
+func (b *localBus) publish(inv invalidation) error {
+	for _, fn := range b.subscribers {
+		fn(inv)
+	}
+	return nil
+}
+
+func (b *localBus) subscribe(fn func(inv invalidation)) func() {
+	b.subscribers = append(b.subscribers, fn)
+	return func() {}
+}
+
+func TestTieredInvalidation(t *testing.T) {
+	bus := &localBus{}
+	l2 := newMemory(0, 0)
+	l1a, l1b := newMemory(0, 0), newMemory(0, 0)
+	a := newTiered(l1a, l2, time.Minute, bus)
+	b := newTiered(l1b, l2, time.Minute, bus)
+
+	inL1 := func(l1 *memory, key string) bool {
+		_, err := l1.Get(key)
+		return err == nil
+	}
+
+	a.Set("k1", []byte("v1"), time.Minute)
+	b.Get("k1")
+	// overwritten by the other replica
+	a.Set("k1", []byte("v2"), time.Minute)
+	if inL1(l1b, "k1") || !inL1(l1a, "k1") {
+		t.Fatal("k1 should be dropped from the other replica l1 only")
+	}
+	if val, _ := b.Get("k1"); string(val) != "v2" {
+		t.Fatal("v2 expected")
+	}
+
+	a.Del("k1")
+	if inL1(l1b, "k1") {
+		t.Fatal("k1 should be deleted from the other replica l1")
+	}
+
+	b.Set("k2", []byte("v2"), time.Minute)
+	b.Set("x1", []byte("v1"), time.Minute)
+	a.Get("k2")
+	a.Get("x1")
+	b.Flush("k*")
+	if inL1(l1a, "k2") || !inL1(l1a, "x1") {
+		t.Fatal("only k2 should be flushed from the other replica l1")
+	}
+	b.FlushAll()
+	if inL1(l1a, "x1") {
+		t.Fatal("x1 should be flushed from the other replica l1")
+	}
+}
+
+func TestMemorySortedSets(t *testing.T) {
+	m := newMemory(0, 0)
+	m.ZAdd("s1", []string{"a", "b"}, time.Minute)
+	m.ZAdd("s1", []string{"b", "c"}, 10*time.Millisecond)
+
+	members, _ := m.ZMembers("s1")
+	if len(members) != 3 {
+		t.Fatalf("expected 3 members, got %v", members)
+	}
+	// 2 (key) + 3 (members) bytes
+	if m.size != 5 {
+		t.Fatalf("expected size 5, got %d", m.size)
+	}
+
+	// the expired members are pruned. The set expiration is never
+	// shortened
+	time.Sleep(20 * time.Millisecond)
+	if members, _ := m.ZMembers("s1"); len(members) != 1 || members[0] != "a" {
+		t.Fatalf("expected the a member only, got %v", members)
+	}
+	if m.size != 3 {
+		t.Fatalf("expected size 3, got %d", m.size)
+	}
+	m.ZAdd("s1", []string{"d"}, 2*time.Minute)
+	m.ZAdd("s1", []string{"e"}, 30*time.Second)
+	if n, _ := m.ZCard("s1"); n != 3 {
+		t.Fatalf("expected 3 members, got %d", n)
+	}
+	// ordered by expiration
+	if page, _ := m.ZRange("s1", 1, 5); len(page) != 2 || page[0] != "a" || page[1] != "d" {
+		t.Fatalf("unexpected page %v", page)
+	}
+	m.ZRem("s1", "d", "e")
+
+	m.ZRem("s1", "a", "missing")
+	if members, _ := m.ZMembers("s1"); len(members) != 0 || m.size != 2 {
+		t.Fatalf("unexpected members %v", members)
+	}
+
+	m.Set("k1", []byte("v1"), time.Minute)
+	if deleted, _ := m.Del("s1", "k1", "missing"); deleted != 2 {
+		t.Fatalf("expected 2 deleted keys, got %d", deleted)
+	}
+	if m.size != 0 {
+		t.Fatalf("expected size 0, got %d", m.size)
+	}
+}
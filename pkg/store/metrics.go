@@ -0,0 +1,25 @@
+package store
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const CrautiCacheStoreLookupsTotal = "crauti_cache_store_lookups_total"
+
+// Query example (hit ratio per tier):
+//
+//	sum by (tier) (crauti_cache_store_lookups_total{result="hit"}) /
+//	sum by (tier) (crauti_cache_store_lookups_total)
+var lookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: CrautiCacheStoreLookupsTotal,
+	Help: "Total cache store lookups",
+}, []string{"tier", "result"})
+
+func lookups(tier string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	lookupsTotal.WithLabelValues(tier, result).Inc()
+}
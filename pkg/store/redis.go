@@ -0,0 +1,71 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ferama/crauti/pkg/redis"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const tierRedis = "redis"
+
+// The shared store. Uses the redis connection from the redis package
+type redisStore struct{}
+
+func (s *redisStore) Get(key string) ([]byte, error) {
+	val, err := redis.CacheInstance().Get(key)
+	if err != nil {
+		lookups(tierRedis, false)
+		if errors.Is(err, goredis.Nil) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	lookups(tierRedis, true)
+	return val, nil
+}
+
+func (s *redisStore) Set(key string, value []byte, ttl time.Duration) error {
+	return redis.CacheInstance().Set(key, value, ttl)
+}
+
+func (s *redisStore) Del(keys ...string) (int, error) {
+	return redis.CacheInstance().Del(keys...)
+}
+
+func (s *redisStore) ZAdd(key string, members []string, ttl time.Duration) error {
+	return redis.CacheInstance().ZAdd(key, members, ttl)
+}
+
+func (s *redisStore) ZMembers(key string) ([]string, error) {
+	return redis.CacheInstance().ZMembers(key)
+}
+
+func (s *redisStore) ZRange(key string, offset int, count int) ([]string, error) {
+	return redis.CacheInstance().ZRange(key, offset, count)
+}
+
+func (s *redisStore) ZCard(key string) (int, error) {
+	return redis.CacheInstance().ZCard(key)
+}
+
+func (s *redisStore) ZRem(key string, members ...string) error {
+	return redis.CacheInstance().ZRem(key, members...)
+}
+
+func (s *redisStore) Flush(match string) (int, error) {
+	return redis.CacheInstance().Flush(match)
+}
+
+// false while the redis circuit breaker is open
+func (s *redisStore) Available() bool {
+	return redis.CacheInstance().Available()
+}
+
+// scans the keys instead of flushing the whole database: the keys under
+// the redis.PersistentKeyHead are kept
+func (s *redisStore) FlushAll() error {
+	_, err := redis.CacheInstance().Flush("*")
+	return err
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/logger"
+	"github.com/ferama/crauti/pkg/utils"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+const (
+	BackendRedis  = "redis"
+	BackendMemory = "memory"
+	BackendTiered = "tiered"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+var (
+	log *zerolog.Logger
+
+	mu       sync.Mutex
+	instance Store
+)
+
+func init() {
+	// this one is here to make some init vars available to other
+	// init functions.
+	// The use case is the CRAUTI_DEBUG that need to be available as
+	// soon as possibile in order to instantiate the logger correctly
+	viper.ReadInConfig()
+	conf.Update()
+
+	log = logger.GetLogger("store")
+}
+
+// Store is the cache storage backend used by the cache middleware
+type Store interface {
+	// returns ErrNotFound if the key doesn't exist or it is expired
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	// removes the keys and returns the number of removed ones
+	Del(keys ...string) (int, error)
+	// adds the members to the sorted set stored at key. The members are
+	// scored by their expiration (now + ttl) and the expired ones are
+	// removed. The set expiration is extended to ttl, it is never
+	// shortened
+	ZAdd(key string, members []string, ttl time.Duration) error
+	// returns the members of the sorted set stored at key that are not
+	// expired. An empty slice is returned if the set doesn't exist
+	ZMembers(key string) ([]string, error)
+	// returns a page of the not expired members of the sorted set stored
+	// at key, ordered by expiration. A count lesser or equal to 0 returns
+	// all the members from offset
+	ZRange(key string, offset int, count int) ([]string, error)
+	// returns the number of the not expired members of the sorted set
+	// stored at key
+	ZCard(key string) (int, error)
+	// removes the members from the sorted set stored at key
+	ZRem(key string, members ...string) error
+	// removes all the keys matching the glob style pattern and returns
+	// the number of removed keys
+	Flush(match string) (int, error)
+	// removes all the keys
+	FlushAll() error
+	// false if the backend is unhealthy. The cache middleware
+	// bypasses the store meanwhile
+	Available() bool
+}
+
+// Instance returns the store configured in conf.ConfInst.CacheStore
+func Instance() Store {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if instance == nil {
+		instance = newStore()
+	}
+	return instance
+}
+
+// intended to be used on config changes
+func Update() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if t, ok := instance.(*tiered); ok {
+		t.close()
+	}
+	instance = newStore()
+}
+
+func newMemoryFromConf() *memory {
+	c := conf.ConfInst.CacheStore.Memory
+	maxSize, err := utils.ConvertToBytes(c.MaxSize)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to parse the memory store maxSize")
+	}
+	return newMemory(maxSize, c.MaxEntries)
+}
+
+func newStore() Store {
+	backend := conf.ConfInst.CacheStore.Backend
+	switch backend {
+	case BackendMemory:
+		return newMemoryFromConf()
+	case BackendTiered:
+		l1TTL := conf.ConfInst.CacheStore.Tiered.L1TTL
+		return newTiered(newMemoryFromConf(), &redisStore{}, l1TTL, &redisBus{})
+	case BackendRedis:
+	default:
+		log.Error().Msgf("unknown cache store backend '%s'. reverting to redis", backend)
+	}
+	return &redisStore{}
+}
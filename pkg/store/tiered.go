@@ -0,0 +1,144 @@
+package store
+
+import (
+	"time"
+)
+
+// Serves hot keys from the in memory L1 tier using the shared L2 tier
+// as fallback.
+// The L1 tier is local to each replica: the keys removed or overwritten
+// by a replica are dropped from the L1 tier of the other ones through
+// the invalidation bus. The messages lost while the bus is unreachable
+// leave stale copies around for up to l1TTL
+type tiered struct {
+	l1 Store
+	l2 Store
+
+	// max time an entry lives in l1
+	l1TTL time.Duration
+
+	// nil disables the invalidations propagation
+	bus         invalidationBus
+	id          string
+	unsubscribe func()
+}
+
+func newTiered(l1 Store, l2 Store, l1TTL time.Duration, bus invalidationBus) *tiered {
+	t := &tiered{
+		l1:    l1,
+		l2:    l2,
+		l1TTL: l1TTL,
+		bus:   bus,
+		id:    newReplicaID(),
+	}
+	if bus != nil {
+		t.unsubscribe = bus.subscribe(t.invalidated)
+	}
+	return t
+}
+
+// drops the keys invalidated by the other replicas from l1
+func (t *tiered) invalidated(inv invalidation) {
+	if inv.Origin == t.id {
+		return
+	}
+	switch {
+	case inv.All:
+		t.l1.FlushAll()
+	case inv.Match != "":
+		t.l1.Flush(inv.Match)
+	default:
+		t.l1.Del(inv.Keys...)
+	}
+}
+
+func (t *tiered) publish(inv invalidation) {
+	if t.bus == nil {
+		return
+	}
+	inv.Origin = t.id
+	if err := t.bus.publish(inv); err != nil {
+		log.Error().Err(err).Msg("unable to publish the store invalidation")
+	}
+}
+
+// stops receiving the invalidations of the other replicas
+func (t *tiered) close() {
+	if t.unsubscribe != nil {
+		t.unsubscribe()
+	}
+}
+
+func (t *tiered) Get(key string) ([]byte, error) {
+	val, err := t.l1.Get(key)
+	if err == nil {
+		return val, nil
+	}
+	val, err = t.l2.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	// promote the entry
+	t.l1.Set(key, val, t.l1TTL)
+	return val, nil
+}
+
+func (t *tiered) Set(key string, value []byte, ttl time.Duration) error {
+	l1TTL := t.l1TTL
+	if ttl < l1TTL {
+		l1TTL = ttl
+	}
+	t.l1.Set(key, value, l1TTL)
+	if err := t.l2.Set(key, value, ttl); err != nil {
+		return err
+	}
+	// the other replicas may hold the previous value
+	t.publish(invalidation{Keys: []string{key}})
+	return nil
+}
+
+func (t *tiered) Del(keys ...string) (int, error) {
+	t.l1.Del(keys...)
+	t.publish(invalidation{Keys: keys})
+	return t.l2.Del(keys...)
+}
+
+// sets live in the shared tier only: they need to be consistent
+// across the replicas
+func (t *tiered) ZAdd(key string, members []string, ttl time.Duration) error {
+	return t.l2.ZAdd(key, members, ttl)
+}
+
+func (t *tiered) ZMembers(key string) ([]string, error) {
+	return t.l2.ZMembers(key)
+}
+
+func (t *tiered) ZRange(key string, offset int, count int) ([]string, error) {
+	return t.l2.ZRange(key, offset, count)
+}
+
+func (t *tiered) ZCard(key string) (int, error) {
+	return t.l2.ZCard(key)
+}
+
+func (t *tiered) ZRem(key string, members ...string) error {
+	return t.l2.ZRem(key, members...)
+}
+
+func (t *tiered) Flush(match string) (int, error) {
+	t.l1.Flush(match)
+	t.publish(invalidation{Match: match})
+	return t.l2.Flush(match)
+}
+
+// the memory tier keeps working if the shared one fails: the store
+// degrades to the local cache
+func (t *tiered) Available() bool {
+	return t.l1.Available()
+}
+
+func (t *tiered) FlushAll() error {
+	t.l1.FlushAll()
+	t.publish(invalidation{All: true})
+	return t.l2.FlushAll()
+}
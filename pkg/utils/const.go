@@ -8,4 +8,11 @@ const (
 	CacheStatusHit     = "HIT"
 	CacheStatusIgnored = "IGN"
 	CacheStatusMiss    = "MIS"
+	// a stale entry was validated by the upstream with a 304 response
+	CacheStatusRevalidated = "REVALIDATED"
+	// a stale entry was served while revalidating it in background
+	// or because the upstream failed
+	CacheStatusStale = "STALE"
+	// the cache store is unavailable: the request went to the upstream
+	CacheStatusBypassError = "BYPASS_ERROR"
 )
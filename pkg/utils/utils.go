@@ -17,6 +17,9 @@ func ConvertToBytes(s string) (int64, error) {
 	if s == "0" {
 		return 0, nil
 	}
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid size: '%s'", s)
+	}
 
 	// Get the numeric value as a string
 	numStr := s[:len(s)-2]
@@ -0,0 +1,49 @@
+package warmup
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// a response writer that keeps the status code only. The body is
+// captured up to limit bytes if capture is true
+type recorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+
+	capture  bool
+	limit    int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(statusCode int) {
+	if r.wroteHeader {
+		return
+	}
+	r.status = statusCode
+	r.wroteHeader = true
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.capture || r.overflow {
+		return len(data), nil
+	}
+	if r.body.Len()+len(data) > r.limit {
+		r.overflow = true
+		r.body.Reset()
+		return len(data), nil
+	}
+	return r.body.Write(data)
+}
+
+// the streaming responses flush
+func (r *recorder) Flush() {}
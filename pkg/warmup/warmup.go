@@ -0,0 +1,407 @@
+package warmup
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+	"github.com/ferama/crauti/pkg/logger"
+	"github.com/rs/zerolog"
+)
+
+const (
+	userAgent = "crauti-warmup"
+	// the limit of the sitemap protocol
+	maxSitemapSize = 50 * 1024 * 1024
+	// nested sitemap indexes are followed up to this depth
+	maxSitemapDepth = 2
+	// the number of errors kept into the progress report
+	maxErrors = 20
+)
+
+var (
+	log      *zerolog.Logger
+	once     sync.Once
+	instance *Warmer
+)
+
+func init() {
+	log = logger.GetLogger("warmup")
+}
+
+// Instance returns the Warmer singleton
+func Instance() *Warmer {
+	once.Do(func() {
+		instance = &Warmer{}
+	})
+	return instance
+}
+
+// Progress reports the state of the last warmup run
+type Progress struct {
+	Running    bool       `json:"running"`
+	Runs       int        `json:"runs"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	NextRunAt  *time.Time `json:"nextRunAt,omitempty"`
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Failed     int        `json:"failed"`
+	// the last errors
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Warmer populates the cache fetching a list of urls through the
+// gateway chain. The requests are sent with Cache-Control: max-age=0, so
+// entries that are still fresh are refreshed (or revalidated in rfc9111
+// mode) too.
+// Each replica runs its own warmup
+type Warmer struct {
+	mu      sync.Mutex
+	handler http.Handler
+	// the configuration taken on the last update
+	conf conf.Warmup
+	// cancels the scheduler and the run in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	// identifies the last run. The stopped runs don't report
+	// their progress
+	runID int
+
+	progress Progress
+}
+
+// Update (re)starts the scheduler using the last configuration. The run
+// in progress, if any, is stopped. The handler is the gateway one
+func (w *Warmer) Update(handler http.Handler) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.handler = handler
+	w.conf = conf.ConfInst.Warmup
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.runID++
+	w.progress.Running = false
+	w.progress.NextRunAt = nil
+
+	c := w.conf
+	if len(c.URLs) == 0 && c.File == "" && len(c.Sitemaps) == 0 {
+		return
+	}
+	go w.schedule(w.ctx, c.Interval)
+}
+
+func (w *Warmer) schedule(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		w.Run(nil)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// a tick while a run is still in progress is skipped
+		w.Run(nil)
+
+		next := time.Now().Add(interval)
+		w.mu.Lock()
+		w.progress.NextRunAt = &next
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run starts a warmup run in background. The configured urls are
+// used if urls is empty. It returns false if a run is already in progress
+func (w *Warmer) Run(urls []string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.progress.Running || w.handler == nil {
+		return false
+	}
+	now := time.Now()
+	w.runID++
+	w.progress = Progress{
+		Running:   true,
+		Runs:      w.progress.Runs + 1,
+		StartedAt: &now,
+		NextRunAt: w.progress.NextRunAt,
+	}
+	go w.run(w.ctx, w.runID, w.handler, w.conf, urls)
+	return true
+}
+
+// Progress returns the state of the last run
+func (w *Warmer) Progress() Progress {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p := w.progress
+	p.Errors = append([]string(nil), w.progress.Errors...)
+	return p
+}
+
+func (w *Warmer) report(id int, rawURL string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if id != w.runID {
+		return
+	}
+	w.progress.Done++
+	if err == nil {
+		return
+	}
+	w.progress.Failed++
+	w.addError(rawURL, err)
+}
+
+// must be called holding the lock
+func (w *Warmer) addError(rawURL string, err error) {
+	log.Debug().Err(err).Str("url", rawURL).Msg("warmup failed")
+
+	w.progress.Errors = append(w.progress.Errors, fmt.Sprintf("%s: %s", rawURL, err))
+	if len(w.progress.Errors) > maxErrors {
+		w.progress.Errors = w.progress.Errors[1:]
+	}
+}
+
+func (w *Warmer) run(ctx context.Context, id int, handler http.Handler, c conf.Warmup, urls []string) {
+	if len(urls) == 0 {
+		var errs map[string]error
+		urls, errs = collectURLs(ctx, handler, c)
+
+		w.mu.Lock()
+		if id == w.runID {
+			for source, err := range errs {
+				w.addError(source, err)
+			}
+		}
+		w.mu.Unlock()
+	}
+
+	w.mu.Lock()
+	if id == w.runID {
+		w.progress.Total = len(urls)
+	}
+	w.mu.Unlock()
+
+	log.Info().Int("urls", len(urls)).Msg("warmup started")
+
+	concurrency := c.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rawURL := range queue {
+				w.report(id, rawURL, warm(ctx, handler, rawURL, c))
+			}
+		}()
+	}
+
+enqueue:
+	for _, rawURL := range urls {
+		select {
+		case queue <- rawURL:
+		case <-ctx.Done():
+			break enqueue
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if id != w.runID {
+		log.Info().Msg("warmup stopped")
+		return
+	}
+	now := time.Now()
+	w.progress.Running = false
+	w.progress.FinishedAt = &now
+
+	log.Info().
+		Int("done", w.progress.Done).
+		Int("failed", w.progress.Failed).
+		Dur("took", now.Sub(*w.progress.StartedAt)).
+		Msg("warmup finished")
+}
+
+// fetches an url through the gateway, populating the cache
+func warm(ctx context.Context, handler http.Handler, rawURL string, c conf.Warmup) error {
+	header := http.Header{}
+	for k, v := range c.Headers {
+		header.Set(k, v)
+	}
+	// refresh the entries that are still fresh
+	header.Set("Cache-Control", "max-age=0")
+
+	rec := &recorder{header: http.Header{}}
+	if err := do(ctx, handler, rawURL, header, rec, c.Timeout); err != nil {
+		return err
+	}
+	if rec.status >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", rec.status)
+	}
+	return nil
+}
+
+// serves a GET request using the gateway handler
+func do(ctx context.Context, handler http.Handler, rawURL string, header http.Header, rec *recorder, timeout time.Duration) (err error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	r.RequestURI = r.URL.RequestURI()
+	// let the redirect middleware know that https urls don't need
+	// to be redirected
+	if r.URL.Scheme == "https" {
+		r.TLS = &tls.ConnectionState{}
+	}
+	r.Header.Set("User-Agent", userAgent)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+
+	// the handlers abort the responses panicking. The http server
+	// recovers them, do the same here
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("request aborted: %v", p)
+		}
+	}()
+	handler.ServeHTTP(rec, r)
+	return ctx.Err()
+}
+
+// returns the configured urls, deduplicated. The errors are keyed
+// by their source
+func collectURLs(ctx context.Context, handler http.Handler, c conf.Warmup) ([]string, map[string]error) {
+	urls := []string{}
+	errs := make(map[string]error)
+	seen := make(map[string]bool)
+	add := func(list []string) {
+		for _, u := range list {
+			u = strings.TrimSpace(u)
+			if u == "" || seen[u] {
+				continue
+			}
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+
+	add(c.URLs)
+	if c.File != "" {
+		list, err := readFile(c.File)
+		if err != nil {
+			errs[c.File] = err
+		}
+		add(list)
+	}
+	for _, sm := range c.Sitemaps {
+		if sm == "" {
+			continue
+		}
+		list, err := readSitemap(ctx, handler, sm, c, 0)
+		if err != nil {
+			errs[sm] = err
+		}
+		add(list)
+	}
+	return urls, errs
+}
+
+func readFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	urls := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// both the urlset and the sitemapindex documents
+type sitemap struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+func readSitemap(ctx context.Context, handler http.Handler, rawURL string, c conf.Warmup, depth int) ([]string, error) {
+	header := http.Header{}
+	for k, v := range c.Headers {
+		header.Set(k, v)
+	}
+	rec := &recorder{header: http.Header{}, capture: true, limit: maxSitemapSize}
+	if err := do(ctx, handler, rawURL, header, rec, c.Timeout); err != nil {
+		return nil, err
+	}
+	if rec.status != http.StatusOK {
+		return nil, fmt.Errorf("status %d", rec.status)
+	}
+	if rec.overflow {
+		return nil, fmt.Errorf("sitemap larger than %d bytes", maxSitemapSize)
+	}
+
+	sm := sitemap{}
+	if err := xml.Unmarshal(rec.body.Bytes(), &sm); err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	for _, u := range sm.URLs {
+		urls = append(urls, strings.TrimSpace(u.Loc))
+	}
+	if depth >= maxSitemapDepth {
+		return urls, nil
+	}
+	for _, s := range sm.Sitemaps {
+		list, err := readSitemap(ctx, handler, strings.TrimSpace(s.Loc), c, depth+1)
+		if err != nil {
+			return urls, err
+		}
+		urls = append(urls, list...)
+	}
+	return urls, nil
+}
@@ -0,0 +1,129 @@
+package warmup
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ferama/crauti/pkg/conf"
+)
+
+type upstream struct {
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/sitemap_index.xml":
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>http://example.com/sitemap.xml</loc></sitemap>
+</sitemapindex>`)
+		return
+	case "/sitemap.xml":
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://example.com/s1</loc></url>
+  <url><loc> http://example.com/s2 </loc></url>
+</urlset>`)
+		return
+	case "/broken":
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if r.Header.Get("Cache-Control") != "max-age=0" || r.Header.Get("Accept-Encoding") != "gzip" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	u.mu.Lock()
+	u.hits[r.Host+r.URL.Path]++
+	u.mu.Unlock()
+}
+
+func wait(t *testing.T, w *Warmer) Progress {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p := w.Progress(); !p.Running && p.FinishedAt != nil {
+			return p
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("warmup not finished")
+	return Progress{}
+}
+
+func TestWarmup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "urls.txt")
+	os.WriteFile(file, []byte("# comment\n\n/f1\nhttp://example.com/s1\n"), 0644)
+
+	old := conf.ConfInst.Warmup
+	defer func() { conf.ConfInst.Warmup = old }()
+	conf.ConfInst.Warmup = conf.Warmup{
+		URLs:        []string{"/u1", "/broken", "/u1"},
+		File:        file,
+		Sitemaps:    []string{"http://example.com/sitemap_index.xml", "/missing.xml"},
+		Headers:     map[string]string{"accept-encoding": "gzip"},
+		Concurrency: 2,
+	}
+
+	u := &upstream{hits: make(map[string]int)}
+	w := &Warmer{}
+	w.Update(u)
+	p := wait(t, w)
+
+	if p.Total != 5 || p.Done != 5 || p.Failed != 1 {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+	// the broken url and the sitemap answering with a 400
+	if len(p.Errors) != 2 {
+		t.Fatalf("unexpected errors %v", p.Errors)
+	}
+	for _, k := range []string{"/u1", "/f1", "example.com/s1", "example.com/s2"} {
+		if u.hits[k] != 1 {
+			t.Fatalf("%s should be fetched once, got %d", k, u.hits[k])
+		}
+	}
+
+	// explicit urls
+	if !w.Run([]string{"/u2"}) {
+		t.Fatal("the run should start")
+	}
+	if p = wait(t, w); p.Total != 1 || p.Runs != 2 || u.hits["/u2"] != 1 {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+}
+
+func TestWarmupSchedule(t *testing.T) {
+	old := conf.ConfInst.Warmup
+	defer func() { conf.ConfInst.Warmup = old }()
+	conf.ConfInst.Warmup = conf.Warmup{
+		URLs:        []string{"/u1"},
+		Headers:     map[string]string{"Accept-Encoding": "gzip"},
+		Concurrency: 1,
+		Interval:    50 * time.Millisecond,
+	}
+
+	u := &upstream{hits: make(map[string]int)}
+	w := &Warmer{}
+	w.Update(u)
+	time.Sleep(300 * time.Millisecond)
+
+	// stop the scheduler
+	conf.ConfInst.Warmup = conf.Warmup{}
+	w.Update(u)
+
+	u.mu.Lock()
+	hits := u.hits["/u1"]
+	u.mu.Unlock()
+	if hits < 3 {
+		t.Fatalf("expected the warmup to rerun, got %d runs", hits)
+	}
+	if w.Progress().NextRunAt != nil {
+		t.Fatal("no run should be scheduled")
+	}
+}